@@ -0,0 +1,344 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/dexm-coin/wagon/wasm"
+)
+
+// abiSection is the name of the custom section of a module with its ABI
+const abiSection = "abi"
+
+// ABI describes the functions and the state of a contract, so that tools can
+// call it and show its state without knowing its code. It's the JSON in the
+// abi custom section of the module.
+//
+// Types are i32, u32, i64, u64 and bool, passed as arguments of the WASM
+// function, or string, address and bytes, passed as the input of the call.
+// A function can only have one parameter of the latter kind, as the input is
+// copied to its (ptr: i32, len: i32) parameters.
+type ABI struct {
+	Functions []*ABIFunction
+	Storage   []*ABIVariable `json:",omitempty"`
+}
+
+// ABIFunction is a function exported by the contract. Returns is the type of
+// the return value, or of the data set with result() for string, address and
+// bytes.
+type ABIFunction struct {
+	Name    string
+	Params  []*ABIParam `json:",omitempty"`
+	Returns string      `json:",omitempty"`
+}
+
+// ABIParam is a parameter of a function
+type ABIParam struct {
+	Name string
+	Type string
+}
+
+// ABIVariable is a variable of the state of a contract, saved in the storage
+// under Key or, for contracts without storage, in the memory at Offset. Size
+// is only needed for string, address and bytes in the memory.
+type ABIVariable struct {
+	Name   string
+	Type   string
+	Key    string `json:",omitempty"`
+	Offset uint32 `json:",omitempty"`
+	Size   uint32 `json:",omitempty"`
+}
+
+// abiKey is where the ABI of a contract is saved in ContractDb
+func abiKey(address []byte) []byte {
+	return append([]byte("a/"), address...)
+}
+
+// isBufferType is true for the types passed as the input of the call
+func isBufferType(t string) bool {
+	return t == "string" || t == "address" || t == "bytes"
+}
+
+// abiTypeSize returns how many bytes a type uses in memory and the WASM type
+// it's passed as
+func abiTypeSize(t string) (int, wasm.ValueType, error) {
+	switch t {
+	case "i32", "u32":
+		return 4, wasm.ValueTypeI32, nil
+	case "i64", "u64":
+		return 8, wasm.ValueTypeI64, nil
+	case "bool":
+		return 1, wasm.ValueTypeI32, nil
+	case "string", "address", "bytes":
+		return 0, wasm.ValueTypeI32, nil
+	}
+	return 0, 0, fmt.Errorf("Unknown ABI type %s", t)
+}
+
+// ParseABI decodes an ABI
+func ParseABI(raw []byte) (*ABI, error) {
+	abi := &ABI{}
+	err := json.Unmarshal(raw, abi)
+	if err != nil {
+		return nil, err
+	}
+	return abi, nil
+}
+
+// Function returns the function with the name
+func (abi *ABI) Function(name string) (*ABIFunction, error) {
+	for _, fn := range abi.Functions {
+		if fn.Name == name {
+			return fn, nil
+		}
+	}
+	return nil, fmt.Errorf("The ABI has no function %s", name)
+}
+
+// readABI returns the ABI in the abi section of a module, checked against its
+// exports. If there is no abi section it returns nil.
+func readABI(m *wasm.Module) ([]byte, error) {
+	var raw []byte
+	for _, s := range m.Other {
+		if s.Name == abiSection {
+			raw = s.Bytes
+		}
+	}
+	if raw == nil {
+		return nil, nil
+	}
+
+	abi, err := ParseABI(raw)
+	if err != nil {
+		return nil, errors.New("Invalid ABI")
+	}
+
+	for _, fn := range abi.Functions {
+		err = checkABIFunction(m, fn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range abi.Storage {
+		if _, _, err := abiTypeSize(v.Type); err != nil {
+			return nil, err
+		}
+	}
+
+	return raw, nil
+}
+
+// checkABIFunction checks that a function of the ABI matches the signature of
+// the exported function
+func checkABIFunction(m *wasm.Module, fn *ABIFunction) error {
+	mismatch := fmt.Errorf("The ABI of %s doesn't match the code", fn.Name)
+
+	if m.Export == nil {
+		return mismatch
+	}
+	entry, ok := m.Export.Entries[fn.Name]
+	if !ok || entry.Kind != wasm.ExternalFunction {
+		return mismatch
+	}
+	f := m.GetFunction(int(entry.Index))
+	if f == nil {
+		return mismatch
+	}
+
+	var params []wasm.ValueType
+	for _, p := range fn.Params {
+		_, wasmType, err := abiTypeSize(p.Type)
+		if err != nil {
+			return err
+		}
+
+		if isBufferType(p.Type) {
+			if len(fn.Params) != 1 {
+				return mismatch
+			}
+			params = []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32}
+			break
+		}
+		params = append(params, wasmType)
+	}
+
+	if len(params) != len(f.Sig.ParamTypes) {
+		return mismatch
+	}
+	for i := range params {
+		if params[i] != f.Sig.ParamTypes[i] {
+			return mismatch
+		}
+	}
+
+	if fn.Returns != "" && !isBufferType(fn.Returns) {
+		_, wasmType, err := abiTypeSize(fn.Returns)
+		if err != nil {
+			return err
+		}
+		if len(f.Sig.ReturnTypes) != 1 || f.Sig.ReturnTypes[0] != wasmType {
+			return mismatch
+		}
+	}
+
+	return nil
+}
+
+// GetContractABI returns the ABI of a contract, if it was deployed with one
+func (sb *StateBatch) GetContractABI(address []byte) (*ABI, error) {
+	raw, err := sb.get(sb.bc.ContractDb, abiKey(address))
+	if err != nil {
+		return nil, err
+	}
+	return ParseABI(raw)
+}
+
+// setContractABI stages the ABI of the module deployed at address, or
+// removes the old one if the module has none
+func (sb *StateBatch) setContractABI(address []byte, m *wasm.Module) error {
+	raw, err := readABI(m)
+	if err != nil {
+		return err
+	}
+
+	if raw == nil {
+		sb.delete(sb.bc.ContractDb, abiKey(address))
+		return nil
+	}
+	sb.put(sb.bc.ContractDb, abiKey(address), raw)
+	return nil
+}
+
+// EncodeCall converts the values typed by a user to the arguments and the
+// input of a call of fn
+func (fn *ABIFunction) EncodeCall(values []string) ([]uint64, []byte, error) {
+	if len(values) != len(fn.Params) {
+		return nil, nil, fmt.Errorf("%s takes %d arguments", fn.Name, len(fn.Params))
+	}
+
+	var args []uint64
+	for i, p := range fn.Params {
+		v := values[i]
+
+		var arg uint64
+		var err error
+		switch p.Type {
+		case "i32":
+			var n int64
+			n, err = strconv.ParseInt(v, 10, 32)
+			arg = uint64(uint32(n))
+		case "u32":
+			arg, err = strconv.ParseUint(v, 10, 32)
+		case "i64":
+			var n int64
+			n, err = strconv.ParseInt(v, 10, 64)
+			arg = uint64(n)
+		case "u64":
+			arg, err = strconv.ParseUint(v, 10, 64)
+		case "bool":
+			var b bool
+			b, err = strconv.ParseBool(v)
+			if b {
+				arg = 1
+			}
+		case "string", "address":
+			return nil, []byte(v), nil
+		case "bytes":
+			data, err := hex.DecodeString(v)
+			return nil, data, err
+		default:
+			err = fmt.Errorf("Unknown ABI type %s", p.Type)
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid %s for %s", p.Type, p.Name)
+		}
+
+		args = append(args, arg)
+	}
+
+	return args, nil, nil
+}
+
+// DecodeResult returns the result of a call of fn as text
+func (fn *ABIFunction) DecodeResult(r *Receipt) string {
+	if isBufferType(fn.Returns) {
+		return DecodeValue(fn.Returns, r.ReturnData)
+	}
+	if fn.Returns == "" || r.ReturnValue == nil {
+		return ""
+	}
+
+	size, _, err := abiTypeSize(fn.Returns)
+	if err != nil {
+		return ""
+	}
+	raw := make([]byte, 8)
+	binary.LittleEndian.PutUint64(raw, *r.ReturnValue)
+	return DecodeValue(fn.Returns, raw[:size])
+}
+
+// DecodeValue returns a value of a type saved in the little endian encoding
+// of WASM as text
+func DecodeValue(t string, raw []byte) string {
+	size, _, err := abiTypeSize(t)
+	if err != nil || len(raw) < size {
+		return hex.EncodeToString(raw)
+	}
+
+	switch t {
+	case "i32":
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(raw))), 10)
+	case "u32":
+		return strconv.FormatUint(uint64(binary.LittleEndian.Uint32(raw)), 10)
+	case "i64":
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(raw)), 10)
+	case "u64":
+		return strconv.FormatUint(binary.LittleEndian.Uint64(raw), 10)
+	case "bool":
+		return strconv.FormatBool(raw[0] != 0)
+	case "string", "address":
+		for i, b := range raw {
+			if b == 0 {
+				return string(raw[:i])
+			}
+		}
+		return string(raw)
+	}
+	return hex.EncodeToString(raw)
+}
+
+// ReadVariable returns the value of a variable of the state of the contract
+// at address as text
+func (sb *StateBatch) ReadVariable(address []byte, v *ABIVariable) (string, error) {
+	if v.Key != "" {
+		raw, err := sb.GetStorage(address, []byte(v.Key))
+		if err != nil {
+			return "", err
+		}
+		return DecodeValue(v.Type, raw), nil
+	}
+
+	state, err := sb.GetContractState(address)
+	if err != nil {
+		return "", err
+	}
+
+	size, _, err := abiTypeSize(v.Type)
+	if err != nil {
+		return "", err
+	}
+	if isBufferType(v.Type) {
+		size = int(v.Size)
+	}
+
+	end := int(v.Offset) + size
+	if end > len(state.GetMemory()) {
+		return "", errors.New("The variable is outside of the memory")
+	}
+	return DecodeValue(v.Type, state.GetMemory()[v.Offset:end]), nil
+}
@@ -1,82 +1,322 @@
 package blockchain
 
 import (
-	"strings"
+	"bytes"
+	"errors"
 
 	"github.com/dexm-coin/dexmd/wallet"
 	"github.com/dexm-coin/wagon/exec"
 	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/blake2b"
 )
 
-func revert(proc *exec.Process) {
-	//	proc.Terminate()
+// ErrReverted is returned when a contract calls revert()
+var ErrReverted = errors.New("Reverted by the contract")
+
+// abort stops the execution of the contract, the transaction fails with err
+// and its changes are rolled back
+func abort(err error) {
+	panic(err)
+}
+
+func (c *Contract) revert(proc *exec.Process) {
+	abort(ErrReverted)
 }
 
 // timestamp returns the time the block was generated, could be manipulated by
 // the block proposers within a range of 5s
-func timestamp(proc *exec.Process) int64 {
-	return int64(0)
+func (c *Contract) timestamp(proc *exec.Process) int64 {
+	return int64(c.Block.GetTimestamp())
 }
 
-// balance returns the balance of the contract, not including value()
-func balance(proc *exec.Process) int64 {
-	/*state, err := currentContract.Chain.GetWalletState(string(currentContract.Address))
+// balance returns the balance of the contract, including value()
+func (c *Contract) balance(proc *exec.Process) int64 {
+	state, err := c.Batch.GetWalletState(string(c.Address))
 	if err != nil {
 		return 0
-	}*/
+	}
 
-	return int64(0)
+	return int64(state.GetBalance())
 }
 
-// value returns the value of the transaction that called the current function
-func value(proc *exec.Process) int64 {
-	return int64(0) //currentContract.Transaction.Amount)
+// value returns the value sent with the call of the current function
+func (c *Contract) value(proc *exec.Process) int64 {
+	return int64(c.Value)
 }
 
 // sender saves the caller of the current function to the specified pointer.
-// if len(sender) > len then an error will be thrown. This is done to avoid
+// if len(sender) > size then an error will be thrown. This is done to avoid
 // memory corruption inside the contract.
-func sender(proc *exec.Process, to, len int64) int64 {
-	senderAddr := wallet.BytesToAddress(currentContract.Transaction.Sender, currentContract.Transaction.Shard)
+func (c *Contract) sender(proc *exec.Process, to, size int32) {
+	senderAddr := c.Caller
 
-	len(senderAddr)
+	if int32(len(senderAddr)) > size {
+		abort(errors.New("The buffer is too small for the sender"))
+	}
 
-	proc.WriteAt([]byte(senderAddr), to)
-	return 0
+	proc.WriteAt([]byte(senderAddr), int64(to))
 }
 
-func pay(proc *exec.Process, to int32, amnt, gas int64) {
+// pay moves amnt from the balance of the contract to the wallet at to. gas is
+// reserved for payments to contracts, a plain transfer doesn't run any code.
+func (c *Contract) pay(proc *exec.Process, to int32, amnt, gas int64) {
 	reciver := readString(proc, to)
 	log.Info("Transaction in contract to ", reciver, amnt, gas)
-	return
+
+	if !wallet.IsWalletValid(reciver) {
+		abort(errors.New("Invalid recipient for pay"))
+	}
+	if amnt < 0 {
+		abort(errors.New("Invalid amount for pay"))
+	}
+
+	err := c.transfer(reciver, uint64(amnt))
+	if err != nil {
+		abort(err)
+	}
+}
+
+// transfer moves amount from the balance of the contract to another wallet
+// and records it in the receipt
+func (c *Contract) transfer(to string, amount uint64) error {
+	sb := c.Batch
+	contractAddr := string(c.Address)
+
+	state, err := sb.GetWalletState(contractAddr)
+	if err != nil || amount > state.GetBalance() {
+		return errors.New("The contract can't pay more than its balance")
+	}
+	state.Balance -= amount
+
+	err = sb.SetState(contractAddr, &state)
+	if err != nil {
+		return err
+	}
+
+	// Ignore error because if the wallet doesn't exist yet we don't care
+	reciverState, _ := sb.GetWalletState(to)
+	reciverState.Balance += amount
+
+	err = sb.SetState(to, &reciverState)
+	if err != nil {
+		return err
+	}
+
+	c.Receipt.Transfers = append(c.Receipt.Transfers, &Transfer{
+		From:   contractAddr,
+		To:     to,
+		Amount: amount,
+	})
+	return nil
 }
 
-func get(proc *exec.Process) {}
+// call runs a function of the contract at addrPtr, which sees this contract
+// as sender(), value taken from the balance of this contract as value() and
+// the args as data(). The callee can use at most gas and that's charged to
+// this contract. If the callee fails all its changes are rolled back and -1
+// is returned, otherwise up to retLen bytes of its result are copied to
+// retPtr and the full length of the result is returned.
+func (c *Contract) call(proc *exec.Process, addrPtr, fnPtr, argsPtr, argsLen int32, value, gas int64, retPtr, retLen int32) int32 {
+	address := readString(proc, addrPtr)
+	function := readString(proc, fnPtr)
+	args := readBytes(proc, argsPtr, argsLen)
 
-func set(proc *exec.Process) {}
+	if value < 0 || gas < 0 {
+		abort(errors.New("Invalid value or gas for call"))
+	}
+
+	// The callee can't use more gas than what is left
+	if left := c.gas.limit - c.gas.used; uint64(gas) > left {
+		gas = int64(left)
+	}
 
-func lock(proc *exec.Process, allowedAddr int32) {
+	snapshot := c.Batch.Snapshot()
+	transfers := len(c.Receipt.Transfers)
+	logs := len(c.Receipt.Logs)
+
+	used, result, err := c.runCall(address, function, args, uint64(value), uint64(gas))
+	if err != nil {
+		log.Info("Call to ", address, " failed: ", err)
+		c.Batch.RevertToSnapshot(snapshot)
+		c.Receipt.Transfers = c.Receipt.Transfers[:transfers]
+		c.Receipt.Logs = c.Receipt.Logs[:logs]
+	}
+
+	c.gas.useGas(proc, int64(used))
+	if err != nil {
+		return -1
+	}
+
+	n := len(result)
+	if n > int(retLen) {
+		n = int(retLen)
+	}
+	if n > 0 {
+		proc.WriteAt(result[:n], int64(retPtr))
+	}
+	return int32(len(result))
+}
+
+// runCall executes the callee of call and returns the gas it used and its
+// result
+func (c *Contract) runCall(address, function string, args []byte, value, gas uint64) (uint64, []byte, error) {
+	if c.callDepth >= maxContractCallDepth {
+		return 0, nil, ErrCallDepth
+	}
+
+	callee, err := GetContract(address, c.Batch, c.Transaction, c.Block)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	callers := append(append([]string{}, c.callers...), string(c.Address))
+	if callee.MemorySnapshot {
+		for _, running := range callers {
+			if running == address {
+				return 0, nil, ErrReentrantCall
+			}
+		}
+	}
+
+	callee.Caller = string(c.Address)
+	callee.callers = callers
+	callee.Value = value
+	callee.Input = args
+	callee.Receipt = c.Receipt
+	callee.callDepth = c.callDepth + 1
+	callee.gas.limit = gas
+
+	if value > 0 {
+		err = c.transfer(address, value)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	err = callee.ExecuteContract(function, nil)
+	if err == nil {
+		err = callee.SaveState()
+	}
+	return callee.GasUsed(), callee.ReturnData, err
+}
+
+// result sets the data returned to the contract that made the call
+func (c *Contract) result(proc *exec.Process, ptr, size int32) {
+	c.ReturnData = readBytes(proc, ptr, size)
+}
+
+// emit adds an event to the receipt, the topic is the 32 bytes at topicPtr
+// and the data the size bytes at dataPtr. If the transaction or the call that
+// emitted it fails the event is dropped.
+func (c *Contract) emit(proc *exec.Process, topicPtr, dataPtr, size int32) {
+	if size > maxLogData {
+		abort(errors.New("The event data is too long"))
+	}
+	topic := readBytes(proc, topicPtr, logTopicSize)
+	data := readBytes(proc, dataPtr, size)
+
+	c.gas.useGas(proc, gasPerLog+int64(len(data))*gasPerLogByte)
+	c.Receipt.Logs = append(c.Receipt.Logs, &Log{
+		Address: string(c.Address),
+		Topic:   topic,
+		Data:    data,
+	})
+}
+
+// readBytes reads size bytes of the memory of the contract at ptr, the
+// contract is stopped if they aren't all there
+func readBytes(proc *exec.Process, ptr, size int32) []byte {
+	if ptr < 0 || size < 0 {
+		abort(errors.New("Invalid memory access"))
+	}
+
+	buf := make([]byte, size)
+	_, err := proc.ReadAt(buf, int64(ptr))
+	if err != nil {
+		abort(errors.New("Invalid memory access"))
+	}
+	return buf
+}
+
+// get copies up to valLen bytes of the value saved under the key to valPtr.
+// It returns the full length of the value or -1 if there is no such key.
+func (c *Contract) get(proc *exec.Process, keyPtr, keyLen, valPtr, valLen int32) int32 {
+	if keyLen > maxStorageKey {
+		abort(errors.New("The storage key is too long"))
+	}
+	key := readBytes(proc, keyPtr, keyLen)
+
+	val, err := c.Batch.GetStorage(c.Address, key)
+	if err != nil {
+		c.gas.useGas(proc, int64(len(key))*gasPerStorageRead)
+		return -1
+	}
+	c.gas.useGas(proc, int64(len(key)+len(val))*gasPerStorageRead)
+
+	n := len(val)
+	if n > int(valLen) {
+		n = int(valLen)
+	}
+	if n > 0 {
+		proc.WriteAt(val[:n], int64(valPtr))
+	}
+	return int32(len(val))
+}
+
+// set saves valLen bytes from valPtr under the key, an empty value deletes it
+func (c *Contract) set(proc *exec.Process, keyPtr, keyLen, valPtr, valLen int32) {
+	if keyLen > maxStorageKey || valLen > maxStorageValue {
+		abort(errors.New("The storage key or value is too long"))
+	}
+	key := readBytes(proc, keyPtr, keyLen)
+	val := readBytes(proc, valPtr, valLen)
+
+	c.gas.useGas(proc, int64(len(key)+len(val))*gasPerStorageWrite)
+	c.Batch.SetStorage(c.Address, key, val)
+}
+
+// lock makes allowedAddr the only wallet that can upgrade the contract
+func (c *Contract) lock(proc *exec.Process, allowedAddr int32) {
 	reciver := readString(proc, allowedAddr)
 
 	// Not checking wallets could lead to contracts locked forever
 	if !wallet.IsWalletValid(reciver) {
-		revert(proc)
-		return
+		abort(errors.New("Invalid wallet for lock"))
 	}
 
-	currentContract.State.Locked = true
+	c.State.Locked = true
+	c.Batch.put(c.Batch.bc.StateDb, lockKey(c.Address), []byte(reciver))
+}
+
+// unlock lets anyone send the upgrades approved by the contract
+func (c *Contract) unlock(proc *exec.Process) {
+	c.State.Locked = false
+	c.Batch.delete(c.Batch.bc.StateDb, lockKey(c.Address))
 }
 
-func unlock(proc *exec.Process) {
-	currentContract.State.Locked = false
+// data copies up to sz bytes of the input of the call to the pointer and
+// returns the full length of the input
+func (c *Contract) data(proc *exec.Process, to int32, sz int32) int32 {
+	txData := c.Input
+
+	n := len(txData)
+	if n > int(sz) {
+		n = int(sz)
+	}
+	if n > 0 {
+		proc.WriteAt(txData[:n], int64(to))
+	}
+
+	return int32(len(txData))
 }
 
-func data(proc *exec.Process, to int32, sz int32) {}
+// approvePatch lets a later transaction replace the code of the contract with
+// the code that has the BLAKE-2b hash at hashPtr
+func (c *Contract) approvePatch(proc *exec.Process, hashPtr int32) {
+	hash := readBytes(proc, hashPtr, blake2b.Size256)
 
-func approvePatch(proc *exec.Process, hashPtr int32) {
-	// This assumes a BLAKE-2b hash
-	hash := make([]byte, 32)
-	proc.ReadAt(hash, int64(hashPtr))
+	c.gas.useGas(proc, int64(len(hash))*gasPerStorageWrite)
+	c.Batch.SetApprovedPatch(c.Address, hash)
 }
 
 func readString(proc *exec.Process, ptr int32) string {
@@ -85,5 +325,8 @@ func readString(proc *exec.Process, ptr int32) string {
 	proc.ReadAt(maxLen, int64(ptr))
 
 	// Return string till the first \x00 byte
-	return strings.TrimRight(string(maxLen), "\x00")
+	if end := bytes.IndexByte(maxLen, 0); end != -1 {
+		maxLen = maxLen[:end]
+	}
+	return string(maxLen)
 }
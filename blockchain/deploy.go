@@ -0,0 +1,208 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/dexm-coin/wagon/exec"
+	"github.com/dexm-coin/wagon/wasm"
+	ops "github.com/dexm-coin/wagon/wasm/operators"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	maxContractSize = 65536
+
+	// Deploying is charged for every byte of code, it's kept by every node
+	gasPerCodeByte = 10
+)
+
+// isFloat is true for the instructions that use floating point numbers, they
+// aren't deterministic across machines
+func isFloat(op byte) bool {
+	switch {
+	case op == ops.F32Load || op == ops.F64Load ||
+		op == ops.F32Store || op == ops.F64Store ||
+		op == ops.F32Const || op == ops.F64Const:
+		return true
+	case op >= ops.F32Eq && op <= ops.F64Ge:
+		return true
+	case op >= ops.F32Abs && op <= ops.F64Copysign:
+		return true
+	case op >= ops.I32TruncSF32 && op <= ops.I32TruncUF64:
+		return true
+	case op >= ops.I64TruncSF32 && op <= ops.F64ReinterpretI64:
+		return true
+	}
+	return false
+}
+
+func isFloatType(t wasm.ValueType) bool {
+	return t == wasm.ValueTypeF32 || t == wasm.ValueTypeF64
+}
+
+// checkFloats returns an error if the module uses floating point numbers
+// anywhere
+func checkFloats(m *wasm.Module) error {
+	err := errors.New("Floating point numbers aren't allowed in contracts")
+
+	if m.Types != nil {
+		for _, sig := range m.Types.Entries {
+			for _, t := range append(sig.ParamTypes, sig.ReturnTypes...) {
+				if isFloatType(t) {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, global := range m.GlobalIndexSpace {
+		if isFloatType(global.Type.Type) {
+			return err
+		}
+	}
+
+	for _, fn := range m.FunctionIndexSpace {
+		if fn.IsHost() {
+			continue
+		}
+
+		for _, local := range fn.Body.Locals {
+			if isFloatType(local.Type) {
+				return err
+			}
+		}
+
+		instrs, ierr := readInstructions(fn.Body.Code)
+		if ierr != nil {
+			return ierr
+		}
+		for _, in := range instrs {
+			if isFloat(in.op) {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateContract checks the code of a contract before it's deployed: it has
+// to be a module smaller than maxContractSize that only imports host
+// functions, doesn't use floats, can be metered and has a valid ABI if it has
+// one. It returns the parsed module.
+func validateContract(code []byte) (*wasm.Module, error) {
+	if len(code) > maxContractSize {
+		return nil, errors.New("The contract is too big")
+	}
+
+	// The host functions are never called, they just need something to be
+	// bound to
+	m, err := wasm.ReadModule(bytes.NewReader(code), (&Contract{}).setupImport)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Import != nil {
+		for _, entry := range m.Import.Entries {
+			if entry.ModuleName != "dexm" || entry.Kind != wasm.ExternalFunction {
+				return nil, fmt.Errorf("Unsupported import %s.%s", entry.ModuleName, entry.FieldName)
+			}
+		}
+	}
+
+	err = checkFloats(m)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = readABI(m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addMeter(m, &gasMeter{})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = exec.NewVM(m)
+	return m, err
+}
+
+// chargeCode validates the code carried by t and charges it to the gas of
+// the transaction
+func chargeCode(t *protobufs.Transaction, receipt *Receipt) (*wasm.Module, error) {
+	if t.GetFunction() != "" {
+		return nil, errors.New("A contract creation can't call a function")
+	}
+
+	code := t.GetData()
+	m, err := validateContract(code)
+	if err != nil {
+		return nil, err
+	}
+
+	cost := uint64(len(code)) * gasPerCodeByte
+	if cost > uint64(t.GetGas()) {
+		receipt.GasUsed = uint64(t.GetGas())
+		return nil, ErrOutOfGas
+	}
+	receipt.GasUsed = cost
+	return m, nil
+}
+
+// deployContract saves the code in the data of t at the address given by
+// wallet.ContractAddress and then runs its init export, if there is one
+func (sb *StateBatch) deployContract(t *protobufs.Transaction, block *protobufs.Block, receipt *Receipt) error {
+	m, err := chargeCode(t, receipt)
+	if err != nil {
+		return err
+	}
+	code := t.GetData()
+
+	address := wallet.ContractAddress(receipt.Sender, t.GetNonce(), t.GetShard())
+	if _, err := sb.GetContractCode([]byte(address)); err == nil {
+		return errors.New("There is already a contract at the address")
+	}
+
+	log.Info("New contract at ", address)
+	sb.SetContractCode([]byte(address), code)
+	receipt.ContractAddress = address
+
+	err = sb.setContractABI([]byte(address), m)
+	if err != nil {
+		return err
+	}
+
+	c, err := GetContract(address, sb, t, block)
+	if err != nil {
+		return err
+	}
+
+	if c.Module.Export == nil {
+		return nil
+	}
+	entry, ok := c.Module.Export.Entries["init"]
+	if !ok || entry.Kind != wasm.ExternalFunction {
+		return nil
+	}
+
+	// The value of the transaction goes to its recipient and the data is
+	// the code, init gets neither
+	c.Receipt = receipt
+	c.Value = 0
+	c.Input = nil
+	c.gas.limit = uint64(t.GetGas()) - receipt.GasUsed
+
+	err = c.ExecuteContract("init", nil)
+	receipt.GasUsed += c.GasUsed()
+	if err != nil {
+		return err
+	}
+
+	return c.SaveState()
+}
@@ -3,43 +3,87 @@ package blockchain
 import (
 	"bytes"
 	"errors"
+	"fmt"
+	"math"
 	"reflect"
 
+	"github.com/dexm-coin/dexmd/wallet"
 	bp "github.com/dexm-coin/protobufs/build/blockchain"
 	"github.com/dexm-coin/wagon/exec"
 	"github.com/dexm-coin/wagon/wasm"
-	"github.com/golang/protobuf/proto"
 	log "github.com/sirupsen/logrus"
-	"github.com/syndtr/goleveldb/leveldb"
 )
 
-var currentContract *Contract
-
 // Contract is the struct that saves the state of a contract
 type Contract struct {
-	ContractDb  *leveldb.DB
-	StateDb     *leveldb.DB
+	Batch       *StateBatch
 	Code        []byte
 	Address     []byte
 	State       *bp.ContractState
 	Block       *bp.Block
 	Chain       *Blockchain
 	Transaction *bp.Transaction
+	Receipt     *Receipt
+
+	// Caller, Value and Input come from the transaction unless the contract
+	// was called by another contract
+	Caller    string
+	Value     uint64
+	Input     []byte
+	callDepth int
+	// callers are the contracts running below this one
+	callers []string
+
+	// ReturnValue is what the function returned, ReturnData what the
+	// contract passed to result()
+	ReturnValue *uint64
+	ReturnData  []byte
+
+	// MemorySnapshot is true for the contracts that don't use get and set,
+	// they keep their whole memory and globals between calls
+	MemorySnapshot bool
 
 	Module *wasm.Module
 	VM     *exec.VM
+
+	gas *gasMeter
 }
 
-// GetContract loads the code and state from the DB and returns an error if there
-// is no code. In case there is no state an empty one will be generated
-func GetContract(address string, contractDb, stateDb *leveldb.DB, bc *Blockchain, tr *bp.Transaction) (*Contract, error) {
-	code, err := contractDb.Get([]byte(address), nil)
+// GetContract loads the code and state from the StateBatch and returns an error
+// if there is no code. In case there is no state an empty one will be generated.
+// The contract runs for the transaction tr inside block and can't use more than
+// the gas of the transaction.
+func GetContract(address string, sb *StateBatch, tr *bp.Transaction, block *bp.Block) (*Contract, error) {
+	code, err := sb.GetContractCode([]byte(address))
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse wasm code
-	m, err := wasm.ReadModule(bytes.NewReader(code), setupImport)
+	c := &Contract{
+		Batch:   sb,
+		Code:    code,
+		Address: []byte(address),
+
+		Block:       block,
+		Chain:       sb.bc,
+		Transaction: tr,
+		Receipt:     &Receipt{},
+
+		gas: &gasMeter{limit: uint64(tr.GetGas())},
+	}
+	if tr != nil {
+		c.Caller = wallet.BytesToAddress(tr.GetSender(), tr.GetShard())
+		c.Value = tr.GetAmount()
+		c.Input = tr.GetData()
+	}
+
+	// Parse wasm code, the host functions are bound to c
+	m, err := wasm.ReadModule(bytes.NewReader(code), c.setupImport)
+	if err != nil {
+		return nil, err
+	}
+
+	err = addMeter(m, c.gas)
 	if err != nil {
 		return nil, err
 	}
@@ -49,69 +93,186 @@ func GetContract(address string, contractDb, stateDb *leveldb.DB, bc *Blockchain
 	if err != nil {
 		return nil, err
 	}
+	c.gas.vm = vm
+
+	// Traps and panics inside the contract are returned as errors instead of
+	// taking down the whole node
+	vm.RecoverPanic = true
 
-	state := bp.ContractState{}
+	c.Module = m
+	c.VM = vm
+	c.MemorySnapshot = usesMemorySnapshot(m)
 
 	// Fetch from DB and use empty state if there is no state in the DB
-	encodedState, err := stateDb.Get([]byte(address), nil)
+	c.State, err = sb.GetContractState([]byte(address))
 	if err != nil {
-		state.Memory = vm.Memory()
-		state.Globals = vm.Globals()
-	} else {
-		proto.Unmarshal(encodedState, &state)
-	}
-
-	return &Contract{
-		ContractDb: contractDb,
-		StateDb:    stateDb,
-		Code:       code,
-		Address:    []byte(address),
-		State:      &state,
-
-		Module:      m,
-		VM:          vm,
-		Chain:       bc,
-		Transaction: tr,
-	}, nil
+		c.State = &bp.ContractState{}
+		if c.MemorySnapshot {
+			c.State.Memory = vm.Memory()
+			c.State.Globals = vm.Globals()
+		}
+	}
+
+	return c, nil
+}
+
+// usesMemorySnapshot returns true if the module doesn't import get or set
+func usesMemorySnapshot(m *wasm.Module) bool {
+	if m.Import == nil {
+		return true
+	}
+
+	for _, entry := range m.Import.Entries {
+		if entry.FieldName == "get" || entry.FieldName == "set" {
+			return false
+		}
+	}
+	return true
 }
 
-// ExecuteContract runs the function with the passed arguments
+// ExecuteContract runs the function with the passed arguments, they must match
+// the WASM signature of the function. Functions that take a pointer and a
+// length (i32, i32) can be called without arguments, they then get the input
+// of the call copied in the memory returned by the alloc(size: i32) : i32
+// export of the contract.
 func (c *Contract) ExecuteContract(exportName string, arguments []uint64) error {
-	// Set the VM state before executing
-	c.VM.SetMemory(c.State.Memory)
-	c.VM.SetGlobal(c.State.Globals)
-	// Set the current contract struct for the proc apis
-	currentContract = c
+	// Set the VM state before executing, contracts with storage start every
+	// call from the initial memory
+	if c.MemorySnapshot {
+		c.VM.SetMemory(c.State.Memory)
+		c.VM.SetGlobal(c.State.Globals)
+	}
+
+	c.gas.depth = 0
+
+	index, sig, err := c.exportedFunction(exportName)
+	if err != nil {
+		return err
+	}
+
+	log.Info(exportName, index)
 
-	// Check if the passed function exists
-	calledFunction, ok := c.Module.Export.Entries[exportName]
-	if !ok {
-		return errors.New("Invalid export index")
+	if len(arguments) == 0 && len(c.Input) != 0 && takesBuffer(sig) {
+		arguments, err = c.writeInput()
+		if err != nil {
+			return err
+		}
 	}
 
-	log.Info(exportName, calledFunction.Index)
+	err = checkArguments(sig, arguments)
+	if err != nil {
+		return err
+	}
 
 	// Call the function with passed arguments
-	_, err := c.VM.ExecCode(int64(calledFunction.Index))
+	rtrn, err := c.VM.ExecCode(index, arguments...)
 	if err != nil {
 		return err
 	}
+	c.ReturnValue = returnValue(rtrn)
 
 	// Save the new state
-	c.State.Memory = c.VM.Memory()
-	c.State.Globals = c.VM.Globals()
+	if c.MemorySnapshot {
+		c.State.Memory = c.VM.Memory()
+		c.State.Globals = c.VM.Globals()
+	}
 
 	return nil
 }
 
-// SaveState saves the contract state to the database
-func (c *Contract) SaveState() error {
-	state, _ := proto.Marshal(c.State)
+// exportedFunction returns the index and signature of an exported function
+func (c *Contract) exportedFunction(name string) (int64, *wasm.FunctionSig, error) {
+	if c.Module.Export == nil {
+		return 0, nil, errors.New("Invalid export index")
+	}
+
+	entry, ok := c.Module.Export.Entries[name]
+	if !ok || entry.Kind != wasm.ExternalFunction {
+		return 0, nil, errors.New("Invalid export index")
+	}
 
-	return c.StateDb.Put(c.Address, state, nil)
+	fn := c.Module.GetFunction(int(entry.Index))
+	if fn == nil || fn.IsHost() {
+		return 0, nil, errors.New("Invalid export index")
+	}
+	return int64(entry.Index), fn.Sig, nil
+}
+
+// takesBuffer returns true for the functions that take a pointer and a length
+func takesBuffer(sig *wasm.FunctionSig) bool {
+	return len(sig.ParamTypes) == 2 &&
+		sig.ParamTypes[0] == wasm.ValueTypeI32 && sig.ParamTypes[1] == wasm.ValueTypeI32
 }
 
-func setupImport(name string) (*wasm.Module, error) {
+// writeInput copies the input in the memory allocated by the contract and
+// returns the pointer and length to pass to the function
+func (c *Contract) writeInput() ([]uint64, error) {
+	alloc, sig, err := c.exportedFunction("alloc")
+	if err != nil || len(sig.ParamTypes) != 1 || len(sig.ReturnTypes) != 1 {
+		return nil, errors.New("The contract has no alloc(size: i32) : i32 for the input")
+	}
+
+	rtrn, err := c.VM.ExecCode(alloc, uint64(len(c.Input)))
+	if err != nil {
+		return nil, err
+	}
+	ptr := returnValue(rtrn)
+
+	mem := c.VM.Memory()
+	if ptr == nil || *ptr > uint64(len(mem)) || uint64(len(c.Input)) > uint64(len(mem))-*ptr {
+		return nil, errors.New("alloc returned memory outside of the contract")
+	}
+	copy(mem[*ptr:], c.Input)
+
+	return []uint64{*ptr, uint64(len(c.Input))}, nil
+}
+
+// checkArguments checks that the arguments match the parameters of a function
+func checkArguments(sig *wasm.FunctionSig, arguments []uint64) error {
+	if len(arguments) != len(sig.ParamTypes) {
+		return fmt.Errorf("The function takes %d arguments, %d given", len(sig.ParamTypes), len(arguments))
+	}
+
+	for i, t := range sig.ParamTypes {
+		if (t == wasm.ValueTypeI32 || t == wasm.ValueTypeF32) && arguments[i] > math.MaxUint32 {
+			return fmt.Errorf("Argument %d doesn't fit in a %s", i, t)
+		}
+	}
+	return nil
+}
+
+// returnValue converts the result of ExecCode to the raw value, nil if the
+// function doesn't return anything
+func returnValue(rtrn interface{}) *uint64 {
+	var v uint64
+	switch r := rtrn.(type) {
+	case uint32:
+		v = uint64(r)
+	case uint64:
+		v = r
+	case float32:
+		v = uint64(math.Float32bits(r))
+	case float64:
+		v = math.Float64bits(r)
+	default:
+		return nil
+	}
+	return &v
+}
+
+// GasUsed returns the gas used by the contract so far
+func (c *Contract) GasUsed() uint64 {
+	return c.gas.used
+}
+
+// SaveState stages the contract state in the StateBatch it was loaded from
+func (c *Contract) SaveState() error {
+	return c.Batch.SetContractState(c.Address, c.State)
+}
+
+// setupImport resolves the imports of the contract to the host functions,
+// they are bound to c so every contract has its own
+func (c *Contract) setupImport(name string) (*wasm.Module, error) {
 	m := wasm.NewModule()
 
 	m.Types = &wasm.SectionTypes{
@@ -130,10 +291,10 @@ func setupImport(name string) (*wasm.Module, error) {
 				ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
 			},
 
-			// pay(to_ptr: i64, amnt: i64, gas : i64)
+			// pay(to_ptr: i32, amnt: i64, gas : i64)
 			{
 				Form: 2,
-				ParamTypes: []wasm.ValueType{wasm.ValueTypeI64,
+				ParamTypes: []wasm.ValueType{wasm.ValueTypeI32,
 					wasm.ValueTypeI64, wasm.ValueTypeI64},
 				ReturnTypes: []wasm.ValueType{},
 			},
@@ -145,11 +306,11 @@ func setupImport(name string) (*wasm.Module, error) {
 				ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
 			},
 
-			// sender(ptr: i64, size: i64) : i64
+			// sender(ptr: i32, size: i32)
 			{
 				Form:        4,
-				ParamTypes:  []wasm.ValueType{wasm.ValueTypeI64, wasm.ValueTypeI64},
-				ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
+				ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32},
+				ReturnTypes: []wasm.ValueType{},
 			},
 
 			// value() : i64
@@ -158,6 +319,75 @@ func setupImport(name string) (*wasm.Module, error) {
 				ParamTypes:  []wasm.ValueType{},
 				ReturnTypes: []wasm.ValueType{wasm.ValueTypeI64},
 			},
+
+			// get(key_ptr: i32, key_len: i32, val_ptr: i32, val_len: i32) : i32
+			{
+				Form: 6,
+				ParamTypes: []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32,
+					wasm.ValueTypeI32, wasm.ValueTypeI32},
+				ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32},
+			},
+
+			// set(key_ptr: i32, key_len: i32, val_ptr: i32, val_len: i32)
+			{
+				Form: 7,
+				ParamTypes: []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32,
+					wasm.ValueTypeI32, wasm.ValueTypeI32},
+				ReturnTypes: []wasm.ValueType{},
+			},
+
+			// data(ptr: i32, size: i32) : i32
+			{
+				Form:        8,
+				ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32},
+				ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32},
+			},
+
+			// approvePatch(hash_ptr: i32)
+			{
+				Form:        9,
+				ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32},
+				ReturnTypes: []wasm.ValueType{},
+			},
+
+			// call(addr_ptr: i32, fn_ptr: i32, args_ptr: i32, args_len: i32,
+			//      value: i64, gas: i64, ret_ptr: i32, ret_len: i32) : i32
+			{
+				Form: 10,
+				ParamTypes: []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32,
+					wasm.ValueTypeI32, wasm.ValueTypeI32, wasm.ValueTypeI64,
+					wasm.ValueTypeI64, wasm.ValueTypeI32, wasm.ValueTypeI32},
+				ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32},
+			},
+
+			// result(ptr: i32, size: i32)
+			{
+				Form:        11,
+				ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32, wasm.ValueTypeI32},
+				ReturnTypes: []wasm.ValueType{},
+			},
+
+			// emit(topic_ptr: i32, data_ptr: i32, size: i32)
+			{
+				Form: 12,
+				ParamTypes: []wasm.ValueType{wasm.ValueTypeI32,
+					wasm.ValueTypeI32, wasm.ValueTypeI32},
+				ReturnTypes: []wasm.ValueType{},
+			},
+
+			// lock(addr_ptr: i32)
+			{
+				Form:        13,
+				ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32},
+				ReturnTypes: []wasm.ValueType{},
+			},
+
+			// unlock()
+			{
+				Form:        14,
+				ParamTypes:  []wasm.ValueType{},
+				ReturnTypes: []wasm.ValueType{},
+			},
 		},
 	}
 
@@ -165,42 +395,106 @@ func setupImport(name string) (*wasm.Module, error) {
 		// revert()
 		{
 			Sig:  &m.Types.Entries[0],
-			Host: reflect.ValueOf(revert),
+			Host: reflect.ValueOf(c.revert),
 			Body: &wasm.FunctionBody{},
 		},
 
 		// balance() : i64
 		{
 			Sig:  &m.Types.Entries[1],
-			Host: reflect.ValueOf(balance),
+			Host: reflect.ValueOf(c.balance),
 			Body: &wasm.FunctionBody{},
 		},
 
-		// pay(to_ptr: i32, amnt: i64)
+		// pay(to_ptr: i32, amnt: i64, gas : i64)
 		{
 			Sig:  &m.Types.Entries[2],
-			Host: reflect.ValueOf(pay),
+			Host: reflect.ValueOf(c.pay),
 			Body: &wasm.FunctionBody{},
 		},
 
 		// time() : i64
 		{
 			Sig:  &m.Types.Entries[3],
-			Host: reflect.ValueOf(timestamp),
+			Host: reflect.ValueOf(c.timestamp),
 			Body: &wasm.FunctionBody{},
 		},
 
-		// sender(ptr: i64, size: i64) : i64
+		// sender(ptr: i32, size: i32)
 		{
 			Sig:  &m.Types.Entries[4],
-			Host: reflect.ValueOf(sender),
+			Host: reflect.ValueOf(c.sender),
 			Body: &wasm.FunctionBody{},
 		},
 
 		// value() : i64
 		{
 			Sig:  &m.Types.Entries[5],
-			Host: reflect.ValueOf(value),
+			Host: reflect.ValueOf(c.value),
+			Body: &wasm.FunctionBody{},
+		},
+
+		// get(key_ptr: i32, key_len: i32, val_ptr: i32, val_len: i32) : i32
+		{
+			Sig:  &m.Types.Entries[6],
+			Host: reflect.ValueOf(c.get),
+			Body: &wasm.FunctionBody{},
+		},
+
+		// set(key_ptr: i32, key_len: i32, val_ptr: i32, val_len: i32)
+		{
+			Sig:  &m.Types.Entries[7],
+			Host: reflect.ValueOf(c.set),
+			Body: &wasm.FunctionBody{},
+		},
+
+		// data(ptr: i32, size: i32) : i32
+		{
+			Sig:  &m.Types.Entries[8],
+			Host: reflect.ValueOf(c.data),
+			Body: &wasm.FunctionBody{},
+		},
+
+		// approvePatch(hash_ptr: i32)
+		{
+			Sig:  &m.Types.Entries[9],
+			Host: reflect.ValueOf(c.approvePatch),
+			Body: &wasm.FunctionBody{},
+		},
+
+		// call(addr_ptr: i32, fn_ptr: i32, args_ptr: i32, args_len: i32,
+		//      value: i64, gas: i64, ret_ptr: i32, ret_len: i32) : i32
+		{
+			Sig:  &m.Types.Entries[10],
+			Host: reflect.ValueOf(c.call),
+			Body: &wasm.FunctionBody{},
+		},
+
+		// result(ptr: i32, size: i32)
+		{
+			Sig:  &m.Types.Entries[11],
+			Host: reflect.ValueOf(c.result),
+			Body: &wasm.FunctionBody{},
+		},
+
+		// emit(topic_ptr: i32, data_ptr: i32, size: i32)
+		{
+			Sig:  &m.Types.Entries[12],
+			Host: reflect.ValueOf(c.emit),
+			Body: &wasm.FunctionBody{},
+		},
+
+		// lock(addr_ptr: i32)
+		{
+			Sig:  &m.Types.Entries[13],
+			Host: reflect.ValueOf(c.lock),
+			Body: &wasm.FunctionBody{},
+		},
+
+		// unlock()
+		{
+			Sig:  &m.Types.Entries[14],
+			Host: reflect.ValueOf(c.unlock),
 			Body: &wasm.FunctionBody{},
 		},
 	}
@@ -241,6 +535,60 @@ func setupImport(name string) (*wasm.Module, error) {
 				Kind:     wasm.ExternalFunction,
 				Index:    5,
 			},
+
+			"get": {
+				FieldStr: "get",
+				Kind:     wasm.ExternalFunction,
+				Index:    6,
+			},
+
+			"set": {
+				FieldStr: "set",
+				Kind:     wasm.ExternalFunction,
+				Index:    7,
+			},
+
+			"data": {
+				FieldStr: "data",
+				Kind:     wasm.ExternalFunction,
+				Index:    8,
+			},
+
+			"approvePatch": {
+				FieldStr: "approvePatch",
+				Kind:     wasm.ExternalFunction,
+				Index:    9,
+			},
+
+			"call": {
+				FieldStr: "call",
+				Kind:     wasm.ExternalFunction,
+				Index:    10,
+			},
+
+			"result": {
+				FieldStr: "result",
+				Kind:     wasm.ExternalFunction,
+				Index:    11,
+			},
+
+			"emit": {
+				FieldStr: "emit",
+				Kind:     wasm.ExternalFunction,
+				Index:    12,
+			},
+
+			"lock": {
+				FieldStr: "lock",
+				Kind:     wasm.ExternalFunction,
+				Index:    13,
+			},
+
+			"unlock": {
+				FieldStr: "unlock",
+				Kind:     wasm.ExternalFunction,
+				Index:    14,
+			},
 		},
 	}
 
@@ -0,0 +1,469 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Blocks are saved in blockDb under these prefixes:
+//
+//	b + hash           the block
+//	i + hash           blockInfo of the block
+//	h + index + hash   all the blocks known at an index
+//	n + index          hash of the canonical block at an index
+//	u + hash           journal to revert a canonical block
+//	l + hash           blocks without children, the possible heads
+func blockKey(hash []byte) []byte {
+	return append([]byte("b"), hash...)
+}
+
+func infoKey(hash []byte) []byte {
+	return append([]byte("i"), hash...)
+}
+
+func heightKey(index uint64, hash []byte) []byte {
+	key := make([]byte, 9, 9+len(hash))
+	key[0] = 'h'
+	binary.BigEndian.PutUint64(key[1:], index)
+	return append(key, hash...)
+}
+
+func canonicalKey(index uint64) []byte {
+	key := make([]byte, 9)
+	key[0] = 'n'
+	binary.BigEndian.PutUint64(key[1:], index)
+	return key
+}
+
+func undoKey(hash []byte) []byte {
+	return append([]byte("u"), hash...)
+}
+
+func leafKey(hash []byte) []byte {
+	return append([]byte("l"), hash...)
+}
+
+// blockInfo links a block to its parent. Length is the number of blocks
+// between it and the genesis and it's what the fork choice compares.
+type blockInfo struct {
+	Hash   []byte
+	Parent []byte
+	Index  uint64
+	Length uint64
+}
+
+// BlockHash returns the hash used to identify a block
+func BlockHash(block *protobufs.Block) ([]byte, error) {
+	blockBytes, err := proto.Marshal(block)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(blockBytes)
+	return hash[:], nil
+}
+
+func (bc *Blockchain) getBlockInfo(hash []byte) (*blockInfo, error) {
+	raw, err := bc.blockDb.Get(infoKey(hash), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &blockInfo{}
+	err = json.Unmarshal(raw, info)
+	return info, err
+}
+
+// newBlockInfo checks that the parent of a block is known and returns the
+// information needed to save it
+func (bc *Blockchain) newBlockInfo(block *protobufs.Block) (*blockInfo, []byte, error) {
+	blockBytes, err := proto.Marshal(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	hash := sha256.Sum256(blockBytes)
+
+	info := &blockInfo{
+		Hash:   hash[:],
+		Parent: block.GetPrevHash(),
+		Index:  block.GetIndex(),
+	}
+
+	// A block without parent can only be the genesis
+	if len(block.GetPrevHash()) == 0 {
+		if block.GetIndex() != 0 {
+			return nil, nil, errors.New("Block without a parent")
+		}
+		return info, blockBytes, nil
+	}
+
+	parent, err := bc.getBlockInfo(block.GetPrevHash())
+	if err != nil {
+		return nil, nil, errors.New("Unknown parent block")
+	}
+	if parent.Index >= block.GetIndex() {
+		return nil, nil, errors.New("Block index must be higher than its parent")
+	}
+
+	info.Length = parent.Length + 1
+	return info, blockBytes, nil
+}
+
+// storeBlock adds a block and its info to batch, the block takes the place
+// of its parent in the possible heads
+func (bc *Blockchain) storeBlock(batch *leveldb.Batch, info *blockInfo, blockBytes []byte) {
+	rawInfo, _ := json.Marshal(info)
+
+	batch.Put(blockKey(info.Hash), blockBytes)
+	batch.Put(infoKey(info.Hash), rawInfo)
+	batch.Put(heightKey(info.Index, info.Hash), []byte{})
+	batch.Put(leafKey(info.Hash), []byte{})
+	if info.Parent != nil {
+		batch.Delete(leafKey(info.Parent))
+	}
+}
+
+// deleteBlock removes a block that can't be applied, its parent becomes a
+// possible head again
+func (bc *Blockchain) deleteBlock(info *blockInfo) error {
+	batch := new(leveldb.Batch)
+	batch.Delete(blockKey(info.Hash))
+	batch.Delete(infoKey(info.Hash))
+	batch.Delete(heightKey(info.Index, info.Hash))
+	batch.Delete(leafKey(info.Hash))
+	if info.Parent != nil {
+		batch.Put(leafKey(info.Parent), []byte{})
+	}
+	return bc.blockDb.Write(batch, nil)
+}
+
+// isCanonical returns true if the block is part of the chain ending in the
+// current head
+func (bc *Blockchain) isCanonical(info *blockInfo) bool {
+	if info.Index > bc.HeadIndex {
+		return false
+	}
+
+	hash, err := bc.blockDb.Get(canonicalKey(info.Index), nil)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(hash, info.Hash)
+}
+
+// descendsFromCheckpoint walks back from a block till the index of the last
+// justified checkpoint and checks that it finds the checkpoint
+func (bc *Blockchain) descendsFromCheckpoint(info *blockInfo) bool {
+	var err error
+	for info.Index > bc.CurrentCheckpoint {
+		info, err = bc.getBlockInfo(info.Parent)
+		if err != nil {
+			return false
+		}
+	}
+
+	return bytes.Equal(info.Hash, bc.CheckpointHash)
+}
+
+// chooseHead is the fork choice rule: the head is the end of the longest
+// chain that descends from the latest justified checkpoint. On a tie the
+// current head is kept. The leaves are pruned when the checkpoint moves, so
+// only the chosen one is checked against it.
+func (bc *Blockchain) chooseHead() (*blockInfo, error) {
+	for {
+		best, err := bc.longestLeaf()
+		if err != nil {
+			return nil, err
+		}
+		if bc.descendsFromCheckpoint(best) {
+			return best, nil
+		}
+
+		// A fork from before the checkpoint can't become canonical anymore
+		err = bc.blockDb.Delete(leafKey(best.Hash), nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// longestLeaf returns the end of the longest chain, preferring the head
+func (bc *Blockchain) longestLeaf() (*blockInfo, error) {
+	var best *blockInfo
+
+	iter := bc.blockDb.NewIterator(util.BytesPrefix([]byte("l")), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		// Skip anything that isn't a leaf
+		hash := append([]byte{}, iter.Key()[1:]...)
+		if len(hash) != sha256.Size {
+			continue
+		}
+
+		info, err := bc.getBlockInfo(hash)
+		if err != nil {
+			continue
+		}
+
+		if best == nil || info.Length > best.Length ||
+			(info.Length == best.Length && bytes.Equal(info.Hash, bc.HeadHash)) {
+			best = info
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("No head found")
+	}
+	return best, iter.Error()
+}
+
+// pruneLeaves removes the leaves that don't descend from the checkpoint, it
+// runs every time the checkpoint moves
+func (bc *Blockchain) pruneLeaves() error {
+	iter := bc.blockDb.NewIterator(util.BytesPrefix([]byte("l")), nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		hash := iter.Key()[1:]
+		if len(hash) != sha256.Size {
+			continue
+		}
+
+		info, err := bc.getBlockInfo(hash)
+		if err != nil || !bc.descendsFromCheckpoint(info) {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return bc.blockDb.Write(batch, nil)
+}
+
+// AddBlock saves a block and moves the head to the best chain according to
+// the fork choice. That can mean applying just this block, nothing if it's
+// on a shorter fork, or reverting the head to switch to another fork.
+func (bc *Blockchain) AddBlock(block *protobufs.Block, validators *ValidatorsBook) error {
+	if !bc.HasGenesis() {
+		return errors.New("The genesis block hasn't been imported")
+	}
+
+	err := bc.SaveBlock(block)
+	if err != nil {
+		return err
+	}
+
+	return bc.updateHead(validators)
+}
+
+// updateHead runs the fork choice and reorganizes the state to match it
+func (bc *Blockchain) updateHead(validators *ValidatorsBook) error {
+	best, err := bc.chooseHead()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(best.Hash, bc.HeadHash) {
+		return nil
+	}
+
+	// Find where the new head leaves the canonical chain
+	var fork []*blockInfo
+	ancestor := best
+	for !bc.isCanonical(ancestor) {
+		fork = append(fork, ancestor)
+		ancestor, err = bc.getBlockInfo(ancestor.Parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ancestor.Index != bc.HeadIndex {
+		log.Info("Reorganizing chain from block ", ancestor.Index)
+	}
+
+	for bc.HeadIndex > ancestor.Index {
+		err = bc.revertHead(validators)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := len(fork) - 1; i >= 0; i-- {
+		raw, err := bc.blockDb.Get(blockKey(fork[i].Hash), nil)
+		if err != nil {
+			return err
+		}
+
+		block := &protobufs.Block{}
+		err = proto.Unmarshal(raw, block)
+		if err != nil {
+			return err
+		}
+
+		err = bc.ApplyBlock(block, validators)
+		if err != nil {
+			// The block is invalid, forget it and choose the head again
+			log.Error("Dropping block ", block.GetIndex(), " ", err)
+			derr := bc.deleteBlock(fork[i])
+			if derr != nil {
+				return derr
+			}
+
+			uerr := bc.updateHead(validators)
+			if uerr != nil {
+				return uerr
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revertHead undoes the state changes of the head block and makes its parent
+// the new head
+func (bc *Blockchain) revertHead(validators *ValidatorsBook) error {
+	if bc.HeadIndex <= bc.CurrentCheckpoint {
+		return errors.New("Can't revert a justified block")
+	}
+
+	info, err := bc.getBlockInfo(bc.HeadHash)
+	if err != nil {
+		return err
+	}
+	parent, err := bc.getBlockInfo(info.Parent)
+	if err != nil {
+		return err
+	}
+
+	raw, err := bc.blockDb.Get(blockKey(info.Hash), nil)
+	if err != nil {
+		return err
+	}
+	block := &protobufs.Block{}
+	err = proto.Unmarshal(raw, block)
+	if err != nil {
+		return err
+	}
+
+	// The stake of the validators slashed in the block is given back after
+	// the state is reverted, read it before the records are gone
+	offenders, slashed, err := slashedInBlock(block, bc.getSlashRecord)
+	if err != nil {
+		return err
+	}
+
+	rawJournal, err := bc.blockDb.Get(undoKey(info.Hash), nil)
+	if err != nil {
+		return err
+	}
+	journal := &blockJournal{}
+	err = json.Unmarshal(rawJournal, journal)
+	if err != nil {
+		return err
+	}
+
+	sb := bc.NewStateBatch()
+	err = bc.restoreJournal(sb, journal)
+	if err != nil {
+		return err
+	}
+
+	meta := bc.meta()
+	meta.HeadIndex = parent.Index
+	meta.HeadHash = parent.Hash
+	rawMeta, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Delete(canonicalKey(info.Index))
+	batch.Delete(undoKey(info.Hash))
+	var receipts []*Receipt
+	for _, t := range block.GetTransactions() {
+		hash, err := wallet.TransactionHash(t)
+		if err != nil {
+			return err
+		}
+		r, err := bc.GetReceipt(hash)
+		if err != nil {
+			return err
+		}
+		receipts = append(receipts, r)
+		batch.Delete(receiptKey(hash))
+	}
+	unindexLogs(batch, info.Hash, receipts)
+	unindexTransactions(batch, receipts)
+	batch.Delete(stateRootKey(info.Hash))
+	batch.Put(metaKey, rawMeta)
+
+	err = bc.writeState(sb, batch, nil)
+	if err != nil {
+		return err
+	}
+	bc.setMeta(meta)
+
+	// The offenders have to be slashed again on the new branch
+	revertValidators(validators, block, offenders, slashed)
+	bc.Slashing.restoreEvidence(block)
+	return nil
+}
+
+// slashedInBlock returns the validators slashed by a block and the records
+// saved when they were slashed, read with getRecord
+func slashedInBlock(block *protobufs.Block, getRecord func(string) (*slashRecord, error)) ([]string, []*slashRecord, error) {
+	var offenders []string
+	var slashed []*slashRecord
+	for _, t := range block.GetTransactions() {
+		if t.GetRecipient() != SlashAddress {
+			continue
+		}
+
+		offender, err := slashTransactionOffender(t)
+		if err != nil {
+			return nil, nil, err
+		}
+		record, err := getRecord(offender)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		offenders = append(offenders, offender)
+		slashed = append(slashed, record)
+	}
+	return offenders, slashed, nil
+}
+
+// revertValidators undoes what a block did to the validators, offenders and
+// slashed are what slashedInBlock returned before the block was reverted
+func revertValidators(validators *ValidatorsBook, block *protobufs.Block, offenders []string, slashed []*slashRecord) {
+	for i, offender := range offenders {
+		validators.unslash(offender, slashed[i].Stake, slashed[i].EndDynasty)
+	}
+
+	// Validators registered by the reverted block have to go as well
+	for _, t := range block.GetTransactions() {
+		if t.GetRecipient() != "DexmPoS" {
+			continue
+		}
+
+		sender := wallet.BytesToAddress(t.GetSender(), t.GetShard())
+		if val, ok := validators.valsArray[sender]; ok && val.startDynasty == int64(block.GetIndex()) {
+			validators.RemoveValidator(sender)
+		}
+	}
+}
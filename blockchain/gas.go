@@ -0,0 +1,347 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+
+	"github.com/dexm-coin/wagon/exec"
+	"github.com/dexm-coin/wagon/wasm"
+	"github.com/dexm-coin/wagon/wasm/leb128"
+	ops "github.com/dexm-coin/wagon/wasm/operators"
+)
+
+const (
+	gasPerInstruction = 1
+	gasPerCall        = 10
+	gasPerHostCall    = 100
+	gasPerMemoryPage  = 1000
+
+	// Storage is charged for every byte of the key and the value
+	gasPerStorageRead  = 2
+	gasPerStorageWrite = 20
+
+	maxStorageKey   = 256
+	maxStorageValue = 16384
+
+	// Contracts can't have more than 1MB of memory, it's all saved in the state
+	maxMemoryPages = 16
+	maxCallDepth   = 256
+
+	// Contracts calling other contracts
+	maxContractCallDepth = 16
+
+	wasmPageSize = 65536
+)
+
+var (
+	// ErrOutOfGas is returned when a contract uses all the gas of the
+	// transaction
+	ErrOutOfGas = errors.New("Out of gas")
+	// ErrCallDepth is returned when a contract nests too many calls
+	ErrCallDepth = errors.New("Call depth exceeded")
+	// ErrReentrantCall is returned when a call would run again a contract
+	// with a memory snapshot that is already running, the outer call would
+	// overwrite its state when it ends
+	ErrReentrantCall = errors.New("Reentrant call to a contract with a memory snapshot")
+)
+
+// gasMeter counts the resources used by a contract while it runs. The code of
+// the contract is instrumented to call it: useGas at the start of every
+// sequence of instructions without jumps, enter and leave around every
+// function and grow instead of grow_memory.
+type gasMeter struct {
+	limit uint64
+	used  uint64
+	depth int
+
+	vm *exec.VM
+}
+
+func (g *gasMeter) useGas(proc *exec.Process, amount int64) {
+	if uint64(amount) > g.limit-g.used {
+		g.used = g.limit
+		panic(ErrOutOfGas)
+	}
+	g.used += uint64(amount)
+}
+
+func (g *gasMeter) enter(proc *exec.Process) {
+	g.depth++
+	if g.depth > maxCallDepth {
+		panic(ErrCallDepth)
+	}
+}
+
+func (g *gasMeter) leave(proc *exec.Process) {
+	g.depth--
+}
+
+// grow works like grow_memory but returns -1 once the memory would be larger
+// than maxMemoryPages
+func (g *gasMeter) grow(proc *exec.Process, pages int32) int32 {
+	if g.vm == nil || pages < 0 {
+		return -1
+	}
+
+	mem := g.vm.Memory()
+	current := len(mem) / wasmPageSize
+	if current+int(pages) > maxMemoryPages {
+		return -1
+	}
+
+	g.useGas(proc, int64(pages)*gasPerMemoryPage)
+	g.vm.SetMemory(append(mem, make([]byte, int(pages)*wasmPageSize)...))
+	return int32(current)
+}
+
+// instruction is a single operator with its immediates
+type instruction struct {
+	op  byte
+	raw []byte
+}
+
+// skipLEB skips a LEB128 encoded number
+func skipLEB(r *bytes.Reader) error {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if b&0x80 == 0 {
+			return nil
+		}
+	}
+}
+
+// readInstructions splits the code of a function in instructions
+func readInstructions(code []byte) ([]instruction, error) {
+	var res []instruction
+	r := bytes.NewReader(code)
+
+	for r.Len() > 0 {
+		start := len(code) - r.Len()
+		op, _ := r.ReadByte()
+
+		var err error
+		switch {
+		case op == ops.Block || op == ops.Loop || op == ops.If:
+			_, err = r.ReadByte()
+		case op == ops.Br || op == ops.BrIf || op == ops.Call:
+			err = skipLEB(r)
+		case op == ops.BrTable:
+			var n uint32
+			n, err = leb128.ReadVarUint32(r)
+			for i := uint32(0); i <= n && err == nil; i++ {
+				err = skipLEB(r)
+			}
+		case op == ops.CallIndirect:
+			err = skipLEB(r)
+			if err == nil {
+				_, err = r.ReadByte()
+			}
+		case op >= ops.GetLocal && op <= ops.SetGlobal:
+			err = skipLEB(r)
+		case op >= ops.I32Load && op <= ops.I64Store32:
+			err = skipLEB(r)
+			if err == nil {
+				err = skipLEB(r)
+			}
+		case op == ops.CurrentMemory || op == ops.GrowMemory:
+			_, err = r.ReadByte()
+		case op == ops.I32Const || op == ops.I64Const:
+			err = skipLEB(r)
+		case op == ops.F32Const:
+			_, err = io.ReadFull(r, make([]byte, 4))
+		case op == ops.F64Const:
+			_, err = io.ReadFull(r, make([]byte, 8))
+		}
+		if err != nil {
+			return nil, errors.New("Invalid contract code")
+		}
+
+		res = append(res, instruction{op, code[start : len(code)-r.Len()]})
+	}
+
+	return res, nil
+}
+
+// endsSequence is true for the instructions after which the execution can
+// continue somewhere else or be reached from somewhere else
+func endsSequence(op byte) bool {
+	switch op {
+	case ops.Block, ops.Loop, ops.If, ops.Else, ops.End,
+		ops.Br, ops.BrIf, ops.BrTable, ops.Return:
+		return true
+	}
+	return false
+}
+
+func putUvarint(buf *bytes.Buffer, v uint64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if v == 0 {
+			return
+		}
+	}
+}
+
+func putVarint(buf *bytes.Buffer, v int64) {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			buf.WriteByte(b)
+			return
+		}
+		buf.WriteByte(b | 0x80)
+	}
+}
+
+// meteredFunctions are the indexes of the gasMeter functions in the module
+type meteredFunctions struct {
+	useGas, enter, leave, grow uint32
+}
+
+// instrument adds the calls to the gasMeter to the code of a function. The
+// body is wrapped in a block so that every branch out of the function goes
+// through leave.
+func instrument(fn *wasm.Function, m *wasm.Module, meter meteredFunctions) error {
+	instrs, err := readInstructions(fn.Body.Code)
+	if err != nil {
+		return err
+	}
+
+	call := func(buf *bytes.Buffer, index uint32) {
+		buf.WriteByte(ops.Call)
+		putUvarint(buf, uint64(index))
+	}
+
+	// Block types are encoded as a negative 7 bit number
+	blockType := byte(0x40)
+	if len(fn.Sig.ReturnTypes) != 0 {
+		blockType = byte(fn.Sig.ReturnTypes[0]) & 0x7f
+	}
+
+	var out bytes.Buffer
+	call(&out, meter.enter)
+	out.WriteByte(ops.Block)
+	out.WriteByte(blockType)
+
+	var sequence []instruction
+	flush := func() {
+		if len(sequence) == 0 {
+			return
+		}
+
+		var cost int64
+		for _, in := range sequence {
+			cost += instructionCost(in, m)
+		}
+		out.WriteByte(ops.I64Const)
+		putVarint(&out, cost)
+		call(&out, meter.useGas)
+
+		for _, in := range sequence {
+			switch in.op {
+			case ops.GrowMemory:
+				call(&out, meter.grow)
+			case ops.Return:
+				call(&out, meter.leave)
+				out.Write(in.raw)
+			default:
+				out.Write(in.raw)
+			}
+		}
+		sequence = nil
+	}
+
+	for _, in := range instrs {
+		sequence = append(sequence, in)
+		if endsSequence(in.op) {
+			flush()
+		}
+	}
+	flush()
+
+	call(&out, meter.leave)
+	out.WriteByte(ops.End)
+
+	fn.Body.Code = out.Bytes()
+	return nil
+}
+
+func instructionCost(in instruction, m *wasm.Module) int64 {
+	switch in.op {
+	case ops.Call:
+		index, err := leb128.ReadVarUint32(bytes.NewReader(in.raw[1:]))
+		if err == nil {
+			if fn := m.GetFunction(int(index)); fn != nil && fn.IsHost() {
+				return gasPerHostCall
+			}
+		}
+		return gasPerCall
+	case ops.CallIndirect:
+		return gasPerCall
+	}
+	return gasPerInstruction
+}
+
+// addMeter instruments all the functions of a module to be metered by g
+func addMeter(m *wasm.Module, g *gasMeter) error {
+	if m.Memory != nil && len(m.Memory.Entries) != 0 && m.Memory.Entries[0].Limits.Initial > maxMemoryPages {
+		return errors.New("The contract uses too much memory")
+	}
+
+	// The new functions go at the end so that the indexes used by the
+	// contract don't change
+	count := len(m.FunctionIndexSpace)
+	meter := meteredFunctions{
+		useGas: uint32(count),
+		enter:  uint32(count + 1),
+		leave:  uint32(count + 2),
+		grow:   uint32(count + 3),
+	}
+
+	for i := range m.FunctionIndexSpace {
+		fn := &m.FunctionIndexSpace[i]
+		if fn.IsHost() {
+			continue
+		}
+
+		err := instrument(fn, m, meter)
+		if err != nil {
+			return err
+		}
+	}
+
+	host := []struct {
+		fn  interface{}
+		sig wasm.FunctionSig
+	}{
+		{g.useGas, wasm.FunctionSig{ParamTypes: []wasm.ValueType{wasm.ValueTypeI64}}},
+		{g.enter, wasm.FunctionSig{}},
+		{g.leave, wasm.FunctionSig{}},
+		{g.grow, wasm.FunctionSig{
+			ParamTypes:  []wasm.ValueType{wasm.ValueTypeI32},
+			ReturnTypes: []wasm.ValueType{wasm.ValueTypeI32},
+		}},
+	}
+
+	for _, h := range host {
+		sig := h.sig
+		m.FunctionIndexSpace = append(m.FunctionIndexSpace, wasm.Function{
+			Sig:  &sig,
+			Host: reflect.ValueOf(h.fn),
+			Body: &wasm.FunctionBody{},
+		})
+	}
+
+	return nil
+}
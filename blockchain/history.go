@@ -0,0 +1,68 @@
+package blockchain
+
+import (
+	"errors"
+
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// StateRootAt returns the root of the state as of block index, that is after
+// the last canonical block with an index lower or equal to it
+func (bc *Blockchain) StateRootAt(index uint64) ([]byte, error) {
+	if index > bc.HeadIndex {
+		return nil, errors.New("The block is after the head")
+	}
+	if index < bc.prunedIndex() {
+		return nil, errors.New("The state of the block was pruned")
+	}
+
+	iter := bc.blockDb.NewIterator(&util.Range{
+		Start: canonicalKey(0),
+		Limit: canonicalKey(index + 1),
+	}, nil)
+	defer iter.Release()
+
+	if !iter.Last() {
+		return nil, errors.New("No block before the index")
+	}
+	return bc.GetStateRoot(iter.Value())
+}
+
+// getAt returns the value of a path of the trie as of block index
+func (bc *Blockchain) getAt(key []byte, index uint64) ([]byte, error) {
+	root, err := bc.StateRootAt(index)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &trie{bc.NewStateBatch()}
+	proof, err := t.prove(root, key)
+	if err != nil {
+		return nil, err
+	}
+	if proof.Value == nil {
+		return nil, leveldb.ErrNotFound
+	}
+	return proof.Value, nil
+}
+
+// GetWalletStateAt returns the balance and nonce of a wallet as of block index
+func (bc *Blockchain) GetWalletStateAt(wallet string, index uint64) (protobufs.AccountState, error) {
+	state := protobufs.AccountState{}
+	raw, err := bc.getAt(AccountKey(wallet), index)
+	if err != nil {
+		return state, err
+	}
+
+	err = proto.Unmarshal(raw, &state)
+	return state, err
+}
+
+// GetStorageAt returns the value saved by a contract under key as of block
+// index
+func (bc *Blockchain) GetStorageAt(address string, key []byte, index uint64) ([]byte, error) {
+	return bc.getAt(StorageKey(address, key), index)
+}
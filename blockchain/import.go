@@ -0,0 +1,233 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/dexm-coin/dexmd/util"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	log "github.com/sirupsen/logrus"
+)
+
+// blockResult is what applying the transactions of a block changes outside
+// of the StateBatch
+type blockResult struct {
+	receipts  []*Receipt
+	staking   []*protobufs.Transaction
+	slashed   []string
+	stateRoot []byte
+}
+
+// executeBlock stages all the transactions of a block in sb. A transaction
+// that fails inside a contract is still part of the block and gets a failed
+// receipt, any other error makes the whole block invalid.
+func (bc *Blockchain) executeBlock(sb *StateBatch, block *protobufs.Block, validators *ValidatorsBook) (*blockResult, error) {
+	res := &blockResult{}
+
+	for _, t := range block.GetTransactions() {
+		receipt := newReceipt(t, block.GetIndex())
+
+		if t.GetRecipient() == SlashAddress {
+			offender, err := sb.stageSlashing(t, validators, block.GetIndex())
+			if err != nil {
+				return nil, err
+			}
+			res.slashed = append(res.slashed, offender)
+			res.receipts = append(res.receipts, receipt)
+			continue
+		}
+
+		err := sb.applyTransaction(t, block, receipt)
+		if err != nil {
+			return nil, err
+		}
+		res.receipts = append(res.receipts, receipt)
+
+		// New validators are only registered once the block has been committed
+		if t.GetRecipient() == "DexmPoS" && receipt.Success {
+			res.staking = append(res.staking, t)
+		}
+	}
+
+	parent, err := bc.GetStateRoot(block.GetPrevHash())
+	if err != nil {
+		return nil, err
+	}
+	res.stateRoot, err = sb.StateRoot(parent)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// ApplyBlock applies all the transactions of a block to the state. Balances,
+// nonces, contract code and contract memory are staged in a StateBatch and
+// committed only once every transaction went through, so if one of them fails
+// nothing from the block is written. The block then becomes the new head and
+// the receipts of its transactions are saved.
+func (bc *Blockchain) ApplyBlock(block *protobufs.Block, validators *ValidatorsBook) error {
+	if !bytes.Equal(block.GetPrevHash(), bc.HeadHash) {
+		return errors.New("The block doesn't follow the current head")
+	}
+
+	sb := bc.NewStateBatch()
+	res, err := bc.executeBlock(sb, block, validators)
+	if err != nil {
+		log.Error("ApplyBlock ", err)
+		return err
+	}
+
+	// The receipts root also commits to the state root after the block.
+	// Blocks without transactions have an empty one, they can't change the
+	// state but they don't authenticate it either
+	if len(block.GetTransactions()) != 0 && len(block.GetMerkleRootReceipt()) == 0 {
+		return errors.New("The block doesn't have a receipts root")
+	}
+	root, err := ReceiptsRoot(res.receipts, res.stateRoot)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(root, block.GetMerkleRootReceipt()) {
+		return errors.New("The receipts root doesn't match the transactions or the state")
+	}
+
+	err = bc.commitBlock(sb, block, res.receipts, res.stateRoot)
+	if err != nil {
+		return err
+	}
+
+	// The transactions of the block aren't needed in the mempool anymore
+	senders := make(map[string]bool)
+	for _, r := range res.receipts {
+		if r.Sender != "" {
+			senders[r.Sender] = true
+		}
+	}
+	bc.pruneMempool(senders)
+
+	for _, t := range res.staking {
+		sender := wallet.BytesToAddress(t.GetSender(), t.GetShard())
+		exist := validators.AddValidator(sender, t.GetAmount(), int64(block.GetIndex()), t.GetPubSchnorrKey())
+		if exist {
+			log.Info("slash for ", sender)
+		}
+	}
+
+	for _, offender := range res.slashed {
+		log.Warning("Slashed validator ", offender)
+		validators.Slash(offender, int64(block.GetIndex()))
+		bc.Slashing.RemoveEvidence(offender)
+	}
+
+	return nil
+}
+
+// applyTransaction stages the changes caused by a single transaction. The gas
+// is always charged, if the rest of the transaction fails its changes are
+// reverted and the receipt records the error.
+func (sb *StateBatch) applyTransaction(t *protobufs.Transaction, block *protobufs.Block, receipt *Receipt) error {
+	sender := receipt.Sender
+
+	log.Info("Sender:", sender)
+	log.Info("Recipient:", t.GetRecipient())
+	log.Info("Amnt:", t.GetAmount())
+
+	senderBalance, err := sb.GetWalletState(sender)
+	if err != nil {
+		return err
+	}
+
+	requiredBal, ok := util.AddU64O(t.GetAmount(), uint64(t.GetGas()))
+	if requiredBal > senderBalance.GetBalance() || !ok {
+		return errors.New("Balance is insufficient")
+	}
+	if t.GetNonce() != senderBalance.GetNonce()+1 {
+		return errors.New("Invalid nonce")
+	}
+
+	// Pay the gas and avoid replaying transactions
+	senderBalance.Balance -= uint64(t.GetGas())
+	senderBalance.Nonce++
+	receipt.GasCharged = uint64(t.GetGas())
+
+	err = sb.SetState(sender, &senderBalance)
+	if err != nil {
+		return err
+	}
+
+	snapshot := sb.Snapshot()
+	err = sb.executeTransaction(t, block, receipt)
+	if err != nil {
+		log.Info("Transaction failed: ", err)
+		sb.RevertToSnapshot(snapshot)
+		receipt.fail(err)
+	}
+
+	return nil
+}
+
+// executeTransaction moves the amount and runs the contract code of a
+// transaction whose gas has already been paid
+func (sb *StateBatch) executeTransaction(t *protobufs.Transaction, block *protobufs.Block, receipt *Receipt) error {
+	sender := receipt.Sender
+
+	senderBalance, err := sb.GetWalletState(sender)
+	if err != nil {
+		return err
+	}
+	senderBalance.Balance -= t.GetAmount()
+
+	err = sb.SetState(sender, &senderBalance)
+	if err != nil {
+		return err
+	}
+
+	// Ignore error because if the wallet doesn't exist yet we don't care, it's
+	// read after the sender was saved in case they are the same
+	reciverBalance, _ := sb.GetWalletState(t.GetRecipient())
+	reciverBalance.Balance += t.GetAmount()
+
+	err = sb.SetState(t.GetRecipient(), &reciverBalance)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Sender balance:", senderBalance.Balance)
+	log.Info("Sender nonce: ", senderBalance.Nonce)
+	log.Info("Reciver balance:", reciverBalance.Balance)
+
+	// Code sent to an existing contract is an upgrade
+	if t.GetContractCreation() {
+		if _, err := sb.GetContractCode([]byte(t.GetRecipient())); err == nil {
+			return sb.upgradeContract(t, block, receipt)
+		}
+		return sb.deployContract(t, block, receipt)
+	}
+
+	// If a function identifier is specified then fetch the contract and execute
+	if t.GetFunction() != "" {
+		c, err := GetContract(t.GetRecipient(), sb, t, block)
+		if err != nil {
+			return err
+		}
+		c.Receipt = receipt
+
+		err = c.ExecuteContract(t.GetFunction(), t.GetArgs())
+		receipt.GasUsed = c.GasUsed()
+		if err != nil {
+			return err
+		}
+
+		err = c.SaveState()
+		if err != nil {
+			return err
+		}
+
+		receipt.ReturnValue = c.ReturnValue
+		receipt.ReturnData = c.ReturnData
+	}
+
+	return nil
+}
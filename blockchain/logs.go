@@ -0,0 +1,212 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Logs are indexed in blockDb under these prefixes:
+//
+//	e + address + 0 + position   a log emitted by the contract at address
+//	t + topic + position         a log with that topic
+//	f + hash                     bloom filter of the logs of a block
+//
+// position is the block index, the index of the transaction in the block and
+// the index of the log in the transaction, so logs are sorted by block.
+const (
+	logTopicSize = 32
+	maxLogData   = 1024
+
+	gasPerLog     = 100
+	gasPerLogByte = 5
+
+	bloomBits = 2048
+)
+
+// LogEntry is a log returned by FilterLogs with the transaction that emitted it
+type LogEntry struct {
+	Log
+
+	BlockIndex      uint64
+	TransactionHash []byte
+}
+
+// LogFilter selects the logs returned by FilterLogs, at least one of Address
+// and Topic has to be set
+type LogFilter struct {
+	Address   string
+	Topic     []byte
+	FromBlock uint64
+	ToBlock   uint64
+}
+
+func logPosition(blockIndex uint64, tx, n int) []byte {
+	pos := make([]byte, 16)
+	binary.BigEndian.PutUint64(pos, blockIndex)
+	binary.BigEndian.PutUint32(pos[8:], uint32(tx))
+	binary.BigEndian.PutUint32(pos[12:], uint32(n))
+	return pos
+}
+
+func addressLogPrefix(address string) []byte {
+	prefix := append([]byte("e"), address...)
+	return append(prefix, 0)
+}
+
+func topicLogPrefix(topic []byte) []byte {
+	return append([]byte("t"), topic...)
+}
+
+func bloomKey(hash []byte) []byte {
+	return append([]byte("f"), hash...)
+}
+
+// Bloom is a bloom filter of the contracts and topics that emitted logs in a
+// block. If Test returns false the block has nothing from them and can be
+// skipped.
+type Bloom [bloomBits / 8]byte
+
+// bloomIndexes returns the 3 bits of the bloom that are set for data
+func bloomIndexes(data []byte) [3]uint {
+	hash := sha256.Sum256(data)
+
+	var res [3]uint
+	for i := range res {
+		res[i] = uint(binary.BigEndian.Uint16(hash[i*2:])) % bloomBits
+	}
+	return res
+}
+
+// Add adds data to the bloom
+func (b *Bloom) Add(data []byte) {
+	for _, i := range bloomIndexes(data) {
+		b[i/8] |= 1 << (i % 8)
+	}
+}
+
+// Test returns false if data certainly wasn't added to the bloom
+func (b *Bloom) Test(data []byte) bool {
+	for _, i := range bloomIndexes(data) {
+		if b[i/8]&(1<<(i%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// LogsBloom returns the bloom of the contract addresses and topics of the
+// logs in the receipts
+func LogsBloom(receipts []*Receipt) Bloom {
+	var b Bloom
+	for _, r := range receipts {
+		for _, l := range r.Logs {
+			b.Add([]byte(l.Address))
+			b.Add(l.Topic)
+		}
+	}
+	return b
+}
+
+// GetBloom returns the bloom of the logs of a block in the canonical chain
+func (bc *Blockchain) GetBloom(blockHash []byte) (Bloom, error) {
+	var b Bloom
+
+	raw, err := bc.blockDb.Get(bloomKey(blockHash), nil)
+	if err != nil {
+		return b, err
+	}
+	if len(raw) != len(b) {
+		return b, errors.New("Invalid bloom")
+	}
+
+	copy(b[:], raw)
+	return b, nil
+}
+
+// indexLogs adds the logs of the receipts of a block and its bloom to batch
+func indexLogs(batch *leveldb.Batch, blockHash []byte, receipts []*Receipt) error {
+	for i, r := range receipts {
+		for n, l := range r.Logs {
+			raw, err := json.Marshal(&LogEntry{
+				Log:             *l,
+				BlockIndex:      r.BlockIndex,
+				TransactionHash: r.TransactionHash,
+			})
+			if err != nil {
+				return err
+			}
+
+			pos := logPosition(r.BlockIndex, i, n)
+			batch.Put(append(addressLogPrefix(l.Address), pos...), raw)
+			batch.Put(append(topicLogPrefix(l.Topic), pos...), raw)
+		}
+	}
+
+	bloom := LogsBloom(receipts)
+	batch.Put(bloomKey(blockHash), bloom[:])
+	return nil
+}
+
+// unindexLogs removes what indexLogs added for a block from batch
+func unindexLogs(batch *leveldb.Batch, blockHash []byte, receipts []*Receipt) {
+	for i, r := range receipts {
+		for n, l := range r.Logs {
+			pos := logPosition(r.BlockIndex, i, n)
+			batch.Delete(append(addressLogPrefix(l.Address), pos...))
+			batch.Delete(append(topicLogPrefix(l.Topic), pos...))
+		}
+	}
+
+	batch.Delete(bloomKey(blockHash))
+}
+
+// FilterLogs returns the logs in the canonical chain between FromBlock and
+// ToBlock (both included) that match the filter, sorted by block
+func (bc *Blockchain) FilterLogs(filter LogFilter) ([]*LogEntry, error) {
+	var prefix []byte
+	switch {
+	case filter.Address != "":
+		prefix = addressLogPrefix(filter.Address)
+	case len(filter.Topic) != 0:
+		prefix = topicLogPrefix(filter.Topic)
+	default:
+		return nil, errors.New("The filter needs an address or a topic")
+	}
+
+	start := append(prefix, logPosition(filter.FromBlock, 0, 0)...)
+	iter := bc.blockDb.NewIterator(&util.Range{
+		Start: start,
+		Limit: util.BytesPrefix(prefix).Limit,
+	}, nil)
+	defer iter.Release()
+
+	var res []*LogEntry
+	for iter.Next() {
+		key := iter.Key()
+		if len(key) != len(prefix)+16 {
+			continue
+		}
+		if binary.BigEndian.Uint64(key[len(prefix):]) > filter.ToBlock {
+			break
+		}
+
+		entry := &LogEntry{}
+		err := json.Unmarshal(iter.Value(), entry)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(filter.Topic) != 0 && !bytes.Equal(entry.Topic, filter.Topic) {
+			continue
+		}
+		res = append(res, entry)
+	}
+
+	return res, iter.Error()
+}
@@ -27,9 +27,12 @@ func VerifyProof(mp *protobufs.MerkleProof) bool {
 		m[key] = hashes[i]
 		mapProof = append(mapProof, m)
 	}
-	t, _ := proto.Marshal(mp.GetTransaction())
+	t, err := wallet.TransactionHash(mp.GetTransaction())
+	if err != nil {
+		return false
+	}
 
-	equal := reflect.DeepEqual(hash(t), mp.GetLeaf())
+	equal := reflect.DeepEqual(t, mp.GetLeaf())
 	// check if the transaction and Leaf ( hash of the transaction for the proof ) are equal
 	if !equal {
 		return false
@@ -53,39 +56,27 @@ func verifyMerkleProof(proof []map[string][]byte, root, value []byte) bool {
 	return bytes.Equal(root, proofHash)
 }
 
-func GenerateMerkleTree(transactions []*protobufs.Transaction) ([]byte, []byte, error) {
+// GenerateMerkleTree returns the merkle root of the transactions of a block,
+// the receipts have their own root, see ReceiptsRoot
+func GenerateMerkleTree(transactions []*protobufs.Transaction) ([]byte, error) {
 	var dataTransaction [][]byte
-	var dataReceipt [][]byte
 	for _, t := range transactions {
-		r := &protobufs.Receipt{
-			Sender:    wallet.BytesToAddress(t.GetSender(), t.GetShard()),
-			Recipient: t.GetRecipient(),
-			Amount:    t.GetAmount(),
-			Nonce:     t.GetNonce(),
+		// The leaves are sha256 of the data, so this makes them TransactionHash
+		tByte, err := wallet.UnsignedTransactionBytes(t)
+		if err != nil {
+			return nil, err
 		}
-		rByte, _ := proto.Marshal(r)
-		tByte, _ := proto.Marshal(t)
 		dataTransaction = append(dataTransaction, tByte)
-		dataReceipt = append(dataReceipt, rByte)
 	}
 
 	treeTransaction := gomerkle.NewTree(sha256.New())
 	treeTransaction.AddData(dataTransaction...)
 	err := treeTransaction.Generate()
 	if err != nil {
-		return nil, nil, err
-	}
-	merkleRootTransaction := treeTransaction.Root()
-
-	treeReceipt := gomerkle.NewTree(sha256.New())
-	treeReceipt.AddData(dataReceipt...)
-	err = treeReceipt.Generate()
-	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
-	merkleRootReceipt := treeReceipt.Root()
 
-	return merkleRootTransaction, merkleRootReceipt, nil
+	return treeTransaction.Root(), nil
 }
 
 func GenerateMerkleProof(transactions []*protobufs.Transaction, indexProof int) []byte {
@@ -98,7 +89,7 @@ func GenerateMerkleProof(transactions []*protobufs.Transaction, indexProof int)
 
 	var data [][]byte
 	for _, t := range transactions {
-		tByte, _ := proto.Marshal(t)
+		tByte, _ := wallet.UnsignedTransactionBytes(t)
 		data = append(data, tByte)
 	}
 
@@ -0,0 +1,314 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"errors"
+
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+var (
+	// metaKey is where the chainMeta record is saved inside blockDb
+	metaKey = []byte("meta")
+	// pendingKey holds the journal of the block being committed
+	pendingKey = []byte("pending")
+
+	syncWrite = &opt.WriteOptions{Sync: true}
+)
+
+// chainMeta is saved in blockDb every time a block is committed, it's what a
+// node uses to resume from where it stopped after a restart
+type chainMeta struct {
+	HeadIndex uint64
+	HeadHash  []byte
+
+	Checkpoint     uint64
+	CheckpointHash []byte
+
+	GenesisTimestamp uint64
+	GenesisHash      []byte
+}
+
+// journalEntry is the value a key had before a block changed it. If Missing
+// is true the key didn't exist and has to be deleted to undo the block.
+type journalEntry struct {
+	Db      string
+	Key     []byte
+	Value   []byte
+	Missing bool
+}
+
+// blockJournal is written before the state of a block gets committed and
+// deleted right after, if a node finds one on startup it means that the
+// node stopped while writing that block. The journal of every canonical
+// block is also kept to revert it during a reorg.
+type blockJournal struct {
+	Entries []journalEntry
+}
+
+// stateDbs returns the databases changed when a block is applied with the
+// name used for them in the journal
+func (bc *Blockchain) stateDbs() map[string]*leveldb.DB {
+	return map[string]*leveldb.DB{
+		"balances": bc.balancesDb,
+		"code":     bc.ContractDb,
+		"memory":   bc.StateDb,
+	}
+}
+
+// meta returns the metadata of the chain as it is in memory
+func (bc *Blockchain) meta() chainMeta {
+	return chainMeta{
+		HeadIndex:        bc.HeadIndex,
+		HeadHash:         bc.HeadHash,
+		Checkpoint:       bc.CurrentCheckpoint,
+		CheckpointHash:   bc.CheckpointHash,
+		GenesisTimestamp: bc.GenesisTimestamp,
+		GenesisHash:      bc.GenesisHash,
+	}
+}
+
+func (bc *Blockchain) setMeta(meta chainMeta) {
+	bc.HeadIndex = meta.HeadIndex
+	bc.HeadHash = meta.HeadHash
+	bc.CurrentCheckpoint = meta.Checkpoint
+	bc.CheckpointHash = meta.CheckpointHash
+	bc.GenesisTimestamp = meta.GenesisTimestamp
+	bc.GenesisHash = meta.GenesisHash
+}
+
+// loadMeta reads the chain metadata, if the node never saved a block it
+// returns leveldb.ErrNotFound
+func (bc *Blockchain) loadMeta() error {
+	raw, err := bc.blockDb.Get(metaKey, nil)
+	if err != nil {
+		return err
+	}
+
+	meta := chainMeta{}
+	err = json.Unmarshal(raw, &meta)
+	if err != nil {
+		return err
+	}
+	bc.setMeta(meta)
+
+	// Start again from the block after the head
+	bc.CurrentBlock = meta.HeadIndex + 1
+	return nil
+}
+
+// HasGenesis returns true if the genesis block was already committed, that
+// happens when a node is restarted on an existing database
+func (bc *Blockchain) HasGenesis() bool {
+	return bc.GenesisHash != nil
+}
+
+// SetCheckpoint saves the last justified checkpoint, it must be a block of
+// the canonical chain. The fork choice only picks heads descending from it.
+func (bc *Blockchain) SetCheckpoint(index uint64) error {
+	hash, err := bc.blockDb.Get(canonicalKey(index), nil)
+	if err != nil {
+		return err
+	}
+
+	meta := bc.meta()
+	meta.Checkpoint = index
+	meta.CheckpointHash = hash
+
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	err = bc.blockDb.Put(metaKey, raw, syncWrite)
+	if err != nil {
+		return err
+	}
+
+	bc.setMeta(meta)
+	return bc.pruneLeaves()
+}
+
+// ApplyGenesis commits the genesis block together with the starting balances.
+// If the node already has a genesis it does nothing, so restarting a node
+// doesn't reset the balances.
+func (bc *Blockchain) ApplyGenesis(block *protobufs.Block, balances map[string]*protobufs.AccountState) error {
+	if bc.HasGenesis() {
+		return nil
+	}
+
+	if block.GetIndex() != 0 {
+		return errors.New("The genesis block must have index 0")
+	}
+
+	sb := bc.NewStateBatch()
+	for wallet, state := range balances {
+		err := sb.SetState(wallet, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	root, err := sb.StateRoot(nil)
+	if err != nil {
+		return err
+	}
+
+	return bc.commitBlock(sb, block, nil, root)
+}
+
+// commitBlock writes the state changes of a block on top of the current head
+// and makes it the new head. The block is saved with its undo journal, so
+// it can be reverted if the fork choice moves to another chain.
+func (bc *Blockchain) commitBlock(sb *StateBatch, block *protobufs.Block, receipts []*Receipt, stateRoot []byte) error {
+	info, blockBytes, err := bc.newBlockInfo(block)
+	if err != nil {
+		return err
+	}
+
+	meta := bc.meta()
+	meta.HeadIndex = info.Index
+	meta.HeadHash = info.Hash
+	if !bc.HasGenesis() {
+		meta.GenesisTimestamp = block.GetTimestamp()
+		meta.GenesisHash = info.Hash
+		meta.Checkpoint = info.Index
+		meta.CheckpointHash = info.Hash
+	}
+
+	rawMeta, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	bc.storeBlock(batch, info, blockBytes)
+	batch.Put(canonicalKey(info.Index), info.Hash)
+	batch.Put(stateRootKey(info.Hash), stateRoot)
+	batch.Put(metaKey, rawMeta)
+	for _, r := range receipts {
+		raw, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		batch.Put(receiptKey(r.TransactionHash), raw)
+	}
+	err = indexLogs(batch, info.Hash, receipts)
+	if err != nil {
+		return err
+	}
+	err = indexTransactions(batch, info.Hash, block, receipts)
+	if err != nil {
+		return err
+	}
+
+	err = bc.writeState(sb, batch, undoKey(info.Hash))
+	if err != nil {
+		return err
+	}
+
+	bc.setMeta(meta)
+	return nil
+}
+
+// writeState commits the staged state and then batch to blockDb. The previous
+// value of every key is saved in a journal before anything else, so if the
+// node stops half way repair can restore them. If journalKey isn't nil the
+// journal is also kept there.
+func (bc *Blockchain) writeState(sb *StateBatch, batch *leveldb.Batch, journalKey []byte) error {
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+
+	journal, err := sb.journal()
+	if err != nil {
+		return err
+	}
+
+	rawJournal, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	err = bc.blockDb.Put(pendingKey, rawJournal, syncWrite)
+	if err != nil {
+		return err
+	}
+
+	err = sb.Commit()
+	if err != nil {
+		// Some databases may already have the new state, put back the old one
+		if rerr := bc.repair(); rerr != nil {
+			log.Error("repair ", rerr)
+		}
+		return err
+	}
+
+	if journalKey != nil {
+		batch.Put(journalKey, rawJournal)
+	}
+	batch.Delete(pendingKey)
+
+	err = bc.blockDb.Write(batch, syncWrite)
+	if err != nil {
+		if rerr := bc.repair(); rerr != nil {
+			log.Error("repair ", rerr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// restoreJournal stages the values saved in a journal
+func (bc *Blockchain) restoreJournal(sb *StateBatch, journal *blockJournal) error {
+	dbs := bc.stateDbs()
+	for _, e := range journal.Entries {
+		db, ok := dbs[e.Db]
+		if !ok {
+			return errors.New("Unknown database " + e.Db + " in journal")
+		}
+
+		if e.Missing {
+			sb.delete(db, e.Key)
+		} else {
+			sb.put(db, e.Key, e.Value)
+		}
+	}
+	return nil
+}
+
+// repair looks for the journal of a block that wasn't fully written and
+// restores the state as it was before that block
+func (bc *Blockchain) repair() error {
+	raw, err := bc.blockDb.Get(pendingKey, nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	journal := blockJournal{}
+	err = json.Unmarshal(raw, &journal)
+	if err != nil {
+		return err
+	}
+
+	log.Warning("The node stopped while writing a block, restoring the previous state")
+
+	sb := bc.NewStateBatch()
+	err = bc.restoreJournal(sb, &journal)
+	if err != nil {
+		return err
+	}
+
+	err = sb.Commit()
+	if err != nil {
+		return err
+	}
+
+	return bc.blockDb.Delete(pendingKey, syncWrite)
+}
@@ -1,26 +1,202 @@
 package blockchain
 
 import (
-	"crypto/sha256"
+	"bytes"
 	"errors"
-	"reflect"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/dexm-coin/dexmd/util"
 	"github.com/dexm-coin/dexmd/wallet"
 	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
 	"github.com/golang/protobuf/proto"
-	pq "github.com/jupp0r/go-priority-queue"
 	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
+// Transactions with a nonce too far ahead of the sender are rejected, they
+// would just sit in the queue
+const maxNonceGap = 64
+
+// poolTx is a transaction waiting in the mempool
+type poolTx struct {
+	tx       *protobufs.Transaction
+	hash     []byte
+	sender   string
+	size     int
+	priority float64
+}
+
+// mempool keeps the transactions of every sender ordered by nonce. The ones
+// that follow the nonce of the sender without gaps are pending and can go in
+// a block, the others are queued till the missing ones arrive.
 type mempool struct {
 	maxBlockBytes int
 	maxGasPerByte float64
-	queue         pq.PriorityQueue
+	maxCount      int
+	maxBytes      int
+
+	mu      sync.Mutex
+	senders map[string]map[uint32]*poolTx
+	count   int
+	size    int
+}
+
+func newMempool(maxBlockSize int, maxGas float64, maxCount, maxBytes int) *mempool {
+	return &mempool{
+		maxBlockBytes: maxBlockSize,
+		maxGasPerByte: maxGas,
+		maxCount:      maxCount,
+		maxBytes:      maxBytes,
+		senders:       make(map[string]map[uint32]*poolTx),
+	}
+}
+
+func (mp *mempool) remove(ptx *poolTx) {
+	txs := mp.senders[ptx.sender]
+	if txs[ptx.tx.GetNonce()] != ptx {
+		return
+	}
+
+	delete(txs, ptx.tx.GetNonce())
+	if len(txs) == 0 {
+		delete(mp.senders, ptx.sender)
+	}
+
+	mp.count--
+	mp.size -= ptx.size
+}
+
+// lowest returns the transaction with the lowest gas per byte among the last
+// ones of every sender, leaving out the ones in skip. Removing one in the
+// middle would leave the nonces after it stuck in the queue.
+func (mp *mempool) lowest(skip map[*poolTx]bool) *poolTx {
+	var res *poolTx
+	for _, txs := range mp.senders {
+		var last *poolTx
+		for nonce, ptx := range txs {
+			if skip[ptx] {
+				continue
+			}
+			if last == nil || nonce > last.tx.GetNonce() {
+				last = ptx
+			}
+		}
+		if last != nil && (res == nil || last.priority < res.priority) {
+			res = last
+		}
+	}
+	return res
+}
+
+// add inserts a transaction, replacing the one with the same nonce if it
+// pays more gas and evicting the cheapest ones if the pool is full. What has
+// to go is worked out first and nothing changes if the transaction doesn't
+// fit. save is called with the dropped transactions before the pool is
+// changed, if it fails the transaction isn't added.
+func (mp *mempool) add(ptx *poolTx, save func(dropped []*poolTx) error) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	var dropped []*poolTx
+	skip := make(map[*poolTx]bool)
+	count, size := mp.count, mp.size
+
+	nonce := ptx.tx.GetNonce()
+	if old, ok := mp.senders[ptx.sender][nonce]; ok {
+		if ptx.tx.GetGas() <= old.tx.GetGas() {
+			return errors.New("A transaction with the same nonce and more gas is already in the mempool")
+		}
+		dropped = append(dropped, old)
+		skip[old] = true
+		count--
+		size -= old.size
+	}
+
+	for count+1 > mp.maxCount || size+ptx.size > mp.maxBytes {
+		cheapest := mp.lowest(skip)
+		if cheapest == nil || cheapest.priority >= ptx.priority {
+			return errors.New("The mempool is full")
+		}
+		// The new transaction would be stuck behind the evicted one
+		if cheapest.sender == ptx.sender && cheapest.tx.GetNonce() < nonce {
+			return errors.New("The mempool is full")
+		}
+		dropped = append(dropped, cheapest)
+		skip[cheapest] = true
+		count--
+		size -= cheapest.size
+	}
+
+	err := save(dropped)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range dropped {
+		mp.remove(d)
+	}
+	if _, ok := mp.senders[ptx.sender]; !ok {
+		mp.senders[ptx.sender] = make(map[uint32]*poolTx)
+	}
+	mp.senders[ptx.sender][nonce] = ptx
+	mp.count++
+	mp.size += ptx.size
+	return nil
+}
+
+// pending returns the transactions of a sender that can be included right
+// now, starting from the nonce after stateNonce
+func (mp *mempool) pending(sender string, stateNonce uint32) []*poolTx {
+	var res []*poolTx
+	for nonce := stateNonce + 1; ; nonce++ {
+		ptx, ok := mp.senders[sender][nonce]
+		if !ok {
+			return res
+		}
+		res = append(res, ptx)
+	}
+}
+
+// prune removes the transactions with a nonce up to stateNonce, they are
+// already in the chain
+func (mp *mempool) prune(sender string, stateNonce uint32) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for nonce, ptx := range mp.senders[sender] {
+		if nonce <= stateNonce {
+			mp.remove(ptx)
+		}
+	}
 }
 
-func newMempool(maxBlockSize int, maxGas float64) *mempool {
-	return &mempool{maxBlockSize, maxGas, pq.New()}
+// checkTransaction does the checks that don't depend on the nonce and returns
+// the state of the sender
+func (bc *Blockchain) checkTransaction(t *protobufs.Transaction) (protobufs.AccountState, error) {
+	if !wallet.IsWalletValid(t.GetRecipient()) {
+		return protobufs.AccountState{}, errors.New("Invalid recipient")
+	}
+
+	valid, err := wallet.TransactionSignatureValid(t)
+	if !valid || err != nil {
+		return protobufs.AccountState{}, errors.New("Invalid signature")
+	}
+
+	sender := wallet.BytesToAddress(t.GetSender(), t.GetShard())
+	balance, err := bc.GetWalletState(sender)
+	if err != nil {
+		return balance, err
+	}
+
+	// Check if balance is sufficient
+	requiredBal, ok := util.AddU64O(t.GetAmount(), uint64(t.GetGas()))
+	if requiredBal > balance.GetBalance() || !ok {
+		return balance, errors.New("Balance is insufficient in transaction")
+	}
+
+	return balance, nil
 }
 
 // AddMempoolTransaction adds a transaction to the mempool
@@ -33,50 +209,170 @@ func (bc *Blockchain) AddMempoolTransaction(rawTx []byte) error {
 		return err
 	}
 
-	err = bc.ValidateTransaction(pb)
+	balance, err := bc.checkTransaction(pb)
 	if err != nil {
 		log.Error(err)
 		return err
 	}
 
+	// Transactions from the future are kept in the queue
+	if pb.GetNonce() <= balance.GetNonce() || pb.GetNonce() > balance.GetNonce()+maxNonceGap {
+		return errors.New("Invalid nonce in transaction")
+	}
+
 	priority := float64(pb.GetGas()) / float64(len(rawTx))
 
 	if priority > bc.Mempool.maxGasPerByte {
 		return errors.New("Too much gas")
 	}
 
-	bhash := sha256.Sum256(rawTx)
-	hash := bhash[:]
+	hash, err := wallet.TransactionHash(pb)
+	if err != nil {
+		return err
+	}
 
-	bc.blockDb.Put(hash, rawTx, nil)
-	bc.Mempool.queue.Insert(hash, priority)
-	return nil
+	ptx := &poolTx{
+		tx:       pb,
+		hash:     hash,
+		sender:   wallet.BytesToAddress(pb.GetSender(), pb.GetShard()),
+		size:     len(rawTx),
+		priority: priority,
+	}
+
+	// The replaced and evicted transactions are removed from the disk too,
+	// or they would come back after a restart
+	return bc.Mempool.add(ptx, func(dropped []*poolTx) error {
+		batch := new(leveldb.Batch)
+		for _, d := range dropped {
+			batch.Delete(d.hash)
+		}
+		batch.Put(hash, rawTx)
+		return bc.mempoolDb.Write(batch, nil)
+	})
 }
 
-// GenerateBlock generates a valid unsigned block with transactions from the mempool
-func (bc *Blockchain) GenerateBlock(miner string, shard uint32, validators *ValidatorsBook) (*protobufs.Block, error) {
-	hash := []byte{}
-
-	if bc.CurrentBlock != 0 {
-		currBlocks := []byte{}
-		var err error
-		// There may be holes in the blockchain. Keep going till you find a block
-		for i := bc.CurrentBlock - 1; i > 0; i-- {
-			currBlocks, err = bc.GetBlock(i)
-			if err == nil {
-				break
+// SetMempoolLimits changes the number of transactions and the bytes the
+// mempool can hold, the transactions already in it are kept
+func (bc *Blockchain) SetMempoolLimits(maxCount, maxBytes int) {
+	bc.Mempool.mu.Lock()
+	defer bc.Mempool.mu.Unlock()
+
+	bc.Mempool.maxCount = maxCount
+	bc.Mempool.maxBytes = maxBytes
+}
+
+// loadMempool adds the transactions saved in mempoolDb to the mempool, the
+// ones that aren't valid anymore are removed
+func (bc *Blockchain) loadMempool() error {
+	iter := bc.mempoolDb.NewIterator(nil, nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		if bc.AddMempoolTransaction(iter.Value()) != nil {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return bc.mempoolDb.Write(batch, nil)
+}
+
+// MempoolSize returns the number of transactions that can go in the next
+// block and the number of the ones waiting for a previous nonce
+func (bc *Blockchain) MempoolSize() (pending, queued int) {
+	bc.Mempool.mu.Lock()
+	defer bc.Mempool.mu.Unlock()
+
+	for sender := range bc.Mempool.senders {
+		state, _ := bc.GetWalletState(sender)
+		pending += len(bc.Mempool.pending(sender, state.GetNonce()))
+	}
+	return pending, bc.Mempool.count - pending
+}
+
+// pruneMempool removes the transactions of senders whose nonce changed
+func (bc *Blockchain) pruneMempool(senders map[string]bool) {
+	for sender := range senders {
+		state, err := bc.GetWalletState(sender)
+		if err != nil {
+			continue
+		}
+		bc.Mempool.prune(sender, state.GetNonce())
+	}
+}
+
+// selectTransactions picks the pending transactions with the most gas per
+// byte, keeping the nonce order of every sender, till the block is full
+func (bc *Blockchain) selectTransactions(shard uint32, available int) []*protobufs.Transaction {
+	bc.Mempool.mu.Lock()
+	defer bc.Mempool.mu.Unlock()
+
+	type candidate struct {
+		txs     []*poolTx
+		balance uint64
+	}
+
+	var candidates []*candidate
+	for sender := range bc.Mempool.senders {
+		state, err := bc.GetWalletState(sender)
+		if err != nil {
+			continue
+		}
+
+		txs := bc.Mempool.pending(sender, state.GetNonce())
+		if len(txs) == 0 || txs[0].tx.GetShard() != shard {
+			continue
+		}
+		candidates = append(candidates, &candidate{txs, state.GetBalance()})
+	}
+
+	// Same order on every run
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].txs[0].sender < candidates[j].txs[0].sender
+	})
+
+	var transactions []*protobufs.Transaction
+	for {
+		var best *candidate
+		for _, c := range candidates {
+			if len(c.txs) == 0 {
+				continue
+			}
+			if best == nil || c.txs[0].priority > best.txs[0].priority {
+				best = c
 			}
 		}
 
-		bhash := sha256.Sum256(currBlocks)
-		hash = bhash[:]
+		if best == nil {
+			return transactions
+		}
+
+		ptx := best.txs[0]
+		required := ptx.tx.GetAmount() + uint64(ptx.tx.GetGas())
+
+		// The following nonces can't be included without this one
+		if ptx.size > available || required > best.balance {
+			best.txs = nil
+			continue
+		}
+
+		best.txs = best.txs[1:]
+		best.balance -= required
+		available -= ptx.size
+		transactions = append(transactions, ptx.tx)
 	}
+}
 
+// GenerateBlock generates a valid unsigned block with transactions from the mempool
+func (bc *Blockchain) GenerateBlock(miner string, shard uint32, validators *ValidatorsBook) (*protobufs.Block, error) {
 	block := protobufs.Block{
 		Index:     bc.CurrentBlock,
 		Timestamp: uint64(time.Now().Unix()),
 		Miner:     miner,
-		PrevHash:  hash,
+		PrevHash:  bc.HeadHash,
 		Shard:     shard,
 	}
 
@@ -89,70 +385,64 @@ func (bc *Blockchain) GenerateBlock(miner string, shard uint32, validators *Vali
 
 	currentLen := len(blockHeader)
 
-	// Check that the len is smaller than the max
-	for currentLen < bc.Mempool.maxBlockBytes {
-		tx, err := bc.Mempool.queue.Pop()
-
-		// The mempool is empty, that's all the transactions we can include
-		if err != nil {
-			break
-		}
-
-		rtx := interface{}(tx).(*protobufs.Transaction)
-
-		// check if the transazion is form my shard
-		senderWallet := wallet.BytesToAddress(rtx.GetSender(), rtx.GetShard())
-		shardSender, err := validators.GetShard(senderWallet)
-		if err != nil {
-			log.Error(err)
-			continue
-		}
-		currentShard, err := validators.GetShard(miner)
-		if err != nil {
-			log.Error(err)
+	// Evidence against validators goes first, it's removed from the pending
+	// list once the block is imported
+	for _, e := range bc.Slashing.PendingEvidence() {
+		if !validators.CheckIsValidator(e.Offender) {
 			continue
 		}
-		if shardSender != currentShard {
+		if _, _, err := bc.GetSlashRecord(e.Offender); err == nil {
+			bc.Slashing.RemoveEvidence(e.Offender)
 			continue
 		}
 
-		rawTx, err := proto.Marshal(rtx)
+		tx, err := e.SlashingTransaction()
 		if err != nil {
-			break
-		}
-
-		// check if the hash of this transaction is inside bc.TransactionArrived that contain all the hash of the prev n transaction
-		bhash := sha256.Sum256(rawTx)
-		hash := bhash[:]
-		alreadyReceived := false
-		for _, h := range bc.TransactionArrived {
-			equal := reflect.DeepEqual(h, hash)
-			if equal {
-				alreadyReceived = true
-				break
-			}
-		}
-		if alreadyReceived {
+			log.Error(err)
 			continue
 		}
 
-		transactions = append(transactions, rtx)
-		currentLen += len(rawTx)
+		transactions = append(transactions, tx)
+		currentLen += len(tx.GetData())
 	}
 
+	transactions = append(transactions, bc.selectTransactions(shard, bc.Mempool.maxBlockBytes-currentLen)...)
+
 	block.Transactions = transactions
 
-	merkleRootTransaction := []byte{}
-	merkleRootReceipt := []byte{}
-	if len(transactions) != 0 {
-		merkleRootTransaction, merkleRootReceipt, err = GenerateMerkleTree(transactions)
-		if err != nil {
-			return nil, err
-		}
+	err = bc.SealBlock(&block, validators)
+	if err != nil {
+		return nil, err
 	}
 
-	block.MerkleRootTransaction = merkleRootTransaction
-	block.MerkleRootReceipt = merkleRootReceipt
-
 	return &block, nil
 }
+
+// SealBlock fills the transactions and receipts roots of a block built on top
+// of the current head
+func (bc *Blockchain) SealBlock(block *protobufs.Block, validators *ValidatorsBook) error {
+	if !bytes.Equal(block.GetPrevHash(), bc.HeadHash) {
+		return errors.New("The block doesn't follow the current head")
+	}
+
+	block.MerkleRootTransaction = []byte{}
+	block.MerkleRootReceipt = []byte{}
+	if len(block.GetTransactions()) == 0 {
+		return nil
+	}
+
+	root, err := GenerateMerkleTree(block.GetTransactions())
+	if err != nil {
+		return err
+	}
+	block.MerkleRootTransaction = root
+
+	// Run the transactions on a batch that is thrown away to know their
+	// receipts
+	res, err := bc.executeBlock(bc.NewStateBatch(), block, validators)
+	if err != nil {
+		return err
+	}
+	block.MerkleRootReceipt, err = ReceiptsRoot(res.receipts, res.stateRoot)
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"math"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/dexm-coin/dexmd/util"
@@ -12,6 +13,7 @@ import (
 	"github.com/golang/protobuf/proto"
 	log "github.com/sirupsen/logrus"
 	"github.com/syndtr/goleveldb/leveldb"
+	ldbutil "github.com/syndtr/goleveldb/leveldb/util"
 )
 
 // Blockchain is an internal representation of a blockchain
@@ -21,9 +23,14 @@ type Blockchain struct {
 	ContractDb    *leveldb.DB
 	StateDb       *leveldb.DB
 	CasperVotesDb *leveldb.DB
+	mempoolDb     *leveldb.DB
 
-	Mempool            *mempool
-	TransactionArrived [][]byte
+	// writeMu is held while the state is written, pruning takes it to
+	// remove the old trie nodes
+	writeMu sync.Mutex
+
+	Mempool  *mempool
+	Slashing *SlashingDetector
 
 	Schnorr             map[string][]byte
 	MTTrasaction        [][]byte
@@ -34,9 +41,15 @@ type Blockchain struct {
 	MessagesReceipt     [][]byte
 
 	GenesisTimestamp uint64
+	GenesisHash      []byte
+
+	// Last block committed, saved in blockDb together with the checkpoint
+	HeadIndex uint64
+	HeadHash  []byte
 
 	CurrentBlock      uint64
 	CurrentCheckpoint uint64
+	CheckpointHash    []byte
 	CurrentValidator  string
 	CurrentVote       uint64
 }
@@ -82,6 +95,13 @@ func NewBlockchain(dbPath string, index uint64) (*Blockchain, error) {
 		return nil, err
 	}
 
+	err = checkSchema(dbb)
+	if err != nil {
+		db.Close()
+		dbb.Close()
+		return nil, err
+	}
+
 	cdb, err := leveldb.OpenFile(dbPath+".code", nil)
 	if err != nil {
 		return nil, err
@@ -97,18 +117,24 @@ func NewBlockchain(dbPath string, index uint64) (*Blockchain, error) {
 		return nil, err
 	}
 
-	// 1MB blocks
-	mp := newMempool(1000000, 100)
+	mpdb, err := leveldb.OpenFile(dbPath+".mempool", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// 1MB blocks, at most 5000 transactions or 32MB waiting
+	mp := newMempool(1000000, 100, 5000, 32000000)
 
-	return &Blockchain{
+	bc := &Blockchain{
 		balancesDb:    db,
 		blockDb:       dbb,
 		ContractDb:    cdb,
 		StateDb:       sdb,
 		CasperVotesDb: cvdb,
+		mempoolDb:     mpdb,
 
-		Mempool:            mp,
-		TransactionArrived: [][]byte{},
+		Mempool:  mp,
+		Slashing: NewSlashingDetector(),
 
 		Schnorr:             make(map[string][]byte),
 		MTTrasaction:        [][]byte{},
@@ -121,7 +147,38 @@ func NewBlockchain(dbPath string, index uint64) (*Blockchain, error) {
 		CurrentBlock:      index,
 		CurrentCheckpoint: 0,
 		CurrentVote:       0,
-	}, err
+	}
+
+	// Undo the last block if the node stopped while writing it
+	err = bc.repair()
+	if err != nil {
+		return nil, err
+	}
+
+	// Resume from the saved head if there is one
+	err = bc.loadMeta()
+	if err != nil && err != leveldb.ErrNotFound {
+		return nil, err
+	}
+
+	// Put back the transactions that were waiting before the restart
+	err = bc.loadMempool()
+	if err != nil {
+		return nil, err
+	}
+
+	return bc, nil
+}
+
+// Close closes all the databases of the chain
+func (bc *Blockchain) Close() error {
+	for _, db := range []*leveldb.DB{bc.balancesDb, bc.blockDb, bc.ContractDb, bc.StateDb, bc.CasperVotesDb, bc.mempoolDb} {
+		err := db.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // GetWalletState returns the state of a wallet in the current block
@@ -158,15 +215,50 @@ func (bc *BeaconChain) GetBlockBeacon(index int64, shard uint32) ([]byte, error)
 	return bc.MerkleRootsDb[shard].Get([]byte(strconv.Itoa(int(index))), nil)
 }
 
-// SaveBlock saves an unvalidated block into the blockchain to be used with Casper
+// SaveBlock saves an unvalidated block into the blockchain to be used with Casper.
+// Blocks are saved by hash so different blocks for the same index are all
+// kept, the state is only changed once the fork choice picks the block.
 func (bc *Blockchain) SaveBlock(block *protobufs.Block) error {
-	res, _ := proto.Marshal(block)
-	return bc.blockDb.Put([]byte(strconv.Itoa(int(block.GetIndex()))), res, nil)
+	info, blockBytes, err := bc.newBlockInfo(block)
+	if err != nil {
+		return err
+	}
+
+	// Don't add the block to the possible heads again
+	if _, err := bc.getBlockInfo(info.Hash); err == nil {
+		return nil
+	}
+
+	batch := new(leveldb.Batch)
+	bc.storeBlock(batch, info, blockBytes)
+	return bc.blockDb.Write(batch, nil)
 }
 
-// GetBlock returns the array of blocks at an index
+// GetBlock returns the block of the canonical chain at an index
 func (bc *Blockchain) GetBlock(index uint64) ([]byte, error) {
-	return bc.blockDb.Get([]byte(strconv.Itoa(int(index))), nil)
+	hash, err := bc.blockDb.Get(canonicalKey(index), nil)
+	if err != nil {
+		return nil, err
+	}
+	return bc.GetBlockByHash(hash)
+}
+
+// GetBlockByHash returns a block from any fork
+func (bc *Blockchain) GetBlockByHash(hash []byte) ([]byte, error) {
+	return bc.blockDb.Get(blockKey(hash), nil)
+}
+
+// GetBlocksAtIndex returns the hashes of all the blocks known at an index
+func (bc *Blockchain) GetBlocksAtIndex(index uint64) [][]byte {
+	var hashes [][]byte
+
+	iter := bc.blockDb.NewIterator(ldbutil.BytesPrefix(heightKey(index, nil)), nil)
+	defer iter.Release()
+
+	for iter.Next() {
+		hashes = append(hashes, append([]byte{}, iter.Key()[9:]...))
+	}
+	return hashes
 }
 
 // GetContractCode returns the code of a contract at an address. Used
@@ -191,14 +283,17 @@ func (bc *Blockchain) ValidateBlock(block *protobufs.Block) (bool, error) {
 	// TODO do a check that the signature of the block should match with the validator choosen for that index
 
 	for i, t := range block.GetTransactions() {
-		sender := wallet.BytesToAddress(t.GetSender(), t.GetShard())
+		// Slashing evidence has no sender, it's checked when the block is applied
+		if t.GetRecipient() == SlashAddress {
+			continue
+		}
 
-		result, _ := proto.Marshal(t)
+		sender := wallet.BytesToAddress(t.GetSender(), t.GetShard())
 
-		valid, err := wallet.SignatureValid(t.GetSender(), t.GetR(), t.GetS(), result)
+		valid, err := wallet.TransactionSignatureValid(t)
 		if !valid || err != nil {
 			log.Error("SignatureValid ", err)
-			return false, err
+			return false, errors.New("Invalid signature in transaction " + strconv.Itoa(i))
 		}
 
 		balance := protobufs.AccountState{}
@@ -261,36 +356,15 @@ func (bc *Blockchain) SetState(wallet string, newState *protobufs.AccountState)
 // Different from ValidateBlock because that has to verify for double spends
 // inside the same block.
 func (bc *Blockchain) ValidateTransaction(t *protobufs.Transaction) error {
-	sender := wallet.BytesToAddress(t.GetSender(), t.GetShard())
-
-	if !wallet.IsWalletValid(t.GetRecipient()) {
-		return errors.New("Invalid recipient")
-	}
-
-	// TODO change []byte{} with the hash of the transaction
-	valid, err := wallet.SignatureValid(t.GetSender(), t.GetR(), t.GetS(), []byte{})
-	if !valid {
-		return err
-	}
-
-	balance := protobufs.AccountState{}
-	balance, err = bc.GetWalletState(sender)
+	balance, err := bc.checkTransaction(t)
 	if err != nil {
 		return err
 	}
 
-	if balance.Nonce != t.Nonce {
-		return errors.New("Invalid nonce")
-	}
-
-	// Check if balance is sufficient
-	requiredBal, ok := util.AddU64O(t.GetAmount(), uint64(t.GetGas()))
-	if requiredBal > balance.GetBalance() && ok {
-		return errors.New("Balance is insufficient in transaction")
-	}
-
-	// Check if nonce is correct
-	if t.GetNonce() != balance.GetNonce() || !ok {
+	// Check if nonce is correct, like in ValidateBlock it has to be the
+	// next one of the sender
+	newNonce, ok := util.AddU32O(balance.GetNonce(), uint32(1))
+	if t.GetNonce() != newNonce || !ok {
 		return errors.New("Invalid nonce in transaction")
 	}
 
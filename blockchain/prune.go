@@ -0,0 +1,357 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// PruneMode is what a node forgets about old blocks
+type PruneMode int
+
+const (
+	// PruneArchive keeps everything
+	PruneArchive PruneMode = iota
+	// PruneRecent drops the state diffs of the blocks older than the last
+	// Keep, the blocks themselves are kept
+	PruneRecent
+	// PruneFinalized drops the blocks before the last checkpoint together
+	// with their state diffs, receipts and logs
+	PruneFinalized
+)
+
+// PruneConfig is how a node prunes its databases
+type PruneConfig struct {
+	Mode PruneMode
+	Keep uint64
+}
+
+// prunedKey is the index of the first block that wasn't pruned yet
+var prunedKey = []byte("pruned")
+
+// Databases are the names of the databases of a chain, they are opened as
+// dbPath + name
+var Databases = []string{".balances", ".blocks", ".code", ".memory", ".votes", ".mempool"}
+
+// ParsePruneMode reads a pruning mode from the command line: archive,
+// finalized or the number of blocks to keep
+func ParsePruneMode(s string) (PruneConfig, error) {
+	switch s {
+	case "", "archive":
+		return PruneConfig{Mode: PruneArchive}, nil
+	case "finalized":
+		return PruneConfig{Mode: PruneFinalized}, nil
+	}
+
+	keep, err := strconv.ParseUint(s, 10, 64)
+	if err != nil || keep == 0 {
+		return PruneConfig{}, errors.New("The pruning mode must be archive, finalized or a number of blocks")
+	}
+	return PruneConfig{Mode: PruneRecent, Keep: keep}, nil
+}
+
+// pruneHorizon returns the first block that is kept. Blocks after the
+// checkpoint can still be reverted and the next ones are applied on top of
+// their state, so they are never pruned.
+func (bc *Blockchain) pruneHorizon(cfg PruneConfig) uint64 {
+	horizon := bc.CurrentCheckpoint
+	if cfg.Mode == PruneRecent {
+		if bc.HeadIndex < cfg.Keep {
+			return 0
+		}
+		if bc.HeadIndex-cfg.Keep < horizon {
+			horizon = bc.HeadIndex - cfg.Keep
+		}
+	}
+	return horizon
+}
+
+func (bc *Blockchain) prunedIndex() uint64 {
+	raw, err := bc.blockDb.Get(prunedKey, nil)
+	if err != nil || len(raw) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(raw)
+}
+
+// Prune removes what the pruning mode doesn't need anymore. Transactions that
+// left the mempool are removed in every mode.
+func (bc *Blockchain) Prune(cfg PruneConfig) error {
+	err := bc.pruneMempoolTransactions()
+	if err != nil || cfg.Mode == PruneArchive {
+		return err
+	}
+
+	horizon := bc.pruneHorizon(cfg)
+	from := bc.prunedIndex()
+	if horizon <= from {
+		return nil
+	}
+	log.Info("Pruning blocks from ", from, " to ", horizon)
+
+	for index := from; index < horizon; index++ {
+		err = bc.pruneBlocksAt(index, cfg.Mode == PruneFinalized)
+		if err != nil {
+			return err
+		}
+	}
+
+	raw := make([]byte, 8)
+	binary.BigEndian.PutUint64(raw, horizon)
+	err = bc.blockDb.Put(prunedKey, raw, nil)
+	if err != nil {
+		return err
+	}
+
+	err = bc.pruneVotes(horizon)
+	if err != nil {
+		return err
+	}
+
+	return bc.pruneTrie(horizon)
+}
+
+// pruneBlocksAt removes the forks at index and the state diff of the
+// canonical block, if dropBlock is true the canonical block goes as well.
+// The genesis is always kept.
+func (bc *Blockchain) pruneBlocksAt(index uint64, dropBlock bool) error {
+	canonical, err := bc.blockDb.Get(canonicalKey(index), nil)
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	for _, hash := range bc.GetBlocksAtIndex(index) {
+		if string(hash) != string(canonical) {
+			batch.Delete(blockKey(hash))
+			batch.Delete(infoKey(hash))
+			batch.Delete(heightKey(index, hash))
+			batch.Delete(leafKey(hash))
+			continue
+		}
+
+		batch.Delete(undoKey(hash))
+		batch.Delete(stateRootKey(hash))
+		if !dropBlock || index == 0 {
+			continue
+		}
+
+		// The info is kept so the chain can still be walked back
+		raw, err := bc.GetBlockByHash(hash)
+		if err != nil {
+			continue
+		}
+		block := &protobufs.Block{}
+		err = proto.Unmarshal(raw, block)
+		if err != nil {
+			return err
+		}
+
+		var receipts []*Receipt
+		for _, t := range block.GetTransactions() {
+			txHash, err := wallet.TransactionHash(t)
+			if err != nil {
+				return err
+			}
+			if r, err := bc.GetReceipt(txHash); err == nil {
+				receipts = append(receipts, r)
+			}
+			batch.Delete(receiptKey(txHash))
+			batch.Delete(transactionKey(txHash))
+		}
+		unindexLogs(batch, hash, receipts)
+		unindexTransactions(batch, receipts)
+		batch.Delete(blockKey(hash))
+	}
+
+	return bc.blockDb.Write(batch, nil)
+}
+
+// pruneVotes removes the Casper votes for blocks before horizon
+func (bc *Blockchain) pruneVotes(horizon uint64) error {
+	iter := bc.CasperVotesDb.NewIterator(nil, nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		vote := &protobufs.CasperVote{}
+		if proto.Unmarshal(iter.Value(), vote) != nil {
+			continue
+		}
+		if vote.GetTargetHeight() < horizon {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return bc.CasperVotesDb.Write(batch, nil)
+}
+
+// pruneTrie removes the nodes of the trie that can't be reached from the
+// state roots from horizon to the head. Nodes are shared between roots and a
+// new block could write again a node that is about to be removed, so no
+// block is committed in the meantime.
+func (bc *Blockchain) pruneTrie(horizon uint64) error {
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+
+	t := &trie{bc.NewStateBatch()}
+	live := make(map[string]bool)
+
+	var mark func(hash []byte) error
+	mark = func(hash []byte) error {
+		if string(hash) == string(emptyRoot) || live[string(hash)] {
+			return nil
+		}
+		live[string(hash)] = true
+
+		raw, err := t.node(hash)
+		if err != nil {
+			return err
+		}
+		if raw[0] == trieLeaf {
+			return nil
+		}
+
+		err = mark(raw[1 : 1+len(emptyRoot)])
+		if err != nil {
+			return err
+		}
+		return mark(raw[1+len(emptyRoot):])
+	}
+
+	// The canonical blocks are read from the database instead of stopping at
+	// bc.HeadIndex, the head in memory is only updated after a block has
+	// released writeMu
+	blocks := bc.blockDb.NewIterator(&util.Range{
+		Start: canonicalKey(horizon),
+		Limit: []byte{'n' + 1},
+	}, nil)
+	defer blocks.Release()
+
+	for blocks.Next() {
+		root, err := bc.GetStateRoot(blocks.Value())
+		if err != nil {
+			return err
+		}
+		err = mark(root)
+		if err != nil {
+			return err
+		}
+	}
+	if err := blocks.Error(); err != nil {
+		return err
+	}
+
+	prefix := trieNodeKey(nil)
+	iter := bc.StateDb.NewIterator(util.BytesPrefix(prefix), nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		if !live[string(iter.Key()[len(prefix):])] {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	log.Info("Removing ", batch.Len(), " trie nodes")
+	return bc.StateDb.Write(batch, nil)
+}
+
+// pruneMempoolTransactions removes from mempoolDb the transactions that
+// aren't in the mempool anymore
+func (bc *Blockchain) pruneMempoolTransactions() error {
+	// The lock is held till the end, a transaction added in the meantime
+	// would be deleted from the disk while it's still waiting
+	bc.Mempool.mu.Lock()
+	defer bc.Mempool.mu.Unlock()
+
+	waiting := make(map[string]bool)
+	for _, txs := range bc.Mempool.senders {
+		for _, ptx := range txs {
+			waiting[string(ptx.hash)] = true
+		}
+	}
+
+	iter := bc.mempoolDb.NewIterator(nil, nil)
+	defer iter.Release()
+
+	batch := new(leveldb.Batch)
+	for iter.Next() {
+		if !waiting[string(iter.Key())] {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	return bc.mempoolDb.Write(batch, nil)
+}
+
+// Compact compacts all the databases of the chain, so the space of what was
+// deleted is given back to the disk
+func (bc *Blockchain) Compact() error {
+	for _, db := range []*leveldb.DB{bc.balancesDb, bc.blockDb, bc.ContractDb, bc.StateDb, bc.CasperVotesDb, bc.mempoolDb} {
+		err := db.CompactRange(util.Range{})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StartPruning prunes and compacts the databases every interval till the
+// chain is closed, it's meant to run in its own goroutine
+func (bc *Blockchain) StartPruning(cfg PruneConfig, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := bc.Prune(cfg)
+		if err == nil {
+			err = bc.Compact()
+		}
+
+		if err == leveldb.ErrClosed {
+			return
+		}
+		if err != nil {
+			log.Error("prune ", err)
+		}
+	}
+}
+
+// DiskUsage returns the bytes used by every database of the chain at dbPath
+func DiskUsage(dbPath string) (map[string]int64, error) {
+	usage := make(map[string]int64)
+	for _, name := range Databases {
+		var size int64
+		err := filepath.Walk(dbPath+name, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		usage[name] = size
+	}
+	return usage, nil
+}
@@ -0,0 +1,161 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/onrik/gomerkle"
+)
+
+// Log is an event emitted by a contract
+type Log struct {
+	Address string
+	Topic   []byte
+	Data    []byte
+}
+
+// Transfer is a payment made by a contract with pay()
+type Transfer struct {
+	From   string
+	To     string
+	Amount uint64
+}
+
+// Why a transaction failed, receipts commit to these codes instead of the
+// error message. The message comes from Go and from the VM, so it can change
+// between versions of the node.
+const (
+	FailureNone = iota
+	FailureError
+	FailureOutOfGas
+	FailureReverted
+	FailureCallDepth
+	FailureReentrantCall
+)
+
+// failureCode returns the code of the error a transaction failed with
+func failureCode(err error) int {
+	switch err {
+	case nil:
+		return FailureNone
+	case ErrOutOfGas:
+		return FailureOutOfGas
+	case ErrReverted:
+		return FailureReverted
+	case ErrCallDepth:
+		return FailureCallDepth
+	case ErrReentrantCall:
+		return FailureReentrantCall
+	}
+	return FailureError
+}
+
+// Receipt records what happened when a transaction was applied. A failed
+// transaction is still part of the block: the sender pays the gas and its
+// nonce changes, but nothing else from it is kept. GasUsed is the gas metered
+// while running the transaction, the sender is charged all the gas it sent,
+// which is GasCharged.
+type Receipt struct {
+	TransactionHash []byte
+	BlockIndex      uint64
+
+	Sender    string
+	Recipient string
+	Amount    uint64
+	Nonce     uint32
+
+	Success    bool
+	Failure    int
+	Error      string `json:",omitempty"`
+	GasUsed    uint64
+	GasCharged uint64
+
+	ContractAddress string      `json:",omitempty"`
+	ReturnValue     *uint64     `json:",omitempty"`
+	ReturnData      []byte      `json:",omitempty"`
+	Transfers       []*Transfer `json:",omitempty"`
+	Logs            []*Log      `json:",omitempty"`
+}
+
+// receiptKey is where a receipt is saved in blockDb
+func receiptKey(hash []byte) []byte {
+	return append([]byte("r"), hash...)
+}
+
+func newReceipt(t *protobufs.Transaction, index uint64) *Receipt {
+	hash, _ := wallet.TransactionHash(t)
+
+	r := &Receipt{
+		TransactionHash: hash,
+		BlockIndex:      index,
+		Recipient:       t.GetRecipient(),
+		Amount:          t.GetAmount(),
+		Nonce:           t.GetNonce(),
+		Success:         true,
+	}
+	if t.GetRecipient() != SlashAddress {
+		r.Sender = wallet.BytesToAddress(t.GetSender(), t.GetShard())
+	}
+	return r
+}
+
+// fail marks the receipt as failed, the transfers and logs of a failed
+// transaction are dropped together with its state changes
+func (r *Receipt) fail(err error) {
+	r.Success = false
+	r.Failure = failureCode(err)
+	r.Error = err.Error()
+	r.ContractAddress = ""
+	r.ReturnValue = nil
+	r.ReturnData = nil
+	r.Transfers = nil
+	r.Logs = nil
+}
+
+// GetReceipt returns the receipt of a transaction in the canonical chain
+func (bc *Blockchain) GetReceipt(transactionHash []byte) (*Receipt, error) {
+	raw, err := bc.blockDb.Get(receiptKey(transactionHash), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Receipt{}
+	err = json.Unmarshal(raw, r)
+	return r, err
+}
+
+// ReceiptsRoot returns the merkle root of the receipts of a block. Block has
+// no field for the state root, so the state after the block is committed as
+// the last leaf of this tree.
+// A block without transactions has no receipts and an empty root, so it
+// doesn't commit to any state: only blocks with transactions authenticate the
+// state root, anything after the last of them has to be checked by replaying.
+func ReceiptsRoot(receipts []*Receipt, stateRoot []byte) ([]byte, error) {
+	if len(receipts) == 0 {
+		return []byte{}, nil
+	}
+
+	var data [][]byte
+	for _, r := range receipts {
+		// The message is only kept by the node, Failure is what's agreed on
+		hashed := *r
+		hashed.Error = ""
+
+		raw, err := json.Marshal(&hashed)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, raw)
+	}
+	data = append(data, stateRoot)
+
+	tree := gomerkle.NewTree(sha256.New())
+	tree.AddData(data...)
+	err := tree.Generate()
+	if err != nil {
+		return nil, err
+	}
+	return tree.Root(), nil
+}
@@ -0,0 +1,267 @@
+package blockchain
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// Every key of blockDb starts with a prefix telling what it is, the ones of
+// the blocks are in forkchoice.go. Pending transactions have their own
+// database, mempoolDb, under their hash.
+//
+// Old nodes saved blocks under their index in decimal and pending
+// transactions under their hash in blockDb, Migrate converts them. Version 2
+// added the index of the transactions and of the history of the wallets.
+const schemaVersion = 2
+
+// versionKey is the version of the layout of blockDb
+var versionKey = []byte("version")
+
+// checkSchema refuses to open a blockDb with an old layout, a new database
+// gets the current version
+func checkSchema(db *leveldb.DB) error {
+	raw, err := db.Get(versionKey, nil)
+	if err == nil {
+		version, err := strconv.Atoi(string(raw))
+		if err != nil || version > schemaVersion {
+			return errors.New("Unknown database version " + string(raw))
+		}
+		if version < schemaVersion {
+			return errors.New("The database has an old layout, run the migrate command")
+		}
+		return nil
+	}
+	if err != leveldb.ErrNotFound {
+		return err
+	}
+
+	iter := db.NewIterator(nil, nil)
+	empty := !iter.First()
+	iter.Release()
+	if !empty {
+		return errors.New("The database has an old layout, run the migrate command")
+	}
+
+	return db.Put(versionKey, []byte(strconv.Itoa(schemaVersion)), nil)
+}
+
+// isLegacyIndex is true for the keys of the blocks saved by old nodes
+func isLegacyIndex(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	for _, c := range key {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// Migrate converts the databases of a chain at dbPath to the current layout,
+// one version after the other. Pending transactions are moved to their own
+// database and the canonical transactions get indexed. Old nodes had no
+// journal and no state root, so the blocks they saved are kept as known
+// blocks and their state is removed: the node applies them again from the
+// genesis once it starts.
+func Migrate(dbPath string) error {
+	db, err := leveldb.OpenFile(dbPath+".blocks", nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	version := 0
+	raw, err := db.Get(versionKey, nil)
+	if err == nil {
+		version, err = strconv.Atoi(string(raw))
+		if err != nil || version > schemaVersion {
+			return errors.New("Unknown database version " + string(raw))
+		}
+	} else if err != leveldb.ErrNotFound {
+		return err
+	}
+	if version == schemaVersion {
+		return nil
+	}
+
+	bc := &Blockchain{blockDb: db}
+	err = bc.loadMeta()
+	if err != nil && err != leveldb.ErrNotFound {
+		return err
+	}
+
+	if version < 1 {
+		err = bc.migrateLegacyLayout(dbPath)
+		if err != nil {
+			return err
+		}
+	}
+
+	if version < 2 && bc.HasGenesis() {
+		log.Info("Indexing the transactions")
+		err = bc.migrateTransactionIndex()
+		if err != nil {
+			return err
+		}
+	}
+
+	return db.Put(versionKey, []byte(strconv.Itoa(schemaVersion)), syncWrite)
+}
+
+// migrateLegacyLayout moves the pending transactions of an old node to
+// mempoolDb and its blocks from their index to their hash
+func (bc *Blockchain) migrateLegacyLayout(dbPath string) error {
+	mpdb, err := leveldb.OpenFile(dbPath+".mempool", nil)
+	if err != nil {
+		return err
+	}
+	defer mpdb.Close()
+
+	legacy := make(map[uint64][]byte)
+	batch := new(leveldb.Batch)
+	pending := new(leveldb.Batch)
+
+	iter := bc.blockDb.NewIterator(nil, nil)
+	for iter.Next() {
+		key := append([]byte{}, iter.Key()...)
+		switch {
+		case isLegacyIndex(key):
+			index, err := strconv.ParseUint(string(key), 10, 64)
+			if err != nil {
+				continue
+			}
+			legacy[index] = append([]byte{}, iter.Value()...)
+		case len(key) == len(emptyRoot):
+			pending.Put(key, iter.Value())
+		default:
+			continue
+		}
+		batch.Delete(key)
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	log.Info("Moving ", pending.Len(), " pending transactions")
+	err = mpdb.Write(pending, syncWrite)
+	if err != nil {
+		return err
+	}
+	err = bc.blockDb.Write(batch, syncWrite)
+	if err != nil {
+		return err
+	}
+
+	if len(legacy) == 0 {
+		return nil
+	}
+	err = bc.migrateLegacyBlocks(legacy)
+	if err != nil {
+		return err
+	}
+
+	if !bc.HasGenesis() {
+		log.Warning("Removing the old state, the blocks will be applied again")
+		for _, name := range []string{".balances", ".code", ".memory"} {
+			err = os.RemoveAll(dbPath + name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migrateLegacyBlocks saves the blocks of an old node by hash, in order of
+// index so the parent of every block is known before it
+func (bc *Blockchain) migrateLegacyBlocks(legacy map[uint64][]byte) error {
+	var indexes []uint64
+	for index := range legacy {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i] < indexes[j] })
+
+	for _, index := range indexes {
+		block := &protobufs.Block{}
+		err := proto.Unmarshal(legacy[index], block)
+		if err != nil || block.GetIndex() != index {
+			log.Warning("Skipping invalid block ", index)
+			continue
+		}
+
+		info, blockBytes, err := bc.newBlockInfo(block)
+		if err != nil {
+			log.Warning("Skipping block ", index, " ", err)
+			continue
+		}
+
+		batch := new(leveldb.Batch)
+		bc.storeBlock(batch, info, blockBytes)
+		err = bc.blockDb.Write(batch, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	log.Info("Migrated ", len(indexes), " blocks")
+	return nil
+}
+
+// migrateTransactionIndex indexes the transactions of the canonical chain and
+// the history of the wallets in them
+func (bc *Blockchain) migrateTransactionIndex() error {
+	for index := uint64(0); index <= bc.HeadIndex; index++ {
+		hash, err := bc.blockDb.Get(canonicalKey(index), nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		raw, err := bc.GetBlockByHash(hash)
+		if err != nil {
+			// Pruned
+			continue
+		}
+		block := &protobufs.Block{}
+		err = proto.Unmarshal(raw, block)
+		if err != nil {
+			return err
+		}
+
+		var receipts []*Receipt
+		for _, t := range block.GetTransactions() {
+			txHash, err := wallet.TransactionHash(t)
+			if err != nil {
+				return err
+			}
+			r, err := bc.GetReceipt(txHash)
+			if err != nil {
+				return err
+			}
+			receipts = append(receipts, r)
+		}
+
+		batch := new(leveldb.Batch)
+		err = indexTransactions(batch, hash, block, receipts)
+		if err != nil {
+			return err
+		}
+		err = bc.blockDb.Write(batch, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package blockchain
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// maxSimulationGas is the most gas a simulation can use, anyone can ask for
+// one so it's kept low
+const maxSimulationGas = 1000000
+
+// snapshotBatch returns a StateBatch that reads from snapshots of the state
+// and the head they belong to. They are taken under writeMu so no block is
+// half written, but the simulation itself doesn't hold up new blocks.
+func (bc *Blockchain) snapshotBatch() (*StateBatch, *chainMeta, error) {
+	bc.writeMu.Lock()
+	defer bc.writeMu.Unlock()
+
+	sb := bc.NewStateBatch()
+	sb.snaps = make(map[*leveldb.DB]*leveldb.Snapshot)
+	for _, db := range bc.stateDbs() {
+		s, err := db.GetSnapshot()
+		if err != nil {
+			sb.release()
+			return nil, nil, err
+		}
+		sb.snaps[db] = s
+	}
+
+	// The head in memory is only updated after writeMu is released, the one
+	// saved with the state is always in sync with it
+	raw, err := bc.blockDb.Get(metaKey, nil)
+	if err != nil {
+		sb.release()
+		return nil, nil, err
+	}
+	meta := &chainMeta{}
+	err = json.Unmarshal(raw, meta)
+	if err != nil {
+		sb.release()
+		return nil, nil, err
+	}
+	return sb, meta, nil
+}
+
+// release frees the snapshots of a batch from snapshotBatch
+func (sb *StateBatch) release() {
+	for _, s := range sb.snaps {
+		s.Release()
+	}
+}
+
+// SimulateTransaction runs a transaction on top of the current head as if it
+// was in the next block and returns its receipt, with the gas used, the
+// result, the logs and the error if it failed. Nothing is ever committed and
+// the signature isn't checked. Without a nonce the next one of the sender is
+// used, without gas as much as the sender can pay. The gas is never more than
+// maxSimulationGas.
+func (bc *Blockchain) SimulateTransaction(t *protobufs.Transaction) (*Receipt, error) {
+	if t.GetRecipient() == SlashAddress {
+		return nil, errors.New("Slashing can't be simulated")
+	}
+
+	sb, head, err := bc.snapshotBatch()
+	if err != nil {
+		return nil, err
+	}
+	defer sb.release()
+
+	t = proto.Clone(t).(*protobufs.Transaction)
+	block := &protobufs.Block{
+		Index:     head.HeadIndex + 1,
+		Timestamp: uint64(time.Now().Unix()),
+		PrevHash:  head.HeadHash,
+	}
+
+	state, err := sb.GetWalletState(wallet.BytesToAddress(t.GetSender(), t.GetShard()))
+	if err != nil {
+		return nil, errors.New("Unknown sender")
+	}
+
+	if t.GetNonce() == 0 {
+		t.Nonce = state.GetNonce() + 1
+	}
+	if t.GetGas() > maxSimulationGas {
+		t.Gas = maxSimulationGas
+	}
+	if t.GetGas() == 0 && state.GetBalance() > t.GetAmount() {
+		gas := state.GetBalance() - t.GetAmount()
+		if gas > maxSimulationGas {
+			gas = maxSimulationGas
+		}
+		t.Gas = uint32(gas)
+	}
+	receipt := newReceipt(t, block.GetIndex())
+	err = sb.applyTransaction(t, block, receipt)
+	if err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
@@ -0,0 +1,400 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+)
+
+// SlashAddress is the recipient of the transactions that carry slashing
+// evidence inside a block. They have no sender and no signature, the
+// evidence itself is in Data.
+const SlashAddress = "DexmSlash"
+
+// slashRecordPrefix is the prefix in balancesDb of the record saved when a
+// validator is slashed, it's part of the state so it's undone with the block
+const slashRecordPrefix = "DexmSlash/"
+
+// Number of slots a proposal is remembered to find a second one
+const proposalsWindow = 1000
+
+// Number of votes remembered for every validator
+const votesWindow = 10
+
+// SignedBlock is a block together with the signature of its proposer
+type SignedBlock struct {
+	Block []byte
+	R     []byte
+	S     []byte
+}
+
+// Evidence proves that a validator equivocated. It contains either two
+// signed blocks for the same slot or two conflicting Casper votes, plus the
+// public key to check the signatures, so any node can verify it on its own.
+type Evidence struct {
+	Offender  string
+	PublicKey []byte
+
+	Blocks []SignedBlock           `json:",omitempty"`
+	Votes  []*protobufs.CasperVote `json:",omitempty"`
+}
+
+// slashRecord is saved when the stake of a validator is burned
+type slashRecord struct {
+	Index      uint64
+	Stake      uint64
+	EndDynasty int64
+}
+
+// VoteHash is the hash signed by a validator when voting a checkpoint
+func VoteHash(vote *protobufs.CasperVote) []byte {
+	data := fmt.Sprintf("%v%v%v%v%s", vote.GetSource(), vote.GetTarget(), vote.GetSourceHeight(), vote.GetTargetHeight(), vote.GetPublicKey())
+	hash := sha256.Sum256([]byte(data))
+	return hash[:]
+}
+
+// Verify checks that the evidence really proves an equivocation
+func (e *Evidence) Verify() error {
+	if !wallet.AddressMatches(e.PublicKey, e.Offender) {
+		return errors.New("The public key doesn't belong to the offender")
+	}
+
+	switch {
+	case len(e.Blocks) == 2 && len(e.Votes) == 0:
+		return e.verifyBlocks()
+	case len(e.Votes) == 2 && len(e.Blocks) == 0:
+		return e.verifyVotes()
+	}
+	return errors.New("The evidence must have either 2 blocks or 2 votes")
+}
+
+// verifyBlocks checks that the offender signed two different blocks for the
+// same slot
+func (e *Evidence) verifyBlocks() error {
+	var blocks [2]protobufs.Block
+	var hashes [2][]byte
+
+	for i, sb := range e.Blocks {
+		err := proto.Unmarshal(sb.Block, &blocks[i])
+		if err != nil {
+			return err
+		}
+		if blocks[i].GetMiner() != e.Offender {
+			return errors.New("The block wasn't proposed by the offender")
+		}
+
+		hash := sha256.Sum256(sb.Block)
+		hashes[i] = hash[:]
+
+		valid, err := wallet.SignatureValid(e.PublicKey, sb.R, sb.S, hashes[i])
+		if !valid || err != nil {
+			return errors.New("Invalid signature on the block")
+		}
+	}
+
+	if blocks[0].GetIndex() != blocks[1].GetIndex() || blocks[0].GetShard() != blocks[1].GetShard() {
+		return errors.New("The blocks are for different slots")
+	}
+	if bytes.Equal(hashes[0], hashes[1]) {
+		return errors.New("The blocks are the same")
+	}
+	return nil
+}
+
+// verifyVotes checks that the offender cast two votes that Casper forbids,
+// either two votes with the same target height or one surrounding the other
+func (e *Evidence) verifyVotes() error {
+	for _, v := range e.Votes {
+		if v.GetPublicKey() != e.Offender {
+			return errors.New("The vote wasn't cast by the offender")
+		}
+
+		valid, err := wallet.SignatureValid(e.PublicKey, v.GetR(), v.GetS(), VoteHash(v))
+		if !valid || err != nil {
+			return errors.New("Invalid signature on the vote")
+		}
+	}
+
+	if !conflictingVotes(e.Votes[0], e.Votes[1]) {
+		return errors.New("The votes don't conflict")
+	}
+	return nil
+}
+
+// conflictingVotes returns true for two different votes with the same target
+// height or if one vote surrounds the other
+func conflictingVotes(a, b *protobufs.CasperVote) bool {
+	if a.GetTargetHeight() == b.GetTargetHeight() {
+		return !bytes.Equal(VoteHash(a), VoteHash(b))
+	}
+
+	surrounds := func(out, in *protobufs.CasperVote) bool {
+		return out.GetSourceHeight() < in.GetSourceHeight() && in.GetTargetHeight() < out.GetTargetHeight()
+	}
+	return surrounds(a, b) || surrounds(b, a)
+}
+
+// SlashingTransaction wraps the evidence in a transaction to include it in a
+// block
+func (e *Evidence) SlashingTransaction() (*protobufs.Transaction, error) {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	return &protobufs.Transaction{
+		Recipient: SlashAddress,
+		Data:      data,
+	}, nil
+}
+
+// SlashingDetector remembers the proposals and votes seen on the network and
+// finds validators that signed two conflicting messages
+type SlashingDetector struct {
+	mu sync.Mutex
+
+	// index -> miner and shard -> proposal
+	proposals map[uint64]map[string]SignedBlock
+
+	votes map[string][]*protobufs.CasperVote
+
+	// Evidence that still has to be included in a block, by offender
+	pending map[string]*Evidence
+}
+
+// NewSlashingDetector creates an empty SlashingDetector
+func NewSlashingDetector() *SlashingDetector {
+	return &SlashingDetector{
+		proposals: make(map[uint64]map[string]SignedBlock),
+		votes:     make(map[string][]*protobufs.CasperVote),
+		pending:   make(map[string]*Evidence),
+	}
+}
+
+// ObserveProposal records a proposal with a valid signature and returns the
+// evidence if the miner already proposed another block for the same slot
+func (d *SlashingDetector) ObserveProposal(block *protobufs.Block, pubKey, r, s []byte) *Evidence {
+	blockBytes, err := proto.Marshal(block)
+	if err != nil {
+		return nil
+	}
+	signed := SignedBlock{blockBytes, r, s}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Forget the old slots
+	for index := range d.proposals {
+		if index+proposalsWindow < block.GetIndex() {
+			delete(d.proposals, index)
+		}
+	}
+
+	index := block.GetIndex()
+	if _, ok := d.proposals[index]; !ok {
+		d.proposals[index] = make(map[string]SignedBlock)
+	}
+
+	key := fmt.Sprintf("%s/%d", block.GetMiner(), block.GetShard())
+	old, ok := d.proposals[index][key]
+	if !ok {
+		d.proposals[index][key] = signed
+		return nil
+	}
+	if bytes.Equal(old.Block, blockBytes) {
+		return nil
+	}
+
+	evidence := &Evidence{
+		Offender:  block.GetMiner(),
+		PublicKey: pubKey,
+		Blocks:    []SignedBlock{old, signed},
+	}
+	return d.addEvidence(evidence)
+}
+
+// ObserveVote records a Casper vote and returns the evidence if it conflicts
+// with another vote of the same validator
+func (d *SlashingDetector) ObserveVote(vote *protobufs.CasperVote, pubKey []byte) *Evidence {
+	if !wallet.AddressMatches(pubKey, vote.GetPublicKey()) {
+		return nil
+	}
+	valid, err := wallet.SignatureValid(pubKey, vote.GetR(), vote.GetS(), VoteHash(vote))
+	if !valid || err != nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	offender := vote.GetPublicKey()
+	for _, old := range d.votes[offender] {
+		if conflictingVotes(old, vote) {
+			evidence := &Evidence{
+				Offender:  offender,
+				PublicKey: pubKey,
+				Votes:     []*protobufs.CasperVote{old, vote},
+			}
+			return d.addEvidence(evidence)
+		}
+	}
+
+	d.votes[offender] = append(d.votes[offender], vote)
+	if len(d.votes[offender]) > votesWindow {
+		d.votes[offender] = d.votes[offender][1:]
+	}
+	return nil
+}
+
+// AddEvidence saves evidence received from the network so that it's
+// included in the next block this node generates
+func (d *SlashingDetector) AddEvidence(e *Evidence) *Evidence {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.addEvidence(e)
+}
+
+// addEvidence returns nil if there already was evidence against the same
+// validator, otherwise the new evidence
+func (d *SlashingDetector) addEvidence(e *Evidence) *Evidence {
+	err := e.Verify()
+	if err != nil {
+		log.Error("Invalid evidence ", err)
+		return nil
+	}
+
+	if _, ok := d.pending[e.Offender]; ok {
+		return nil
+	}
+
+	log.Warning("Found evidence against ", e.Offender)
+	d.pending[e.Offender] = e
+	return e
+}
+
+// PendingEvidence returns the evidence that hasn't been included in a block
+func (d *SlashingDetector) PendingEvidence() []*Evidence {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var res []*Evidence
+	for _, e := range d.pending {
+		res = append(res, e)
+	}
+	return res
+}
+
+// restoreEvidence puts back in the pending list the evidence of the slashing
+// transactions of a block that was reverted
+func (d *SlashingDetector) restoreEvidence(block *protobufs.Block) {
+	for _, t := range block.GetTransactions() {
+		if t.GetRecipient() != SlashAddress {
+			continue
+		}
+
+		evidence := &Evidence{}
+		err := json.Unmarshal(t.GetData(), evidence)
+		if err != nil {
+			continue
+		}
+		d.AddEvidence(evidence)
+	}
+}
+
+// RemoveEvidence forgets the pending evidence against a validator, it's
+// called once the validator has been slashed
+func (d *SlashingDetector) RemoveEvidence(offender string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.pending, offender)
+}
+
+// stageSlashing checks the evidence in a slashing transaction and burns the
+// stake of the offender. The stake was moved to DexmPoS when the validator
+// registered, so that's where it gets removed from.
+func (sb *StateBatch) stageSlashing(t *protobufs.Transaction, validators *ValidatorsBook, index uint64) (string, error) {
+	evidence := &Evidence{}
+	err := json.Unmarshal(t.GetData(), evidence)
+	if err != nil {
+		return "", err
+	}
+
+	err = evidence.Verify()
+	if err != nil {
+		return "", err
+	}
+
+	val, ok := validators.valsArray[evidence.Offender]
+	if !ok {
+		return "", errors.New("The offender isn't a validator")
+	}
+
+	recordKey := []byte(slashRecordPrefix + evidence.Offender)
+	if _, err := sb.get(sb.bc.balancesDb, recordKey); err == nil {
+		return "", errors.New("The offender was already slashed")
+	}
+
+	pos, err := sb.GetWalletState("DexmPoS")
+	if err == nil {
+		burn := val.stake
+		if burn > pos.GetBalance() {
+			burn = pos.GetBalance()
+		}
+		pos.Balance -= burn
+
+		err = sb.SetState("DexmPoS", &pos)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	record, err := json.Marshal(slashRecord{
+		Index:      index,
+		Stake:      val.stake,
+		EndDynasty: val.endDynasty,
+	})
+	if err != nil {
+		return "", err
+	}
+	sb.put(sb.bc.balancesDb, recordKey, record)
+
+	return evidence.Offender, nil
+}
+
+func (bc *Blockchain) getSlashRecord(offender string) (*slashRecord, error) {
+	raw, err := bc.balancesDb.Get([]byte(slashRecordPrefix+offender), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &slashRecord{}
+	err = json.Unmarshal(raw, record)
+	return record, err
+}
+
+// GetSlashRecord returns the index at which a validator was slashed and the
+// stake it lost
+func (bc *Blockchain) GetSlashRecord(offender string) (index, stake uint64, err error) {
+	record, err := bc.getSlashRecord(offender)
+	if err != nil {
+		return 0, 0, err
+	}
+	return record.Index, record.Stake, nil
+}
+
+// slashTransactionOffender returns the offender of a slashing transaction
+func slashTransactionOffender(t *protobufs.Transaction) (string, error) {
+	evidence := &Evidence{}
+	err := json.Unmarshal(t.GetData(), evidence)
+	return evidence.Offender, err
+}
@@ -0,0 +1,520 @@
+package blockchain
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// A snapshot is the state of the chain at the last checkpoint, a new node
+// starts from it and only syncs the blocks after. It's saved as gzipped JSON.
+const snapshotVersion = 1
+
+// snapshotValidatorsKey is where a node started from a snapshot keeps its
+// validators, the book is otherwise only in memory
+var snapshotValidatorsKey = []byte("snapshotvalidators")
+
+// SnapshotEntry is a key of one of the state databases
+type SnapshotEntry struct {
+	Db    string
+	Key   []byte
+	Value []byte
+}
+
+// Snapshot is the state after Block, which is the checkpoint of the node
+// that exported it. The trie isn't included, it's built again from State and
+// has to match StateRoot. StateRoot is bound to Block by the receipts root of
+// the last block with transactions: Ancestors are the empty blocks between
+// the two, newest first, and Receipts are the receipts of that block.
+type Snapshot struct {
+	Version int
+
+	Genesis   []byte
+	Block     []byte
+	StateRoot []byte
+
+	Ancestors [][]byte
+	Receipts  []*Receipt
+
+	Validators []*SnapshotValidator
+	State      []*SnapshotEntry
+}
+
+// ValidatorsHash is the hash of the validators of the snapshot. They aren't
+// part of the state, so whoever imports it has to trust this value too.
+func (snap *Snapshot) ValidatorsHash() ([]byte, error) {
+	raw, err := json.Marshal(snap.Validators)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(raw)
+	return hash[:], nil
+}
+
+// snapshotReader reads a consistent view of the databases while the node
+// keeps committing blocks, with the changes of the reverted blocks on top
+type snapshotReader struct {
+	snaps   map[string]*leveldb.Snapshot
+	blocks  *leveldb.Snapshot
+	overlay map[string]map[string]journalEntry
+}
+
+func (r *snapshotReader) get(name string, key []byte) ([]byte, error) {
+	if e, ok := r.overlay[name][string(key)]; ok {
+		if e.Missing {
+			return nil, leveldb.ErrNotFound
+		}
+		return e.Value, nil
+	}
+	return r.snaps[name].Get(key, nil)
+}
+
+func (r *snapshotReader) release() {
+	for _, s := range r.snaps {
+		s.Release()
+	}
+	if r.blocks != nil {
+		r.blocks.Release()
+	}
+}
+
+// revert puts the journal of a block on top of what is read
+func (r *snapshotReader) revert(journal *blockJournal) {
+	for _, e := range journal.Entries {
+		if _, ok := r.overlay[e.Db]; !ok {
+			r.overlay[e.Db] = make(map[string]journalEntry)
+		}
+		r.overlay[e.Db][string(e.Key)] = e
+	}
+}
+
+// state returns every key of the state databases, without the trie
+func (r *snapshotReader) state() ([]*SnapshotEntry, error) {
+	var names []string
+	for name := range r.snaps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var res []*SnapshotEntry
+	for _, name := range names {
+		iter := r.snaps[name].NewIterator(nil, nil)
+		for iter.Next() {
+			key := append([]byte{}, iter.Key()...)
+			if _, ok := r.overlay[name][string(key)]; ok {
+				continue
+			}
+			res = append(res, &SnapshotEntry{name, key, append([]byte{}, iter.Value()...)})
+		}
+		iter.Release()
+		if err := iter.Error(); err != nil {
+			return nil, err
+		}
+
+		for key, e := range r.overlay[name] {
+			if !e.Missing {
+				res = append(res, &SnapshotEntry{name, []byte(key), e.Value})
+			}
+		}
+	}
+
+	// The trie is built again from the rest
+	var state []*SnapshotEntry
+	for _, e := range res {
+		if e.Db == "memory" && strings.HasPrefix(string(e.Key), "t/") {
+			continue
+		}
+		state = append(state, e)
+	}
+	return state, nil
+}
+
+// ExportSnapshot writes a snapshot of the chain at its last checkpoint to w.
+// The blocks after the checkpoint are reverted on a copy of the state, so
+// the node can keep running in the meantime.
+func (bc *Blockchain) ExportSnapshot(w io.Writer, validators *ValidatorsBook) error {
+	bc.writeMu.Lock()
+	vals, err := validators.snapshot()
+	r := &snapshotReader{
+		snaps:   make(map[string]*leveldb.Snapshot),
+		overlay: make(map[string]map[string]journalEntry),
+	}
+	for name, db := range bc.stateDbs() {
+		s, serr := db.GetSnapshot()
+		if serr != nil {
+			err = serr
+			continue
+		}
+		r.snaps[name] = s
+	}
+	if err == nil {
+		r.blocks, err = bc.blockDb.GetSnapshot()
+	}
+	bc.writeMu.Unlock()
+
+	defer r.release()
+	if err != nil {
+		return err
+	}
+
+	// The head in memory is only updated after a block released writeMu, so
+	// it's read from the same view as the state
+	rawMeta, err := r.blocks.Get(metaKey, nil)
+	if err == leveldb.ErrNotFound {
+		return errors.New("The chain has no genesis")
+	}
+	if err != nil {
+		return err
+	}
+	meta := chainMeta{}
+	err = json.Unmarshal(rawMeta, &meta)
+	if err != nil {
+		return err
+	}
+	if meta.GenesisHash == nil {
+		return errors.New("The chain has no genesis")
+	}
+
+	book := NewValidatorsBook()
+	err = book.restoreSnapshot(vals)
+	if err != nil {
+		return err
+	}
+
+	getRecord := func(offender string) (*slashRecord, error) {
+		raw, err := r.get("balances", []byte(slashRecordPrefix+offender))
+		if err != nil {
+			return nil, err
+		}
+		record := &slashRecord{}
+		err = json.Unmarshal(raw, record)
+		return record, err
+	}
+
+	// Walk back from the head to the checkpoint
+	hash := meta.HeadHash
+	for !bytes.Equal(hash, meta.CheckpointHash) {
+		rawInfo, err := r.blocks.Get(infoKey(hash), nil)
+		if err != nil {
+			return err
+		}
+		info := &blockInfo{}
+		err = json.Unmarshal(rawInfo, info)
+		if err != nil {
+			return err
+		}
+		if info.Index <= meta.Checkpoint {
+			return errors.New("The head doesn't descend from the checkpoint")
+		}
+
+		raw, err := r.blocks.Get(blockKey(hash), nil)
+		if err != nil {
+			return err
+		}
+		block := &protobufs.Block{}
+		err = proto.Unmarshal(raw, block)
+		if err != nil {
+			return err
+		}
+
+		offenders, slashed, err := slashedInBlock(block, getRecord)
+		if err != nil {
+			return err
+		}
+
+		rawJournal, err := r.blocks.Get(undoKey(hash), nil)
+		if err != nil {
+			return err
+		}
+		journal := &blockJournal{}
+		err = json.Unmarshal(rawJournal, journal)
+		if err != nil {
+			return err
+		}
+
+		r.revert(journal)
+		revertValidators(book, block, offenders, slashed)
+		hash = info.Parent
+	}
+
+	snap := &Snapshot{Version: snapshotVersion}
+	snap.StateRoot, err = r.blocks.Get(stateRootKey(meta.CheckpointHash), nil)
+	if err != nil {
+		return err
+	}
+	snap.Block, err = r.blocks.Get(blockKey(meta.CheckpointHash), nil)
+	if err != nil {
+		return err
+	}
+	snap.Genesis, err = r.blocks.Get(blockKey(meta.GenesisHash), nil)
+	if err != nil {
+		return err
+	}
+	snap.Ancestors, snap.Receipts, err = stateProof(r.blocks, snap.Block)
+	if err != nil {
+		return err
+	}
+	snap.Validators, err = book.snapshot()
+	if err != nil {
+		return err
+	}
+	snap.State, err = r.state()
+	if err != nil {
+		return err
+	}
+
+	log.Info("Exporting snapshot at block ", meta.Checkpoint, " with ", len(snap.State), " keys")
+
+	gz := gzip.NewWriter(w)
+	err = json.NewEncoder(gz).Encode(snap)
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// stateProof walks back from block to the last block with transactions,
+// whose receipts root commits to the state of block
+func stateProof(blocks *leveldb.Snapshot, raw []byte) ([][]byte, []*Receipt, error) {
+	var ancestors [][]byte
+	for {
+		block := &protobufs.Block{}
+		err := proto.Unmarshal(raw, block)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if len(block.GetTransactions()) != 0 {
+			var receipts []*Receipt
+			for _, t := range block.GetTransactions() {
+				hash, err := wallet.TransactionHash(t)
+				if err != nil {
+					return nil, nil, err
+				}
+				rawReceipt, err := blocks.Get(receiptKey(hash), nil)
+				if err != nil {
+					return nil, nil, err
+				}
+				r := &Receipt{}
+				err = json.Unmarshal(rawReceipt, r)
+				if err != nil {
+					return nil, nil, err
+				}
+				receipts = append(receipts, r)
+			}
+			return ancestors, receipts, nil
+		}
+
+		if block.GetIndex() == 0 {
+			return nil, nil, errors.New("No block commits to the state of the checkpoint")
+		}
+		raw, err = blocks.Get(blockKey(block.GetPrevHash()), nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		ancestors = append(ancestors, raw)
+	}
+}
+
+// ReadSnapshot decodes a snapshot written by ExportSnapshot
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	snap := &Snapshot{}
+	err = json.NewDecoder(gz).Decode(snap)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Version != snapshotVersion {
+		return nil, errors.New("Unknown snapshot version")
+	}
+	return snap, nil
+}
+
+// verifySnapshot checks that the snapshot is at the trusted checkpoint and
+// that its state root is the one the chain committed to. Empty blocks don't
+// commit to a state root, so the state is authenticated by the last block
+// with transactions at or before the checkpoint, the empty blocks after it
+// are sent as Ancestors and only checked to be linked and empty. A snapshot
+// whose chain has no block with transactions before the checkpoint can't be
+// verified.
+func verifySnapshot(snap *Snapshot, checkpoint, validatorsHash []byte) error {
+	hash := sha256.Sum256(snap.Block)
+	if !bytes.Equal(hash[:], checkpoint) {
+		return errors.New("The snapshot isn't at the trusted checkpoint")
+	}
+
+	vh, err := snap.ValidatorsHash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(vh, validatorsHash) {
+		return errors.New("The validators of the snapshot aren't the trusted ones")
+	}
+
+	block := &protobufs.Block{}
+	err = proto.Unmarshal(snap.Block, block)
+	if err != nil {
+		return err
+	}
+	for _, raw := range snap.Ancestors {
+		// Blocks without transactions don't change the state
+		if len(block.GetTransactions()) != 0 {
+			return errors.New("Invalid ancestors in snapshot")
+		}
+		hash := sha256.Sum256(raw)
+		if !bytes.Equal(hash[:], block.GetPrevHash()) {
+			return errors.New("The ancestors of the snapshot aren't linked")
+		}
+
+		block = &protobufs.Block{}
+		err = proto.Unmarshal(raw, block)
+		if err != nil {
+			return err
+		}
+	}
+	if len(block.GetTransactions()) == 0 || len(block.GetTransactions()) != len(snap.Receipts) {
+		return errors.New("No block of the snapshot commits to its state")
+	}
+
+	root, err := ReceiptsRoot(snap.Receipts, snap.StateRoot)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(root, block.GetMerkleRootReceipt()) {
+		return errors.New("The state root isn't the one of the checkpoint")
+	}
+	return nil
+}
+
+// ImportSnapshot starts an empty chain from a snapshot. checkpoint and
+// validatorsHash come from a node that is trusted, the state is checked
+// against the state root the checkpoint commits to. The block of the
+// snapshot becomes both the head and the checkpoint and the blocks before it
+// aren't needed.
+func (bc *Blockchain) ImportSnapshot(snap *Snapshot, checkpoint, validatorsHash []byte, validators *ValidatorsBook) error {
+	if bc.HasGenesis() {
+		return errors.New("The chain isn't empty")
+	}
+
+	err := verifySnapshot(snap, checkpoint, validatorsHash)
+	if err != nil {
+		return err
+	}
+
+	genesis := &protobufs.Block{}
+	block := &protobufs.Block{}
+	if proto.Unmarshal(snap.Genesis, genesis) != nil || proto.Unmarshal(snap.Block, block) != nil {
+		return errors.New("Invalid block in snapshot")
+	}
+	if genesis.GetIndex() != 0 {
+		return errors.New("Invalid genesis in snapshot")
+	}
+
+	sb := bc.NewStateBatch()
+	dbs := bc.stateDbs()
+	for _, e := range snap.State {
+		db, ok := dbs[e.Db]
+		if !ok || (e.Db == "memory" && strings.HasPrefix(string(e.Key), "t/")) {
+			return errors.New("Invalid key in snapshot")
+		}
+		sb.put(db, e.Key, e.Value)
+	}
+
+	root, err := sb.StateRoot(nil)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(root, snap.StateRoot) {
+		return errors.New("The state doesn't match the state root of the snapshot")
+	}
+
+	genesisHash := sha256.Sum256(snap.Genesis)
+	hash := sha256.Sum256(snap.Block)
+	info := &blockInfo{
+		Hash:   hash[:],
+		Parent: block.GetPrevHash(),
+		Index:  block.GetIndex(),
+		Length: block.GetIndex(),
+	}
+
+	meta := chainMeta{
+		HeadIndex:        info.Index,
+		HeadHash:         info.Hash,
+		Checkpoint:       info.Index,
+		CheckpointHash:   info.Hash,
+		GenesisTimestamp: genesis.GetTimestamp(),
+		GenesisHash:      genesisHash[:],
+	}
+	rawMeta, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	rawValidators, err := json.Marshal(snap.Validators)
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	if info.Index != 0 {
+		// The genesis is kept for the nodes that read it on startup, but
+		// it isn't a possible head
+		bc.storeBlock(batch, &blockInfo{Hash: genesisHash[:]}, snap.Genesis)
+		batch.Delete(leafKey(genesisHash[:]))
+		batch.Put(canonicalKey(0), genesisHash[:])
+
+		// Nothing before the snapshot is there
+		pruned := make([]byte, 8)
+		binary.BigEndian.PutUint64(pruned, info.Index)
+		batch.Put(prunedKey, pruned)
+	}
+	bc.storeBlock(batch, info, snap.Block)
+	batch.Put(canonicalKey(info.Index), info.Hash)
+	batch.Put(stateRootKey(info.Hash), root)
+	batch.Put(snapshotValidatorsKey, rawValidators)
+	batch.Put(metaKey, rawMeta)
+
+	err = bc.writeState(sb, batch, nil)
+	if err != nil {
+		return err
+	}
+	bc.setMeta(meta)
+	bc.CurrentBlock = info.Index + 1
+
+	return validators.restoreSnapshot(snap.Validators)
+}
+
+// LoadSnapshotValidators adds to the book the validators of the snapshot the
+// chain was started from, if any
+func (bc *Blockchain) LoadSnapshotValidators(validators *ValidatorsBook) error {
+	raw, err := bc.blockDb.Get(snapshotValidatorsKey, nil)
+	if err == leveldb.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var vals []*SnapshotValidator
+	err = json.Unmarshal(raw, &vals)
+	if err != nil {
+		return err
+	}
+	return validators.restoreSnapshot(vals)
+}
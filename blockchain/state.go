@@ -0,0 +1,225 @@
+package blockchain
+
+import (
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// stagedValue is a value written inside a StateBatch, deleted is used to
+// hide a key that is still present in the database
+type stagedValue struct {
+	value   []byte
+	deleted bool
+}
+
+// stagedChange is what a key was staged to before a put or delete, it's
+// used to go back to a snapshot
+type stagedChange struct {
+	db      *leveldb.DB
+	key     string
+	prev    stagedValue
+	existed bool
+}
+
+// StateBatch stages the changes made to the state while processing a block.
+// Reads go through the staged values first so a transaction sees the changes
+// of the previous ones, but nothing is written to the databases till Commit
+// is called. If the block turns out to be invalid the batch is just dropped.
+type StateBatch struct {
+	bc      *Blockchain
+	staged  map[*leveldb.DB]map[string]stagedValue
+	changes []stagedChange
+
+	// snaps are read instead of the databases when set, see snapshotBatch
+	snaps map[*leveldb.DB]*leveldb.Snapshot
+}
+
+// NewStateBatch creates an empty StateBatch on top of the current state
+func (bc *Blockchain) NewStateBatch() *StateBatch {
+	return &StateBatch{
+		bc:     bc,
+		staged: make(map[*leveldb.DB]map[string]stagedValue),
+	}
+}
+
+// get returns the staged value of key if there is one, otherwise it reads it
+// from the database
+func (sb *StateBatch) get(db *leveldb.DB, key []byte) ([]byte, error) {
+	if v, ok := sb.staged[db][string(key)]; ok {
+		if v.deleted {
+			return nil, leveldb.ErrNotFound
+		}
+		return v.value, nil
+	}
+
+	if s, ok := sb.snaps[db]; ok {
+		return s.Get(key, nil)
+	}
+	return db.Get(key, nil)
+}
+
+func (sb *StateBatch) stage(db *leveldb.DB, key []byte, v stagedValue) {
+	if _, ok := sb.staged[db]; !ok {
+		sb.staged[db] = make(map[string]stagedValue)
+	}
+
+	prev, existed := sb.staged[db][string(key)]
+	sb.changes = append(sb.changes, stagedChange{db, string(key), prev, existed})
+	sb.staged[db][string(key)] = v
+}
+
+func (sb *StateBatch) put(db *leveldb.DB, key, value []byte) {
+	sb.stage(db, key, stagedValue{value: value})
+}
+
+func (sb *StateBatch) delete(db *leveldb.DB, key []byte) {
+	sb.stage(db, key, stagedValue{deleted: true})
+}
+
+// Snapshot returns an identifier of the current staged state to be used with
+// RevertToSnapshot
+func (sb *StateBatch) Snapshot() int {
+	return len(sb.changes)
+}
+
+// RevertToSnapshot drops everything staged after the snapshot was taken
+func (sb *StateBatch) RevertToSnapshot(id int) {
+	for i := len(sb.changes) - 1; i >= id; i-- {
+		c := sb.changes[i]
+		if c.existed {
+			sb.staged[c.db][c.key] = c.prev
+		} else {
+			delete(sb.staged[c.db], c.key)
+		}
+	}
+	sb.changes = sb.changes[:id]
+}
+
+// GetWalletState returns the state of a wallet including the staged changes
+func (sb *StateBatch) GetWalletState(wallet string) (protobufs.AccountState, error) {
+	state := protobufs.AccountState{}
+	raw, err := sb.get(sb.bc.balancesDb, []byte(wallet))
+	if err != nil {
+		return state, err
+	}
+
+	err = proto.Unmarshal(raw, &state)
+	return state, err
+}
+
+// SetState stages the new state of a wallet
+func (sb *StateBatch) SetState(wallet string, newState *protobufs.AccountState) error {
+	stateBytes, err := proto.Marshal(newState)
+	if err != nil {
+		return err
+	}
+
+	sb.put(sb.bc.balancesDb, []byte(wallet), stateBytes)
+	return nil
+}
+
+// GetContractCode returns the code of a contract including the staged ones
+func (sb *StateBatch) GetContractCode(address []byte) ([]byte, error) {
+	return sb.get(sb.bc.ContractDb, address)
+}
+
+// SetContractCode stages the code of a new contract
+func (sb *StateBatch) SetContractCode(address, code []byte) {
+	sb.put(sb.bc.ContractDb, address, code)
+}
+
+// GetContractState returns the memory and globals of a contract
+func (sb *StateBatch) GetContractState(address []byte) (*protobufs.ContractState, error) {
+	raw, err := sb.get(sb.bc.StateDb, address)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &protobufs.ContractState{}
+	err = proto.Unmarshal(raw, state)
+	return state, err
+}
+
+// SetContractState stages the memory and globals of a contract
+func (sb *StateBatch) SetContractState(address []byte, state *protobufs.ContractState) error {
+	raw, err := proto.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	sb.put(sb.bc.StateDb, address, raw)
+	return nil
+}
+
+// storageKey is where a key of the storage of a contract is saved in StateDb,
+// addresses never contain a / so every contract has its own namespace
+func storageKey(address, key []byte) []byte {
+	res := append([]byte("s/"), address...)
+	res = append(res, '/')
+	return append(res, key...)
+}
+
+// GetStorage returns the value saved by a contract under key
+func (sb *StateBatch) GetStorage(address, key []byte) ([]byte, error) {
+	return sb.get(sb.bc.StateDb, storageKey(address, key))
+}
+
+// SetStorage stages a value in the storage of a contract, an empty value
+// deletes the key
+func (sb *StateBatch) SetStorage(address, key, value []byte) {
+	if len(value) == 0 {
+		sb.delete(sb.bc.StateDb, storageKey(address, key))
+		return
+	}
+	sb.put(sb.bc.StateDb, storageKey(address, key), value)
+}
+
+// Commit writes all the staged changes, with one leveldb.Batch for every
+// database. The databases are written one after the other, so if the node
+// stops in between only some of them have the new state: writeState saves a
+// journal before calling Commit so repair can put the old state back.
+func (sb *StateBatch) Commit() error {
+	for db, values := range sb.staged {
+		batch := new(leveldb.Batch)
+		for k, v := range values {
+			if v.deleted {
+				batch.Delete([]byte(k))
+			} else {
+				batch.Put([]byte(k), v.value)
+			}
+		}
+
+		err := db.Write(batch, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	sb.staged = make(map[*leveldb.DB]map[string]stagedValue)
+	sb.changes = nil
+	return nil
+}
+
+// journal reads the value every staged key has in the database right now,
+// it's used to undo the batch if the node stops while committing it
+func (sb *StateBatch) journal() (*blockJournal, error) {
+	journal := &blockJournal{}
+
+	for name, db := range sb.bc.stateDbs() {
+		for k := range sb.staged[db] {
+			old, err := db.Get([]byte(k), nil)
+			if err == leveldb.ErrNotFound {
+				journal.Entries = append(journal.Entries, journalEntry{Db: name, Key: []byte(k), Missing: true})
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			journal.Entries = append(journal.Entries, journalEntry{Db: name, Key: []byte(k), Value: old})
+		}
+	}
+
+	return journal, nil
+}
@@ -0,0 +1,218 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// Transactions of the canonical chain are indexed in blockDb under:
+//
+//	x + hash                      TransactionLocation of the transaction
+//	w + address + 0 + position    AddressTransaction of a wallet
+//
+// position is the block index and the index of the transaction in the block,
+// so the history of a wallet is sorted by block.
+
+// TransactionLocation is where a transaction of the canonical chain is
+type TransactionLocation struct {
+	BlockHash  []byte
+	BlockIndex uint64
+	Position   int
+}
+
+// TransactionStatus is what a wallet needs to know about a transaction once
+// it's in a block
+type TransactionStatus struct {
+	TransactionLocation
+	Receipt *Receipt
+}
+
+// AddressTransaction is a transaction in the history of a wallet. Sent is
+// true if the wallet sent it, Received if it got funds or code from it, a
+// payment made by a contract counts as well.
+type AddressTransaction struct {
+	TransactionHash []byte
+	BlockIndex      uint64
+	Position        int
+
+	Sent     bool `json:",omitempty"`
+	Received bool `json:",omitempty"`
+}
+
+func transactionKey(hash []byte) []byte {
+	return append([]byte("x"), hash...)
+}
+
+func addressTransactionPrefix(address string) []byte {
+	prefix := append([]byte("w"), address...)
+	return append(prefix, 0)
+}
+
+func transactionPosition(blockIndex uint64, tx int) []byte {
+	pos := make([]byte, 12)
+	binary.BigEndian.PutUint64(pos, blockIndex)
+	binary.BigEndian.PutUint32(pos[8:], uint32(tx))
+	return pos
+}
+
+// addressTransactions returns the entries of the history of every wallet
+// taking part in the transaction of r
+func addressTransactions(r *Receipt, position int) map[string]*AddressTransaction {
+	entries := make(map[string]*AddressTransaction)
+	entry := func(address string) *AddressTransaction {
+		if _, ok := entries[address]; !ok {
+			entries[address] = &AddressTransaction{
+				TransactionHash: r.TransactionHash,
+				BlockIndex:      r.BlockIndex,
+				Position:        position,
+			}
+		}
+		return entries[address]
+	}
+
+	if r.Sender != "" {
+		entry(r.Sender).Sent = true
+	}
+	if r.Recipient != "" && r.Recipient != SlashAddress {
+		entry(r.Recipient).Received = true
+	}
+	if r.ContractAddress != "" {
+		entry(r.ContractAddress).Received = true
+	}
+	for _, t := range r.Transfers {
+		entry(t.From).Sent = true
+		entry(t.To).Received = true
+	}
+	return entries
+}
+
+// indexTransactions adds the location of the transactions of a block and the
+// history of the wallets in them to batch
+func indexTransactions(batch *leveldb.Batch, blockHash []byte, block *protobufs.Block, receipts []*Receipt) error {
+	if len(receipts) != len(block.GetTransactions()) {
+		return errors.New("Every transaction needs a receipt")
+	}
+
+	for i, r := range receipts {
+		raw, err := json.Marshal(&TransactionLocation{
+			BlockHash:  blockHash,
+			BlockIndex: block.GetIndex(),
+			Position:   i,
+		})
+		if err != nil {
+			return err
+		}
+		batch.Put(transactionKey(r.TransactionHash), raw)
+
+		pos := transactionPosition(block.GetIndex(), i)
+		for address, entry := range addressTransactions(r, i) {
+			raw, err := json.Marshal(entry)
+			if err != nil {
+				return err
+			}
+			batch.Put(append(addressTransactionPrefix(address), pos...), raw)
+		}
+	}
+	return nil
+}
+
+// unindexTransactions removes what indexTransactions added for the receipts
+// of a block from batch
+func unindexTransactions(batch *leveldb.Batch, receipts []*Receipt) {
+	for i, r := range receipts {
+		batch.Delete(transactionKey(r.TransactionHash))
+
+		pos := transactionPosition(r.BlockIndex, i)
+		for address := range addressTransactions(r, i) {
+			batch.Delete(append(addressTransactionPrefix(address), pos...))
+		}
+	}
+}
+
+// GetTransactionLocation returns where a transaction is in the canonical chain
+func (bc *Blockchain) GetTransactionLocation(hash []byte) (*TransactionLocation, error) {
+	raw, err := bc.blockDb.Get(transactionKey(hash), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	loc := &TransactionLocation{}
+	err = json.Unmarshal(raw, loc)
+	return loc, err
+}
+
+// GetTransactionStatus returns where a transaction is in the canonical chain
+// and its receipt, if the transaction isn't in a block it returns
+// leveldb.ErrNotFound
+func (bc *Blockchain) GetTransactionStatus(hash []byte) (*TransactionStatus, error) {
+	loc, err := bc.GetTransactionLocation(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := bc.GetReceipt(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &TransactionStatus{*loc, r}, nil
+}
+
+// GetTransaction returns a transaction of the canonical chain and where it is
+func (bc *Blockchain) GetTransaction(hash []byte) (*protobufs.Transaction, *TransactionLocation, error) {
+	loc, err := bc.GetTransactionLocation(hash)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	raw, err := bc.GetBlockByHash(loc.BlockHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	block := &protobufs.Block{}
+	err = proto.Unmarshal(raw, block)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if loc.Position >= len(block.GetTransactions()) {
+		return nil, nil, errors.New("Invalid transaction location")
+	}
+	return block.GetTransactions()[loc.Position], loc, nil
+}
+
+// GetAddressHistory returns at most limit transactions sent or received by a
+// wallet between fromBlock and toBlock (both included), sorted by block
+func (bc *Blockchain) GetAddressHistory(address string, fromBlock, toBlock uint64, limit int) ([]*AddressTransaction, error) {
+	prefix := addressTransactionPrefix(address)
+	iter := bc.blockDb.NewIterator(&util.Range{
+		Start: append(prefix, transactionPosition(fromBlock, 0)...),
+		Limit: util.BytesPrefix(prefix).Limit,
+	}, nil)
+	defer iter.Release()
+
+	var res []*AddressTransaction
+	for len(res) < limit && iter.Next() {
+		key := iter.Key()
+		if len(key) != len(prefix)+12 {
+			continue
+		}
+		if binary.BigEndian.Uint64(key[len(prefix):]) > toBlock {
+			break
+		}
+
+		entry := &AddressTransaction{}
+		err := json.Unmarshal(iter.Value(), entry)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entry)
+	}
+
+	return res, iter.Error()
+}
@@ -0,0 +1,361 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+// The state is authenticated by a sparse merkle trie. Every key of the state
+// databases is a leaf at the path given by stateKey, so there are 2^256
+// possible leaves, but a subtree with a single leaf is stored as that leaf and
+// the empty subtrees are all hashed as 32 zero bytes. That keeps the trie as
+// deep as needed to tell the keys apart. Nodes are saved in StateDb under
+// their hash and never changed, so the trie at every old root can still be
+// read.
+//
+//	leaf:   0 + key + value       hash is sha256(0 + key + sha256(value))
+//	branch: 1 + left + right      hash is sha256(1 + left + right)
+const (
+	trieLeaf   = 0
+	trieBranch = 1
+)
+
+var emptyRoot = make([]byte, sha256.Size)
+
+// trieNodeKey is where a node of the trie is saved in StateDb
+func trieNodeKey(hash []byte) []byte {
+	return append([]byte("t/"), hash...)
+}
+
+// stateKey is the path of a key of the state databases in the trie, the tag
+// tells the databases apart
+func stateKey(tag byte, key []byte) []byte {
+	hash := sha256.Sum256(append([]byte{tag}, key...))
+	return hash[:]
+}
+
+// AccountKey is the path of the state of a wallet in the trie
+func AccountKey(address string) []byte {
+	return stateKey('a', []byte(address))
+}
+
+// StorageKey is the path of a key of the storage of a contract in the trie
+func StorageKey(address string, key []byte) []byte {
+	return stateKey('c', storageKey([]byte(address), key))
+}
+
+func leafHash(key, valueHash []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{trieLeaf})
+	h.Write(key)
+	h.Write(valueHash)
+	return h.Sum(nil)
+}
+
+func branchHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{trieBranch})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// bit returns the bit of key at depth, 0 goes left
+func bit(key []byte, depth int) byte {
+	return (key[depth/8] >> (7 - uint(depth%8))) & 1
+}
+
+// trie reads and writes the nodes through a StateBatch, so the nodes of a
+// block are committed with the rest of its state
+type trie struct {
+	sb *StateBatch
+}
+
+func (t *trie) node(hash []byte) ([]byte, error) {
+	raw, err := t.sb.get(t.sb.bc.StateDb, trieNodeKey(hash))
+	if err != nil || len(raw) == 0 {
+		return nil, errors.New("Missing trie node")
+	}
+	return raw, nil
+}
+
+func (t *trie) putLeaf(key, value []byte) []byte {
+	valueHash := sha256.Sum256(value)
+	hash := leafHash(key, valueHash[:])
+
+	raw := append([]byte{trieLeaf}, key...)
+	t.sb.put(t.sb.bc.StateDb, trieNodeKey(hash), append(raw, value...))
+	return hash
+}
+
+func (t *trie) putBranch(left, right []byte) []byte {
+	hash := branchHash(left, right)
+
+	raw := append([]byte{trieBranch}, left...)
+	t.sb.put(t.sb.bc.StateDb, trieNodeKey(hash), append(raw, right...))
+	return hash
+}
+
+// isLeaf returns the key of the node if it's a leaf
+func (t *trie) isLeaf(hash []byte) ([]byte, error) {
+	raw, err := t.node(hash)
+	if err != nil {
+		return nil, err
+	}
+	if raw[0] != trieLeaf {
+		return nil, nil
+	}
+	return raw[1 : 1+sha256.Size], nil
+}
+
+// update sets key to value in the subtree at depth with root hash and
+// returns the new root of the subtree, a nil value removes the key
+func (t *trie) update(hash []byte, depth int, key, value []byte) ([]byte, error) {
+	if bytes.Equal(hash, emptyRoot) {
+		if value == nil {
+			return emptyRoot, nil
+		}
+		return t.putLeaf(key, value), nil
+	}
+
+	raw, err := t.node(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if raw[0] == trieLeaf {
+		leafKey := raw[1 : 1+sha256.Size]
+		switch {
+		case bytes.Equal(leafKey, key) && value == nil:
+			return emptyRoot, nil
+		case bytes.Equal(leafKey, key):
+			return t.putLeaf(key, value), nil
+		case value == nil:
+			return hash, nil
+		}
+
+		return t.join(depth, hash, leafKey, t.putLeaf(key, value), key), nil
+	}
+
+	left := raw[1 : 1+sha256.Size]
+	right := raw[1+sha256.Size:]
+	if bit(key, depth) == 0 {
+		left, err = t.update(left, depth+1, key, value)
+	} else {
+		right, err = t.update(right, depth+1, key, value)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// A subtree left with a single leaf becomes that leaf
+	for _, pair := range [][2][]byte{{left, right}, {right, left}} {
+		if !bytes.Equal(pair[1], emptyRoot) {
+			continue
+		}
+		if bytes.Equal(pair[0], emptyRoot) {
+			return emptyRoot, nil
+		}
+
+		leafKey, err := t.isLeaf(pair[0])
+		if err != nil {
+			return nil, err
+		}
+		if leafKey != nil {
+			return pair[0], nil
+		}
+	}
+
+	return t.putBranch(left, right), nil
+}
+
+// join returns the subtree at depth with the two leaves a and b
+func (t *trie) join(depth int, a, aKey, b, bKey []byte) []byte {
+	aBit, bBit := bit(aKey, depth), bit(bKey, depth)
+	switch {
+	case aBit == bBit && aBit == 0:
+		return t.putBranch(t.join(depth+1, a, aKey, b, bKey), emptyRoot)
+	case aBit == bBit:
+		return t.putBranch(emptyRoot, t.join(depth+1, a, aKey, b, bKey))
+	case aBit == 0:
+		return t.putBranch(a, b)
+	}
+	return t.putBranch(b, a)
+}
+
+// StateProof proves the value of a key under a state root, or that the key
+// isn't there. Siblings are the hashes next to the path of the key, from the
+// root down. If the path ends in the leaf of another key that leaf is in
+// OtherKey and OtherValueHash.
+type StateProof struct {
+	Key      []byte
+	Value    []byte
+	Siblings [][]byte
+
+	OtherKey       []byte `json:",omitempty"`
+	OtherValueHash []byte `json:",omitempty"`
+}
+
+// prove walks the trie from root to the leaf of key
+func (t *trie) prove(root, key []byte) (*StateProof, error) {
+	proof := &StateProof{Key: key}
+
+	hash := root
+	for depth := 0; !bytes.Equal(hash, emptyRoot); depth++ {
+		raw, err := t.node(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		if raw[0] == trieLeaf {
+			leafKey := raw[1 : 1+sha256.Size]
+			value := raw[1+sha256.Size:]
+			if bytes.Equal(leafKey, key) {
+				proof.Value = value
+			} else {
+				valueHash := sha256.Sum256(value)
+				proof.OtherKey = leafKey
+				proof.OtherValueHash = valueHash[:]
+			}
+			break
+		}
+
+		left := raw[1 : 1+sha256.Size]
+		right := raw[1+sha256.Size:]
+		if bit(key, depth) == 0 {
+			proof.Siblings = append(proof.Siblings, right)
+			hash = left
+		} else {
+			proof.Siblings = append(proof.Siblings, left)
+			hash = right
+		}
+	}
+
+	return proof, nil
+}
+
+// Verify checks the proof against a state root
+func (p *StateProof) Verify(root []byte) bool {
+	if len(p.Key) != sha256.Size || len(p.Siblings) > sha256.Size*8 {
+		return false
+	}
+
+	hash := emptyRoot
+	switch {
+	case p.Value != nil:
+		valueHash := sha256.Sum256(p.Value)
+		hash = leafHash(p.Key, valueHash[:])
+	case p.OtherKey != nil:
+		if len(p.OtherKey) != sha256.Size || bytes.Equal(p.OtherKey, p.Key) {
+			return false
+		}
+		// The other leaf has to be on the path of the key
+		for i := range p.Siblings {
+			if bit(p.OtherKey, i) != bit(p.Key, i) {
+				return false
+			}
+		}
+		hash = leafHash(p.OtherKey, p.OtherValueHash)
+	}
+
+	for i := len(p.Siblings) - 1; i >= 0; i-- {
+		if bit(p.Key, i) == 0 {
+			hash = branchHash(hash, p.Siblings[i])
+		} else {
+			hash = branchHash(p.Siblings[i], hash)
+		}
+	}
+
+	return bytes.Equal(hash, root)
+}
+
+// stateChange is a key of the state changed in a StateBatch
+type stateChange struct {
+	key   []byte
+	value []byte
+}
+
+// stateChanges returns the changes staged in sb as paths of the trie, sorted
+// so that the trie is always updated in the same order
+func (sb *StateBatch) stateChanges() []stateChange {
+	tags := map[*leveldb.DB]byte{
+		sb.bc.balancesDb: 'a',
+		sb.bc.StateDb:    'c',
+		sb.bc.ContractDb: 'x',
+	}
+
+	var changes []stateChange
+	for db, tag := range tags {
+		for key, v := range sb.staged[db] {
+			// The trie doesn't contain itself
+			if db == sb.bc.StateDb && strings.HasPrefix(key, "t/") {
+				continue
+			}
+
+			value := v.value
+			if v.deleted {
+				value = nil
+			} else if value == nil {
+				value = []byte{}
+			}
+			changes = append(changes, stateChange{stateKey(tag, []byte(key)), value})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return bytes.Compare(changes[i].key, changes[j].key) < 0
+	})
+	return changes
+}
+
+// StateRoot applies the changes staged in sb to the trie with root parent
+// and returns the new root, the new nodes are staged as well
+func (sb *StateBatch) StateRoot(parent []byte) ([]byte, error) {
+	if len(parent) == 0 {
+		parent = emptyRoot
+	}
+
+	t := &trie{sb}
+	root := parent
+	for _, c := range sb.stateChanges() {
+		var err error
+		root, err = t.update(root, 0, c.key, c.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return root, nil
+}
+
+// stateRootKey is where the state root after a block is saved in blockDb
+func stateRootKey(hash []byte) []byte {
+	return append([]byte("s"), hash...)
+}
+
+// GetStateRoot returns the root of the state after a block of the canonical
+// chain
+func (bc *Blockchain) GetStateRoot(blockHash []byte) ([]byte, error) {
+	if len(blockHash) == 0 {
+		return emptyRoot, nil
+	}
+	return bc.blockDb.Get(stateRootKey(blockHash), nil)
+}
+
+// ProveAccount returns the proof of the state of a wallet under root
+func (bc *Blockchain) ProveAccount(root []byte, address string) (*StateProof, error) {
+	t := &trie{bc.NewStateBatch()}
+	return t.prove(root, AccountKey(address))
+}
+
+// ProveStorage returns the proof of a key of the storage of a contract under
+// root
+func (bc *Blockchain) ProveStorage(root []byte, address string, key []byte) (*StateProof, error) {
+	t := &trie{bc.NewStateBatch()}
+	return t.prove(root, StorageKey(address, key))
+}
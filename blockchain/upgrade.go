@@ -0,0 +1,160 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Upgrades are saved in StateDb next to the contract state:
+//
+//	p/ + address   BLAKE-2b hash of the code approved with approvePatch
+//	k/ + address   the only wallet that can upgrade a locked contract
+//	v/ + address   history of the upgrades of the contract
+func patchKey(address []byte) []byte {
+	return append([]byte("p/"), address...)
+}
+
+func lockKey(address []byte) []byte {
+	return append([]byte("k/"), address...)
+}
+
+func historyKey(address []byte) []byte {
+	return append([]byte("v/"), address...)
+}
+
+// ContractUpgrade is an entry of the history of a contract
+type ContractUpgrade struct {
+	BlockIndex      uint64
+	TransactionHash []byte
+	Sender          string
+
+	PreviousHash []byte
+	Hash         []byte
+}
+
+// CodeHash returns the hash a contract has to approve to be upgraded to code
+func CodeHash(code []byte) []byte {
+	hash := blake2b.Sum256(code)
+	return hash[:]
+}
+
+// GetApprovedPatch returns the hash of the code a contract can be upgraded to
+func (sb *StateBatch) GetApprovedPatch(address []byte) ([]byte, error) {
+	return sb.get(sb.bc.StateDb, patchKey(address))
+}
+
+// SetApprovedPatch stages the hash of the code a contract can be upgraded to
+func (sb *StateBatch) SetApprovedPatch(address, hash []byte) {
+	sb.put(sb.bc.StateDb, patchKey(address), hash)
+}
+
+// GetContractHistory returns the upgrades of a contract, oldest first
+func (sb *StateBatch) GetContractHistory(address []byte) ([]*ContractUpgrade, error) {
+	raw, err := sb.get(sb.bc.StateDb, historyKey(address))
+	if err != nil {
+		return nil, err
+	}
+
+	var history []*ContractUpgrade
+	err = json.Unmarshal(raw, &history)
+	return history, err
+}
+
+// GetContractHistory returns the upgrades of the contract at address in the
+// committed state, a contract that was never upgraded has none
+func (bc *Blockchain) GetContractHistory(address string) ([]*ContractUpgrade, error) {
+	_, err := bc.ContractDb.Get([]byte(address), nil)
+	if err == leveldb.ErrNotFound {
+		return nil, errors.New("The contract doesn't exist")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	history, err := bc.NewStateBatch().GetContractHistory([]byte(address))
+	if err == leveldb.ErrNotFound {
+		return nil, nil
+	}
+	return history, err
+}
+
+// upgradeContract replaces the code of the contract at the recipient of t
+// with the code in its data. The contract must have approved the hash of the
+// new code, and if it's locked only the wallet it was locked to can send the
+// upgrade. Storage, memory and balance are kept, the ABI is replaced.
+func (sb *StateBatch) upgradeContract(t *protobufs.Transaction, block *protobufs.Block, receipt *Receipt) error {
+	address := []byte(t.GetRecipient())
+	code := t.GetData()
+
+	m, err := chargeCode(t, receipt)
+	if err != nil {
+		return err
+	}
+
+	approved, err := sb.GetApprovedPatch(address)
+	if err != nil || !bytes.Equal(approved, CodeHash(code)) {
+		return errors.New("The contract didn't approve this code")
+	}
+
+	state, err := sb.GetContractState(address)
+	if err == nil && state.GetLocked() {
+		owner, _ := sb.get(sb.bc.StateDb, lockKey(address))
+		if string(owner) != receipt.Sender {
+			return errors.New("The contract is locked")
+		}
+	}
+
+	old, err := sb.GetContractCode(address)
+	if err != nil {
+		return err
+	}
+
+	history, _ := sb.GetContractHistory(address)
+	history = append(history, &ContractUpgrade{
+		BlockIndex:      block.GetIndex(),
+		TransactionHash: receipt.TransactionHash,
+		Sender:          receipt.Sender,
+		PreviousHash:    CodeHash(old),
+		Hash:            CodeHash(code),
+	})
+	rawHistory, err := json.Marshal(history)
+	if err != nil {
+		return err
+	}
+
+	log.Info("Upgrading contract ", t.GetRecipient())
+	sb.SetContractCode(address, code)
+	sb.delete(sb.bc.StateDb, patchKey(address))
+	sb.put(sb.bc.StateDb, historyKey(address), rawHistory)
+	receipt.ContractAddress = t.GetRecipient()
+
+	err = sb.setContractABI(address, m)
+	if err != nil {
+		return err
+	}
+
+	if state == nil {
+		return nil
+	}
+
+	// The memory of the old code is kept, it only grows if the new one
+	// starts with more. Globals are reset if they don't fit the new code.
+	c, err := GetContract(t.GetRecipient(), sb, t, block)
+	if err != nil || !c.MemorySnapshot {
+		return err
+	}
+	if len(state.Memory) != 0 && len(state.Memory) < len(c.VM.Memory()) {
+		state.Memory = append(state.Memory, make([]byte, len(c.VM.Memory())-len(state.Memory))...)
+	}
+	if len(state.Globals) != len(c.VM.Globals()) {
+		state.Globals = c.VM.Globals()
+	}
+
+	return sb.SetContractState(address, state)
+}
@@ -149,6 +149,72 @@ func (v *ValidatorsBook) RemoveValidator(wallet string) error {
 	return errors.New("Validator " + wallet + " not found")
 }
 
+// Slash removes the stake of a validator that equivocated and ends its
+// dynasty at index
+func (v *ValidatorsBook) Slash(wallet string, index int64) error {
+	if _, ok := v.valsArray[wallet]; ok {
+		v.valsArray[wallet].stake = 0
+		v.valsArray[wallet].endDynasty = index
+		return nil
+	}
+	return errors.New("Validator " + wallet + " not found")
+}
+
+// unslash gives back stake and dynasty to a validator when the block that
+// slashed it gets reverted
+func (v *ValidatorsBook) unslash(wallet string, stake uint64, endDynasty int64) {
+	if _, ok := v.valsArray[wallet]; ok {
+		v.valsArray[wallet].stake = stake
+		v.valsArray[wallet].endDynasty = endDynasty
+	}
+}
+
+// SnapshotValidator is a validator as it's saved in a snapshot
+type SnapshotValidator struct {
+	Wallet           string
+	Stake            uint64
+	StartDynasty     int64
+	EndDynasty       int64
+	Shard            uint32
+	SchnorrPublicKey []byte
+}
+
+// snapshot returns all the validators of the book
+func (v *ValidatorsBook) snapshot() ([]*SnapshotValidator, error) {
+	var res []*SnapshotValidator
+	for _, val := range v.valsArray {
+		key, err := val.schnorrPublicKey.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, &SnapshotValidator{
+			Wallet:           val.wallet,
+			Stake:            val.stake,
+			StartDynasty:     val.startDynasty,
+			EndDynasty:       val.endDynasty,
+			Shard:            val.shard,
+			SchnorrPublicKey: key,
+		})
+	}
+
+	sort.Slice(res, func(i, j int) bool { return res[i].Wallet < res[j].Wallet })
+	return res, nil
+}
+
+// restoreSnapshot adds the validators of a snapshot to the book, replacing
+// the ones with the same wallet
+func (v *ValidatorsBook) restoreSnapshot(vals []*SnapshotValidator) error {
+	for _, val := range vals {
+		key, err := wal.ByteToPoint(val.SchnorrPublicKey)
+		if err != nil {
+			return err
+		}
+		v.valsArray[val.Wallet] = &Validator{val.Wallet, val.Stake, val.StartDynasty, val.EndDynasty, val.Shard, key}
+	}
+	return nil
+}
+
 // GetSchnorrPublicKey returns the schnorrPublicKey for a given wallet.
 func (v *ValidatorsBook) GetSchnorrPublicKey(wallet string) (kyber.Point, error) {
 	if _, ok := v.valsArray[wallet]; ok {
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
@@ -17,6 +19,7 @@ import (
 	"github.com/dexm-coin/dexmd/blockchain"
 	"github.com/dexm-coin/dexmd/wallet"
 	bp "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
@@ -67,7 +70,7 @@ func main() {
 
 		{
 			Name:    "startnode",
-			Usage:   "sn [wallet] [timestamp] [network]",
+			Usage:   "sn [wallet] [timestamp] [network] [archive|finalized|blocks to keep]",
 			Aliases: []string{"sn", "rn"},
 			Action: func(c *cli.Context) error {
 				walletPath := c.Args().Get(0)
@@ -78,6 +81,11 @@ func main() {
 					network = "hackney"
 				}
 
+				pruning, err := blockchain.ParsePruneMode(c.Args().Get(3))
+				if err != nil {
+					log.Fatal(err)
+				}
+
 				// Import an identity to encrypt data and sign for validator msg
 				w, err := wallet.ImportWallet(walletPath)
 				if err != nil {
@@ -148,6 +156,9 @@ func main() {
 					log.Fatal("blockchain", err)
 				}
 
+				// Prune and compact the databases in the background
+				go b.StartPruning(pruning, 10*time.Minute)
+
 				os.MkdirAll(".dexm.beacon", os.ModePerm)
 				// Create the beacon chain database
 				beacon, err := blockchain.NewBeaconChain(".dexm.beacon/")
@@ -155,12 +166,30 @@ func main() {
 					log.Fatal("blockchain", err)
 				}
 
+				// A node started from a snapshot has no blocks to find the
+				// validators in
+				err = b.LoadSnapshotValidators(beacon.Validators)
+				if err != nil {
+					log.Fatal("snapshot", err)
+				}
+
 				genesisBlock := &bp.Block{
 					Index:     0,
 					Timestamp: TS,
 					Miner:     "Dexm02aCR946Biyo98t55dqgJSb9NTpVn877EF9F5",
 				}
-				b.SaveBlock(genesisBlock)
+
+				// A restarted node keeps the genesis it was started with
+				if b.HasGenesis() {
+					genesisBytes, err := b.GetBlock(0)
+					if err != nil {
+						log.Fatal("genesis", err)
+					}
+					proto.Unmarshal(genesisBytes, genesisBlock)
+					log.Info("Resuming from block ", b.HeadIndex)
+				} else {
+					b.SaveBlock(genesisBlock)
+				}
 
 				// Open the port on the router, ignore errors
 				networking.TraverseNat(PORT, "Dexm Blockchain Node")
@@ -207,7 +236,7 @@ func main() {
 
 		{
 			Name:    "maketransaction",
-			Usage:   "mkt [walletPath] [recipient] [amount] [gas] [contract]",
+			Usage:   "mkt [walletPath] [recipient] [amount] [gas|auto] [contract]",
 			Aliases: []string{"mkt", "gt"},
 			Action: func(c *cli.Context) error {
 				// User supplied arguments
@@ -219,11 +248,6 @@ func main() {
 					log.Fatal(err)
 				}
 
-				gas, err := strconv.Atoi(c.Args().Get(3))
-				if err != nil {
-					log.Fatal(err)
-				}
-
 				cdata := []byte{}
 				contractPath := c.Args().Get(4)
 
@@ -239,10 +263,23 @@ func main() {
 					log.Error("import", err)
 					return nil
 				}
+				shard := uint32(senderWallet.GetShardWallet())
+
+				// Without gas ask a node how much the transaction needs
+				var gas uint64
+				gasArg := c.Args().Get(3)
+				if gasArg == "" || gasArg == "auto" {
+					gas, err = suggestGas(senderWallet, recipient, "", amount, cdata, shard)
+				} else {
+					gas, err = strconv.ParseUint(gasArg, 10, 32)
+				}
+				if err != nil {
+					log.Fatal(err)
+				}
 
 				ccreation := len(cdata) == 0
 
-				networking.SendTransaction(senderWallet, recipient, "", amount, uint64(gas), cdata, ccreation, uint32(senderWallet.GetShardWallet()))
+				networking.SendTransaction(senderWallet, recipient, "", nil, amount, gas, cdata, ccreation, shard)
 
 				return nil
 			},
@@ -267,7 +304,8 @@ func main() {
 					return nil
 				}
 
-				contract, err := blockchain.GetContract(address, b.ContractDb, b.StateDb)
+				sb := b.NewStateBatch()
+				contract, err := blockchain.GetContract(address, sb, nil, nil)
 				if err != nil {
 					log.Fatal(err)
 					return nil
@@ -275,11 +313,24 @@ func main() {
 
 				log.Info("Inspecting ", address)
 
+				// Without an ABI only the names of the functions are known
+				abi, err := sb.GetContractABI([]byte(address))
+				if err != nil {
+					log.Info("The contract has no ABI")
+					abi = nil
+				}
+
 				shell := ishell.New()
 
 				var entries []string
-				for key := range contract.Module.Export.Entries {
-					entries = append(entries, key)
+				if abi != nil {
+					for _, fn := range abi.Functions {
+						entries = append(entries, fn.Name)
+					}
+				} else {
+					for key := range contract.Module.Export.Entries {
+						entries = append(entries, key)
+					}
 				}
 
 				var choice int
@@ -288,24 +339,86 @@ func main() {
 					Help: "Function entries from the contract",
 					Func: func(c *ishell.Context) {
 						choice = c.MultiChoice(entries, "Which function do you want to use ?")
+						fname := entries[choice]
+
+						var fn *blockchain.ABIFunction
+						var args []uint64
+						var data []byte
+						if abi != nil {
+							fn, _ = abi.Function(fname)
+
+							var values []string
+							for _, p := range fn.Params {
+								c.Printf("Insert %s (%s)\n", p.Name, p.Type)
+								values = append(values, c.ReadLine())
+							}
+
+							args, data, err = fn.EncodeCall(values)
+							if err != nil {
+								c.Println(err)
+								return
+							}
+						}
 
 						c.Println("Insert the transaction value")
 						valS := c.ReadLine()
 
-						c.Println("Insert gas cost")
-						gasS := c.ReadLine()
-
 						amount, err := strconv.ParseUint(valS, 10, 64)
 						if err != nil {
 							log.Fatal(err)
 						}
 
-						gas, err := strconv.Atoi(gasS)
+						// Show what the call would do and suggest the gas
+						shard := uint32(senderWallet.GetShardWallet())
+						var suggested uint64
+						receipt, err := networking.SimulateTransaction(senderWallet, address, fname, amount, args, data, shard)
 						if err != nil {
-							log.Fatal(err)
+							log.Error(err)
+						} else {
+							printReceipt(c, fn, receipt)
+							suggested = networking.SuggestGas(receipt.GasUsed)
+						}
+
+						// Without a suggestion the gas has to be given
+						gas := suggested
+						for {
+							if suggested != 0 {
+								c.Println("Insert gas cost, leave empty for", suggested)
+							} else {
+								c.Println("Insert gas cost")
+							}
+							gasS := c.ReadLine()
+							if gasS == "" && suggested != 0 {
+								break
+							}
+
+							gas, err = strconv.ParseUint(gasS, 10, 32)
+							if err == nil && gas != 0 {
+								break
+							}
+							c.Println("Invalid gas cost")
+						}
+
+						networking.SendTransaction(senderWallet, address, fname, args, amount, gas, data, false, shard)
+					},
+				})
+
+				shell.AddCmd(&ishell.Cmd{
+					Name: "state",
+					Help: "Show the variables of the contract described by the ABI",
+					Func: func(c *ishell.Context) {
+						if abi == nil {
+							c.Println("The contract has no ABI")
+							return
 						}
 
-						networking.SendTransaction(senderWallet, address, entries[choice], amount, uint64(gas), []byte{}, false, uint32(senderWallet.GetShardWallet()))
+						for _, v := range abi.Storage {
+							val, err := sb.ReadVariable([]byte(address), v)
+							if err != nil {
+								val = err.Error()
+							}
+							c.Println(v.Name, "=", val)
+						}
 					},
 				})
 
@@ -384,6 +497,245 @@ func main() {
 			},
 		},
 
+		{
+			Name:    "diskusage",
+			Usage:   "du [path]",
+			Aliases: []string{"du"},
+			Action: func(c *cli.Context) error {
+				dbPath := c.Args().Get(0)
+				if dbPath == "" {
+					dbPath = ".dexm.shard/"
+				}
+
+				usage, err := blockchain.DiskUsage(dbPath)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				var total int64
+				for _, name := range blockchain.Databases {
+					fmt.Printf("%-10s %8.2f MB\n", name, float64(usage[name])/1e6)
+					total += usage[name]
+				}
+				fmt.Printf("%-10s %8.2f MB\n", "total", float64(total)/1e6)
+
+				return nil
+			},
+		},
+
+		{
+			Name:    "migrate",
+			Usage:   "migrate [path]",
+			Aliases: []string{"migrate"},
+			Action: func(c *cli.Context) error {
+				dbPath := c.Args().Get(0)
+				if dbPath == "" {
+					dbPath = ".dexm.shard/"
+				}
+
+				err := blockchain.Migrate(dbPath)
+				if err != nil {
+					log.Fatal(err)
+				}
+				log.Info("Migrated ", dbPath)
+
+				return nil
+			},
+		},
+
+		{
+			Name:    "transaction",
+			Usage:   "tx [hash] [shard]",
+			Aliases: []string{"tx"},
+			Action: func(c *cli.Context) error {
+				hash, err := hex.DecodeString(c.Args().Get(0))
+				if err != nil {
+					log.Fatal("Invalid hash")
+				}
+				shard, err := strconv.ParseUint(c.Args().Get(1), 10, 8)
+				if err != nil {
+					log.Fatal("Invalid shard")
+				}
+
+				status, err := networking.GetTransactionStatus(hash, uint32(shard))
+				if err != nil {
+					log.Fatal("The transaction isn't in a block")
+				}
+
+				r := status.Receipt
+				fmt.Println("Block:", status.BlockIndex, hex.EncodeToString(status.BlockHash))
+				fmt.Println("Position:", status.Position)
+				fmt.Println(r.Sender, "->", r.Recipient, r.Amount)
+				fmt.Println("Gas used:", r.GasUsed, "charged:", r.GasCharged)
+				if !r.Success {
+					fmt.Println("Failed:", r.Error)
+				}
+
+				return nil
+			},
+		},
+
+		{
+			Name:    "history",
+			Usage:   "hs [address] [from block]",
+			Aliases: []string{"hs"},
+			Action: func(c *cli.Context) error {
+				address := c.Args().Get(0)
+				if !wallet.IsWalletValid(address) {
+					log.Fatal("Invalid address")
+				}
+				shard, err := strconv.ParseUint(address[4:6], 16, 8)
+				if err != nil {
+					log.Fatal("Invalid address")
+				}
+
+				var from uint64
+				if c.Args().Get(1) != "" {
+					from, err = strconv.ParseUint(c.Args().Get(1), 10, 64)
+					if err != nil {
+						log.Fatal("Invalid block")
+					}
+				}
+
+				history, err := networking.GetAddressHistory(address, from, uint32(shard))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				for _, t := range history {
+					direction := "in "
+					if t.Sent && t.Received {
+						direction = "self"
+					} else if t.Sent {
+						direction = "out"
+					}
+					fmt.Println(t.BlockIndex, direction, hex.EncodeToString(t.TransactionHash))
+				}
+
+				return nil
+			},
+		},
+
+		{
+			Name:    "contracthistory",
+			Usage:   "ch [address]",
+			Aliases: []string{"ch"},
+			Action: func(c *cli.Context) error {
+				address := c.Args().Get(0)
+				if !wallet.IsWalletValid(address) {
+					log.Fatal("Invalid address")
+				}
+				shard, err := strconv.ParseUint(address[4:6], 16, 8)
+				if err != nil {
+					log.Fatal("Invalid address")
+				}
+
+				history, err := networking.GetContractHistory(address, uint32(shard))
+				if err != nil {
+					log.Fatal(err)
+				}
+				if len(history) == 0 {
+					fmt.Println("The contract was never upgraded")
+				}
+
+				for _, u := range history {
+					fmt.Println(u.BlockIndex, u.Sender, hex.EncodeToString(u.PreviousHash), "->", hex.EncodeToString(u.Hash))
+				}
+
+				return nil
+			},
+		},
+
+		{
+			Name:    "exportsnapshot",
+			Usage:   "es [file] [shard]",
+			Aliases: []string{"es"},
+			Action: func(c *cli.Context) error {
+				file := c.Args().Get(0)
+				if file == "" {
+					log.Fatal("Invalid filename")
+				}
+				shard, err := strconv.ParseUint(c.Args().Get(1), 10, 8)
+				if err != nil {
+					log.Fatal("Invalid shard")
+				}
+
+				// The databases are locked by the running node, so it's
+				// the node that writes the snapshot
+				data, err := networking.DownloadSnapshot(uint32(shard))
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				err = ioutil.WriteFile(file, data, 0644)
+				if err != nil {
+					log.Fatal(err)
+				}
+				log.Info("Saved snapshot to ", file)
+
+				// Whoever bootstraps from the file needs these from a node
+				// they trust
+				snap, err := blockchain.ReadSnapshot(bytes.NewReader(data))
+				if err != nil {
+					log.Fatal(err)
+				}
+				checkpoint := sha256.Sum256(snap.Block)
+				validators, err := snap.ValidatorsHash()
+				if err != nil {
+					log.Fatal(err)
+				}
+				log.Info("Checkpoint ", hex.EncodeToString(checkpoint[:]))
+				log.Info("Validators ", hex.EncodeToString(validators))
+
+				return nil
+			},
+		},
+
+		{
+			Name:    "bootstrap",
+			Usage:   "bs [file] [checkpoint] [validators]",
+			Aliases: []string{"bs"},
+			Action: func(c *cli.Context) error {
+				checkpoint, err := hex.DecodeString(c.Args().Get(1))
+				if err != nil || len(checkpoint) != sha256.Size {
+					log.Fatal("Invalid checkpoint hash")
+				}
+				validators, err := hex.DecodeString(c.Args().Get(2))
+				if err != nil || len(validators) != sha256.Size {
+					log.Fatal("Invalid validators hash")
+				}
+
+				f, err := os.Open(c.Args().Get(0))
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer f.Close()
+
+				snap, err := blockchain.ReadSnapshot(f)
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				os.MkdirAll(".dexm.shard", os.ModePerm)
+				b, err := blockchain.NewBlockchain(".dexm.shard/", 0)
+				if err != nil {
+					log.Fatal(err)
+				}
+				defer b.Close()
+
+				err = b.ImportSnapshot(snap, checkpoint, validators, blockchain.NewValidatorsBook())
+				if err != nil {
+					log.Fatal(err)
+				}
+
+				root, _ := b.GetStateRoot(b.HeadHash)
+				log.Info("Started from block ", b.HeadIndex, " ", hex.EncodeToString(b.HeadHash))
+				log.Info("State root ", hex.EncodeToString(root))
+
+				return nil
+			},
+		},
+
 		/* {
 			Name:    "withdraw",
 			Usage:   "wd [walletPath]",
@@ -404,3 +756,40 @@ func main() {
 
 	app.Run(os.Args)
 }
+
+// suggestGas simulates a transaction on a node and returns the gas to send
+// with it
+func suggestGas(w *wallet.Wallet, recipient, fname string, amount uint64, cdata []byte, shard uint32) (uint64, error) {
+	receipt, err := networking.SimulateTransaction(w, recipient, fname, amount, nil, cdata, shard)
+	if err != nil {
+		return 0, err
+	}
+	if !receipt.Success {
+		log.Warn("The transaction would fail: ", receipt.Error)
+	}
+
+	gas := networking.SuggestGas(receipt.GasUsed)
+	log.Info("Suggested gas ", gas)
+	return gas, nil
+}
+
+// printReceipt shows the result of a simulated call, decoded with the ABI of
+// the function if there is one
+func printReceipt(c *ishell.Context, fn *blockchain.ABIFunction, receipt *blockchain.Receipt) {
+	if !receipt.Success {
+		c.Println("The call would fail:", receipt.Error)
+		return
+	}
+
+	if fn != nil {
+		if result := fn.DecodeResult(receipt); result != "" {
+			c.Println("Result:", result)
+		}
+	} else if receipt.ReturnValue != nil {
+		c.Println("Result:", *receipt.ReturnValue)
+	}
+
+	for _, l := range receipt.Logs {
+		c.Println("Event", hex.EncodeToString(l.Topic), hex.EncodeToString(l.Data))
+	}
+}
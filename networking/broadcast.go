@@ -1,12 +1,15 @@
 package networking
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
 	"math/rand"
 	"strconv"
+	"time"
 
+	"github.com/dexm-coin/dexmd/blockchain"
 	"github.com/dexm-coin/dexmd/wallet"
 	bcp "github.com/dexm-coin/protobufs/build/blockchain"
 	protoBlockchain "github.com/dexm-coin/protobufs/build/blockchain"
@@ -105,27 +108,19 @@ func (cs *ConnectionStore) handleBroadcast(data []byte, shard uint32) error {
 			return err
 		}
 
-		// save only the block that have cs.shardChain.currentblock+1
-		// if block.Index != cs.shardChain.CurrentBlock+1 {
-		// 	log.Error("The index of the block is wrong")
-		// }
-		// check if the signature of the block that should be cs.shardChain.CurrentValidator
-		// if block.Miner != cs.shardChain.CurrentValidator {
-		// 	log.Error("The miner is wrong")
-		// }
-		// blockBytes, _ := proto.Marshal(block)
-		// bhash := sha256.Sum256(blockBytes)
-		// hash := bhash[:]
-		// r, s, err := cs.identity.Sign(hash)
-		// if err != nil {
-		// 	log.Error(err)
-		// 	return err
-		// }
-		// verifyBlock, err := wallet.SignatureValid([]byte(cs.shardChain.CurrentValidator), r.Bytes(), s.Bytes(), hash)
-		// if !verifyBlock || err != nil {
-		// 	log.Error("SignatureValid ", err)
-		// 	return err
-		// }
+		// Only the validator chosen for the slot can propose a block
+		err = VerifyBlockProposal(block, broadcastEnvelope.GetIdentity(), cs.beaconChain.Validators, cs.shardChain.GenesisTimestamp, time.Now().Unix())
+		if err != nil {
+			log.Error("Rejected block: ", err)
+			return err
+		}
+
+		// A second signed block for the same slot is enough to slash the miner
+		identity := broadcastEnvelope.GetIdentity()
+		evidence := cs.shardChain.Slashing.ObserveProposal(block, identity.GetPubkey(), identity.GetR(), identity.GetS())
+		if evidence != nil {
+			cs.broadcastEvidence(evidence, shard)
+		}
 
 		err = cs.shardChain.SaveBlock(block)
 		if err != nil {
@@ -154,6 +149,11 @@ func (cs *ConnectionStore) handleBroadcast(data []byte, shard uint32) error {
 			return err
 		}
 		if cs.beaconChain.Validators.CheckIsValidator(vote.PublicKey) {
+			evidence := cs.shardChain.Slashing.ObserveVote(vote, broadcastEnvelope.GetIdentity().GetPubkey())
+			if evidence != nil {
+				cs.broadcastEvidence(evidence, shard)
+			}
+
 			err := cs.AddVote(vote)
 			if err != nil {
 				log.Error(err)
@@ -162,6 +162,21 @@ func (cs *ConnectionStore) handleBroadcast(data []byte, shard uint32) error {
 			cs.shardChain.CurrentVote++
 		}
 
+	case BroadcastSlashingEvidence:
+		if !cs.CheckShard(shard) {
+			return nil
+		}
+
+		evidence := &blockchain.Evidence{}
+		err := json.Unmarshal(broadcastEnvelope.GetData(), evidence)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+
+		// The evidence is verified before being saved for the next block
+		cs.shardChain.Slashing.AddEvidence(evidence)
+
 	case protoNetwork.Broadcast_WITHDRAW:
 		log.Printf("New Withdraw: %x", broadcastEnvelope.GetData())
 
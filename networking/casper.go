@@ -27,19 +27,18 @@ func CreateVote(sVote, tVote []byte, hsVote, htVote uint64, w *wallet.Wallet) pr
 	if err != nil {
 		log.Fatal(err)
 	}
-	data := []byte(fmt.Sprintf("%v", sVote) + fmt.Sprintf("%v", tVote) + fmt.Sprintf("%v", hsVote) + fmt.Sprintf("%v", hsVote) + wal)
-	bhash := sha256.Sum256(data)
-	hash := bhash[:]
-	rSign, sSign, _ := w.Sign(hash)
-	return protobufs.CasperVote{
+	vote := protobufs.CasperVote{
 		Source:       sVote,
 		Target:       tVote,
 		SourceHeight: hsVote,
 		TargetHeight: htVote,
-		R:            rSign.Bytes(),
-		S:            sSign.Bytes(),
 		PublicKey:    wal,
 	}
+
+	rSign, sSign, _ := w.Sign(blockchain.VoteHash(&vote))
+	vote.R = rSign.Bytes()
+	vote.S = sSign.Bytes()
+	return vote
 }
 
 // CheckpointAgreement : Every checkpoint there should be an agreement of 2/3 of the validators
@@ -94,7 +93,10 @@ func (cs *ConnectionStore) CheckpointAgreement(SourceHeight, TargetHeight uint64
 		// so h(s1) < h(s2) < h(t2) < h(t1) is valid
 		receivedVotes = []*protobufs.CasperVote{}
 
-		cs.shardChain.CurrentCheckpoint = TargetHeight
+		err := cs.shardChain.SetCheckpoint(TargetHeight)
+		if err != nil {
+			log.Error("SetCheckpoint ", err)
+		}
 		return true
 	}
 	return false
@@ -152,7 +154,7 @@ func (cs *ConnectionStore) AddVote(vote *protobufs.CasperVote) error {
 	if err != nil {
 		return err
 	}
-	return cs.shardChain.CasperVotesDb.Put([]byte(string(cs.shardChain.CurrentVote)), res, nil)
+	return cs.shardChain.CasperVotesDb.Put([]byte(strconv.FormatUint(cs.shardChain.CurrentVote, 10)), res, nil)
 }
 
 // GetCasperVote get a casper vote inside CasperVotesDb
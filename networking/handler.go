@@ -1,10 +1,13 @@
 package networking
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"strconv"
 	"time"
 
+	bp "github.com/dexm-coin/protobufs/build/blockchain"
 	protobufs "github.com/dexm-coin/protobufs/build/network"
 	"github.com/golang/protobuf/proto"
 	log "github.com/sirupsen/logrus"
@@ -93,6 +96,172 @@ func (cs *ConnectionStore) handleMessage(pb *protobufs.Request, c *client, shard
 
 		return code
 
+	// RequestSimulateTransaction runs the transaction sent after the request
+	// on the current head and returns its receipt
+	case RequestSimulateTransaction:
+		if !cs.CheckShard(shard) {
+			return []byte("Error")
+		}
+
+		rawTrans, err := c.GetResponse(100 * time.Millisecond)
+		if err != nil {
+			log.Error(err)
+			return []byte{}
+		}
+		if !c.allowSimulation() {
+			return []byte("Error")
+		}
+
+		trans := &bp.Transaction{}
+		err = proto.Unmarshal(rawTrans, trans)
+		if err != nil {
+			return []byte("Error")
+		}
+
+		receipt, err := cs.shardChain.SimulateTransaction(trans)
+		if err != nil {
+			return []byte("Error")
+		}
+
+		data, err := json.Marshal(receipt)
+		if err != nil {
+			return []byte("Error")
+		}
+		return data
+
+	// RequestWalletStatusAt returns the balance and nonce of a wallet as of
+	// the block at the index of the request
+	case RequestWalletStatusAt:
+		if !cs.CheckShard(shard) {
+			return []byte("Error")
+		}
+
+		walletAddr, err := c.GetResponse(100 * time.Millisecond)
+		if err != nil {
+			log.Error(err)
+			return []byte{}
+		}
+
+		state, err := cs.shardChain.GetWalletStateAt(string(walletAddr), pb.GetIndex())
+		if err != nil {
+			return []byte("Error")
+		}
+
+		data, err := proto.Marshal(&state)
+		if err != nil {
+			return []byte("Error")
+		}
+		return data
+
+	// RequestStorageAt returns a value of the storage of a contract as of the
+	// block at the index of the request
+	case RequestStorageAt:
+		if !cs.CheckShard(shard) {
+			return []byte("Error")
+		}
+
+		contractAddr, err := c.GetResponse(100 * time.Millisecond)
+		if err != nil {
+			log.Error(err)
+			return []byte{}
+		}
+		key, err := c.GetResponse(100 * time.Millisecond)
+		if err != nil {
+			log.Error(err)
+			return []byte{}
+		}
+
+		value, err := cs.shardChain.GetStorageAt(string(contractAddr), key, pb.GetIndex())
+		if err != nil {
+			return []byte("Error")
+		}
+		return value
+
+	// RequestTransactionStatus returns the location and the receipt of a
+	// transaction of the canonical chain
+	case RequestTransactionStatus:
+		if !cs.CheckShard(shard) {
+			return []byte("Error")
+		}
+
+		hash, err := c.GetResponse(100 * time.Millisecond)
+		if err != nil {
+			log.Error(err)
+			return []byte{}
+		}
+
+		status, err := cs.shardChain.GetTransactionStatus(hash)
+		if err != nil {
+			return []byte("Error")
+		}
+
+		data, err := json.Marshal(status)
+		if err != nil {
+			return []byte("Error")
+		}
+		return data
+
+	// RequestAddressHistory returns the transactions of a wallet from the
+	// block at the index of the request
+	case RequestAddressHistory:
+		if !cs.CheckShard(shard) {
+			return []byte("Error")
+		}
+
+		walletAddr, err := c.GetResponse(100 * time.Millisecond)
+		if err != nil {
+			log.Error(err)
+			return []byte{}
+		}
+
+		history, err := cs.shardChain.GetAddressHistory(string(walletAddr), pb.GetIndex(), cs.shardChain.HeadIndex, maxAddressHistory)
+		if err != nil {
+			return []byte("Error")
+		}
+
+		data, err := json.Marshal(history)
+		if err != nil {
+			return []byte("Error")
+		}
+		return data
+
+	// RequestContractHistory returns the upgrades of a contract
+	case RequestContractHistory:
+		if !cs.CheckShard(shard) {
+			return []byte("Error")
+		}
+
+		address, err := c.GetResponse(100 * time.Millisecond)
+		if err != nil {
+			log.Error(err)
+			return []byte{}
+		}
+
+		history, err := cs.shardChain.GetContractHistory(string(address))
+		if err != nil {
+			return []byte("Error")
+		}
+
+		data, err := json.Marshal(history)
+		if err != nil {
+			return []byte("Error")
+		}
+		return data
+
+	// RequestSnapshot returns a snapshot of the chain at the last checkpoint
+	case RequestSnapshot:
+		if !cs.CheckShard(shard) || !isLoopback(c.conn.RemoteAddr()) {
+			return []byte("Error")
+		}
+
+		var buf bytes.Buffer
+		err := cs.shardChain.ExportSnapshot(&buf, cs.beaconChain.Validators)
+		if err != nil {
+			log.Error("snapshot ", err)
+			return []byte("Error")
+		}
+		return buf.Bytes()
+
 	// GET_INTERESTS returns the type of broadcasts the client is interested in
 	case protobufs.Request_GET_INTERESTS:
 		keys := []string{}
@@ -0,0 +1,175 @@
+package networking
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	bp "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/dexm-coin/protobufs/build/network"
+	"github.com/golang/protobuf/proto"
+	"github.com/gorilla/websocket"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// RequestWalletStatusAt is GET_WALLET_STATUS as of the block in the
+	// index of the request, it's followed by the address
+	RequestWalletStatusAt network.Request_Type = 101
+	// RequestStorageAt returns the value of a key of the storage of a
+	// contract as of the block in the index of the request, it's followed
+	// by the address and then the key
+	RequestStorageAt network.Request_Type = 102
+	// RequestTransactionStatus returns the JSON of the TransactionStatus of
+	// the transaction whose hash follows the request
+	RequestTransactionStatus network.Request_Type = 103
+	// RequestAddressHistory returns the JSON of the transactions of the
+	// address that follows the request, starting from the block in the index
+	// of the request
+	RequestAddressHistory network.Request_Type = 104
+	// RequestContractHistory returns the JSON of the upgrades of the contract
+	// whose address follows the request
+	RequestContractHistory network.Request_Type = 106
+)
+
+// maxAddressHistory is the number of transactions sent for every
+// RequestAddressHistory, wallets ask again from the last block to get more
+const maxAddressHistory = 500
+
+// askNode sends a request followed by parts to the nodes of the network till
+// one of them answers
+func askNode(req *network.Request, shard uint32, parts ...[]byte) ([]byte, error) {
+	ips, err := GetPeerList("hackney")
+	if err != nil {
+		return nil, err
+	}
+
+	dial := websocket.Dialer{
+		Proxy:            http.ProxyFromEnvironment,
+		HandshakeTimeout: 5 * time.Second,
+	}
+
+	for _, ip := range ips {
+		conn, _, err := dial.Dial(fmt.Sprintf("ws://%s/ws", ip+":3141"), nil)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+
+		res, err := askConn(conn, req, shard, parts)
+		conn.Close()
+		if err != nil {
+			log.Error(ip, " ", err)
+			continue
+		}
+		return res, nil
+	}
+
+	return nil, errors.New("No node answered")
+}
+
+func askConn(conn *websocket.Conn, req *network.Request, shard uint32, parts [][]byte) ([]byte, error) {
+	reqEnv, err := makeReqEnvelope(req, shard)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.WriteMessage(websocket.BinaryMessage, reqEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range parts {
+		env, err := proto.Marshal(&network.Envelope{
+			Type:  network.Envelope_OTHER,
+			Data:  p,
+			Shard: shard,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		err = conn.WriteMessage(websocket.BinaryMessage, env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+
+	env := &network.Envelope{}
+	err = proto.Unmarshal(msg, env)
+	if err != nil {
+		return nil, err
+	}
+	if string(env.GetData()) == "Error" {
+		return nil, errors.New("The node couldn't answer")
+	}
+	return env.GetData(), nil
+}
+
+// GetWalletStatusAt asks the network for the state of a wallet as of block
+// index
+func GetWalletStatusAt(address string, index uint64, shard uint32) (*bp.AccountState, error) {
+	req := &network.Request{Type: RequestWalletStatusAt, Index: index}
+	res, err := askNode(req, shard, []byte(address))
+	if err != nil {
+		return nil, err
+	}
+
+	state := &bp.AccountState{}
+	err = proto.Unmarshal(res, state)
+	return state, err
+}
+
+// GetStorageAt asks the network for a key of the storage of a contract as of
+// block index
+func GetStorageAt(address string, key []byte, index uint64, shard uint32) ([]byte, error) {
+	req := &network.Request{Type: RequestStorageAt, Index: index}
+	return askNode(req, shard, []byte(address), key)
+}
+
+// GetTransactionStatus asks the network if a transaction is in a block
+func GetTransactionStatus(hash []byte, shard uint32) (*blockchain.TransactionStatus, error) {
+	req := &network.Request{Type: RequestTransactionStatus}
+	res, err := askNode(req, shard, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &blockchain.TransactionStatus{}
+	err = json.Unmarshal(res, status)
+	return status, err
+}
+
+// GetAddressHistory asks the network for the transactions sent and received
+// by address from block fromBlock on
+func GetAddressHistory(address string, fromBlock uint64, shard uint32) ([]*blockchain.AddressTransaction, error) {
+	req := &network.Request{Type: RequestAddressHistory, Index: fromBlock}
+	res, err := askNode(req, shard, []byte(address))
+	if err != nil {
+		return nil, err
+	}
+
+	var history []*blockchain.AddressTransaction
+	err = json.Unmarshal(res, &history)
+	return history, err
+}
+
+// GetContractHistory asks the network for the upgrades of a contract
+func GetContractHistory(address string, shard uint32) ([]*blockchain.ContractUpgrade, error) {
+	req := &network.Request{Type: RequestContractHistory}
+	res, err := askNode(req, shard, []byte(address))
+	if err != nil {
+		return nil, err
+	}
+
+	var history []*blockchain.ContractUpgrade
+	err = json.Unmarshal(res, &history)
+	return history, err
+}
@@ -1,13 +1,10 @@
 package networking
 
 import (
-	"crypto/sha256"
 	"errors"
-	"fmt"
 	"strconv"
 	"time"
 
-	"github.com/dexm-coin/dexmd/blockchain"
 	"github.com/dexm-coin/dexmd/wallet"
 	"github.com/dexm-coin/protobufs/build/network"
 	"github.com/golang/protobuf/proto"
@@ -117,110 +114,25 @@ func (cs *ConnectionStore) ImportBlock(block *protobufs.Block) error {
 	// The genesis block is a title of a The Times article, We still need to
 	// add a validator because otherwise no blocks will be generated
 	if block.GetIndex() == 0 {
-		// A bit of balance to run tests
-		state := &protobufs.AccountState{
-			Balance: 20000,
-			Nonce:   0,
-		}
-
 		// TODO cange this import wallet because we don't want that people know the private key of those 2 wallet
 		satoshi, _ := wallet.ImportWallet("satoshi3")
-		cs.shardChain.SetState("Dexm02aCR946Biyo98t55dqgJSb9NTpVn877EF9F5", state)
-		cs.beaconChain.Validators.AddValidator("Dexm02aCR946Biyo98t55dqgJSb9NTpVn877EF9F5", 20000, -300, satoshi.GetPublicKeySchnorrByte())
-
-		state = &protobufs.AccountState{
-			Balance: 10000,
-			Nonce:   0,
-		}
-
 		w, _ := wallet.ImportWallet("w3")
-		cs.shardChain.SetState("Dexm01AXxMYVnzKmrekmjx6mUdTarC3xLB1984853", state)
-		cs.beaconChain.Validators.AddValidator("Dexm01AXxMYVnzKmrekmjx6mUdTarC3xLB1984853", 10000, -300, w.GetPublicKeySchnorrByte())
-
-		cs.shardChain.GenesisTimestamp = block.GetTimestamp()
-
-		return nil
-	}
-
-	for _, t := range block.GetTransactions() {
-		sender := wallet.BytesToAddress(t.GetSender(), t.GetShard())
-
-		log.Info("Sender:", sender)
-		log.Info("Recipient:", t.GetRecipient())
-		log.Info("Amnt:", t.GetAmount())
-
-		senderBalance, err := cs.shardChain.GetWalletState(sender)
-		if err != nil {
-			log.Error(err)
-			return err
-		}
-
-		if t.GetRecipient() == "DexmPoS" {
-			exist := cs.beaconChain.Validators.AddValidator(sender, t.GetAmount(), int64(cs.shardChain.CurrentBlock), t.GetPubSchnorrKey())
-			if exist {
-				log.Info("slash for ", sender)
-			}
-		}
-
-		// Ignore error because if the wallet doesn't exist yet we don't care
-		reciverBalance, _ := cs.shardChain.GetWalletState(t.GetRecipient())
-
-		// No overflow checks because ValidateBlock already does that
-		senderBalance.Balance -= t.GetAmount() + uint64(t.GetGas())
-		reciverBalance.Balance += t.GetAmount()
 
-		// Avoid replaying transactions
-		senderBalance.Nonce++
-
-		log.Info("Sender balance:", senderBalance.Balance)
-		log.Info("Sender nonce: ", senderBalance.Nonce)
-		log.Info("Reciver balance:", reciverBalance.Balance)
-
-		err = cs.shardChain.SetState(sender, &senderBalance)
-		if err != nil {
-			log.Error(err)
-			return err
-		}
-		err = cs.shardChain.SetState(t.GetRecipient(), &reciverBalance)
-		if err != nil {
-			log.Error(err)
-			return err
-		}
-
-		if t.GetContractCreation() {
-			// Use sender a nonce to find contract address
-			contractAddr := wallet.BytesToAddress([]byte(fmt.Sprintf("%s%d", sender, senderBalance.Nonce)), t.GetShard())
-
-			// Save it on a separate db
-			log.Info("New contract at ", contractAddr)
-			cs.shardChain.ContractDb.Put([]byte(contractAddr), t.GetData(), nil)
-		}
-
-		// If a function identifier is specified then fetch the contract and execute
-		if t.GetFunction() != "" {
-			c, err := blockchain.GetContract(t.GetRecipient(), cs.shardChain.ContractDb, cs.shardChain.StateDb)
-			if err != nil {
-				return err
-			}
-
-			err = c.ExecuteContract(t.GetFunction(), t.GetArgs())
-			if err != nil {
-				return err
-			}
-
-			c.SaveState()
-		}
+		// The validators are only kept in memory so they are added on every start
+		cs.beaconChain.Validators.AddValidator("Dexm02aCR946Biyo98t55dqgJSb9NTpVn877EF9F5", 20000, -300, satoshi.GetPublicKeySchnorrByte())
+		cs.beaconChain.Validators.AddValidator("Dexm01AXxMYVnzKmrekmjx6mUdTarC3xLB1984853", 10000, -300, w.GetPublicKeySchnorrByte())
 
-		// save the hash of the transaction inside cs.shardChain.TransactionArrived
-		tByte, _ := proto.Marshal(t)
-		hashTransaction := sha256.Sum256(tByte)
-		cs.shardChain.TransactionArrived = append(cs.shardChain.TransactionArrived, hashTransaction[:])
-		if len(cs.shardChain.TransactionArrived) > maxMessagesSave {
-			cs.shardChain.TransactionArrived = cs.shardChain.TransactionArrived[1:]
-		}
+		// A bit of balance to run tests, this is skipped if the node is
+		// resuming from an existing database
+		return cs.shardChain.ApplyGenesis(block, map[string]*protobufs.AccountState{
+			"Dexm02aCR946Biyo98t55dqgJSb9NTpVn877EF9F5": {Balance: 20000, Nonce: 0},
+			"Dexm01AXxMYVnzKmrekmjx6mUdTarC3xLB1984853": {Balance: 10000, Nonce: 0},
+		})
 	}
 
-	return nil
+	// Save the block and let the fork choice decide if it becomes the head,
+	// all the transactions of a block are applied at once
+	return cs.shardChain.AddBlock(block, cs.beaconChain.Validators)
 }
 
 func (c *client) GetResponse(timeout time.Duration) ([]byte, error) {
@@ -7,7 +7,6 @@ import (
 	"github.com/dexm-coin/dexmd/util"
 	"github.com/dexm-coin/dexmd/wallet"
 	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
-	"github.com/golang/protobuf/proto"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -26,10 +25,9 @@ func (cs *ConnectionStore) CheckMerkleProof(merkleProof *protobufs.MerkleProof)
 		ReceiptBurned[string(merkleProof.GetLeaf())] = true
 
 		t := merkleProof.GetTransaction()
-		result, _ := proto.Marshal(t)
 		sender := wallet.BytesToAddress(t.GetSender(), t.GetShard())
 
-		valid, err := wallet.SignatureValid(t.GetSender(), t.GetR(), t.GetS(), result)
+		valid, err := wallet.TransactionSignatureValid(t)
 		if !valid || err != nil {
 			log.Error("SignatureValid ", err)
 			return false, err
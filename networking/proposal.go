@@ -0,0 +1,112 @@
+package networking
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	bcp "github.com/dexm-coin/protobufs/build/blockchain"
+	protoNetwork "github.com/dexm-coin/protobufs/build/network"
+	"github.com/golang/protobuf/proto"
+)
+
+const (
+	// Seconds of difference allowed between our clock and the proposer's
+	maxClockDrift = 5
+	// Seconds after the end of its slot a proposal is still accepted
+	maxProposalDelay = 10
+)
+
+// InvalidProposerError is returned when a block wasn't proposed by the
+// validator chosen for its index and shard
+type InvalidProposerError struct {
+	Index    uint64
+	Miner    string
+	Expected string
+}
+
+func (e *InvalidProposerError) Error() string {
+	if e.Expected == "" {
+		return fmt.Sprintf("No validator can propose block %d, got one from %s", e.Index, e.Miner)
+	}
+	return fmt.Sprintf("Block %d was proposed by %s instead of %s", e.Index, e.Miner, e.Expected)
+}
+
+// InvalidSignatureError is returned when the identity attached to a proposal
+// doesn't prove that the miner signed the block
+type InvalidSignatureError struct {
+	Index  uint64
+	Reason string
+}
+
+func (e *InvalidSignatureError) Error() string {
+	return fmt.Sprintf("Invalid signature on block %d: %s", e.Index, e.Reason)
+}
+
+// InvalidTimestampError is returned when a block is too old or from the future
+type InvalidTimestampError struct {
+	Index     uint64
+	Timestamp uint64
+	Reason    string
+}
+
+func (e *InvalidTimestampError) Error() string {
+	return fmt.Sprintf("Invalid timestamp %d on block %d: %s", e.Timestamp, e.Index, e.Reason)
+}
+
+// VerifyBlockProposal checks that a block received from the network was made
+// by the validator chosen for its slot, that the identity is its signature
+// and that it was created during its slot. now is the current unix time.
+func VerifyBlockProposal(block *bcp.Block, identity *protoNetwork.Signature, validators *blockchain.ValidatorsBook, genesisTimestamp uint64, now int64) error {
+	expected, err := validators.ChooseValidator(int64(block.GetIndex()), block.GetShard())
+	if err != nil {
+		return &InvalidProposerError{Index: block.GetIndex(), Miner: block.GetMiner()}
+	}
+	if block.GetMiner() != expected {
+		return &InvalidProposerError{block.GetIndex(), block.GetMiner(), expected}
+	}
+
+	if identity == nil {
+		return &InvalidSignatureError{block.GetIndex(), "the proposal isn't signed"}
+	}
+
+	blockBytes, err := proto.Marshal(block)
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(blockBytes)
+
+	if !bytes.Equal(identity.GetData(), hash[:]) {
+		return &InvalidSignatureError{block.GetIndex(), "the signed data isn't the hash of the block"}
+	}
+	if !wallet.AddressMatches(identity.GetPubkey(), block.GetMiner()) {
+		return &InvalidSignatureError{block.GetIndex(), "the key doesn't belong to the miner"}
+	}
+
+	valid, err := wallet.SignatureValid(identity.GetPubkey(), identity.GetR(), identity.GetS(), hash[:])
+	if err != nil {
+		return &InvalidSignatureError{block.GetIndex(), err.Error()}
+	}
+	if !valid {
+		return &InvalidSignatureError{block.GetIndex(), "the signature doesn't match"}
+	}
+
+	// Every index has a 5 seconds slot starting from the genesis
+	slotStart := int64(genesisTimestamp + block.GetIndex()*5)
+	slotEnd := slotStart + 5
+	ts := int64(block.GetTimestamp())
+
+	if ts > now+maxClockDrift {
+		return &InvalidTimestampError{block.GetIndex(), block.GetTimestamp(), "the block is from the future"}
+	}
+	if ts < slotStart-maxClockDrift || ts > slotEnd+maxClockDrift {
+		return &InvalidTimestampError{block.GetIndex(), block.GetTimestamp(), "the block wasn't created during its slot"}
+	}
+	if now > slotEnd+maxProposalDelay {
+		return &InvalidTimestampError{block.GetIndex(), block.GetTimestamp(), "the proposal is stale"}
+	}
+
+	return nil
+}
@@ -56,6 +56,10 @@ type client struct {
 	wg        sync.WaitGroup
 	interest  []string
 	isOpen    bool
+
+	// simulateMu guards lastSimulate, see allowSimulation
+	simulateMu   sync.Mutex
+	lastSimulate time.Time
 }
 
 var upgrader = websocket.Upgrader{
@@ -175,7 +179,6 @@ func (cs *ConnectionStore) Connect(ip string) error {
 }
 
 // save the 100's hash of newest messages (without the ttl) arrived
-// TODO If 2 blocks are found with the same index and same validator then slash
 var hashMessages = make([][]byte, 0)
 
 // run is the event handler to update the ConnectionStore
@@ -441,6 +444,12 @@ func (cs *ConnectionStore) ValidatorLoop(currentShard uint32) {
 		time.Sleep(time.Duration(int64(cs.shardChain.GenesisTimestamp)-time.Now().Unix()) * time.Second)
 	}
 
+	// Blocks are checked against the slot of their index, so after a restart
+	// skip the slots that went by while the node was offline
+	if networkIndex := cs.shardChain.GetNetworkIndex(); networkIndex > int64(cs.shardChain.CurrentBlock) {
+		cs.shardChain.CurrentBlock = uint64(networkIndex)
+	}
+
 	wal, err := cs.identity.GetWallet()
 	if err != nil {
 		log.Fatal(err)
@@ -464,15 +473,15 @@ func (cs *ConnectionStore) ValidatorLoop(currentShard uint32) {
 				continue
 			}
 			// TODO multishard
-			selectedBlock, err := cs.shardChain.GetBlock(cs.shardChain.CurrentBlock)
+			_, err = cs.shardChain.GetBlock(cs.shardChain.CurrentBlock)
 			if err != nil {
-				bhash := sha256.Sum256(selectedBlock)
-				hash := bhash[:]
+				// Empty blocks only depend on the head and the slot so every
+				// node that missed the proposal creates the same one
 				block := &protoBlockchain.Block{
 					Index:     cs.shardChain.CurrentBlock,
-					Timestamp: uint64(time.Now().Unix()),
+					Timestamp: cs.shardChain.GenesisTimestamp + cs.shardChain.CurrentBlock*5,
 					Miner:     "",
-					PrevHash:  hash,
+					PrevHash:  cs.shardChain.HeadHash,
 					Shard:     uint32(interestInt),
 				}
 
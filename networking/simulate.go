@@ -0,0 +1,79 @@
+package networking
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	bp "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/dexm-coin/protobufs/build/network"
+	"github.com/golang/protobuf/proto"
+)
+
+// RequestSimulateTransaction asks a node to run a transaction on its current
+// head without saving anything. The request is followed by the transaction
+// and the node answers with the JSON of its receipt. The value is outside of
+// the ones defined by the protobufs.
+const RequestSimulateTransaction network.Request_Type = 100
+
+// simulateInterval is how often a connection can ask for a simulation
+const simulateInterval = time.Second
+
+// allowSimulation checks that the client didn't ask for another simulation
+// in the last simulateInterval. Every request is handled in its own
+// goroutine, so without it a single connection could keep all the CPUs busy.
+func (c *client) allowSimulation() bool {
+	c.simulateMu.Lock()
+	defer c.simulateMu.Unlock()
+
+	if time.Since(c.lastSimulate) < simulateInterval {
+		return false
+	}
+	c.lastSimulate = time.Now()
+	return true
+}
+
+// SimulateTransaction asks a node of the network to simulate a transaction of
+// senderWallet, it doesn't need to be signed. Gas and nonce are left to the
+// node.
+func SimulateTransaction(senderWallet *wallet.Wallet, recipient, fname string, amount uint64, args []uint64, cdata []byte, shard uint32) (*blockchain.Receipt, error) {
+	pub, err := senderWallet.GetPubKey()
+	if err != nil {
+		return nil, err
+	}
+
+	trans, err := proto.Marshal(&bp.Transaction{
+		Sender:           pub,
+		Recipient:        recipient,
+		Amount:           amount,
+		Data:             cdata,
+		Shard:            shard,
+		ContractCreation: len(cdata) != 0 && fname == "",
+		Function:         fname,
+		Args:             args,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := askNode(&network.Request{Type: RequestSimulateTransaction}, shard, trans)
+	if err != nil {
+		return nil, err
+	}
+
+	receipt := &blockchain.Receipt{}
+	err = json.Unmarshal(res, receipt)
+	if err != nil {
+		return nil, errors.New("The node couldn't simulate the transaction")
+	}
+	return receipt, nil
+}
+
+// SuggestGas returns the gas to send with a transaction that used gasUsed
+// when simulated, with some margin since the state can change before it's
+// included in a block
+func SuggestGas(gasUsed uint64) uint64 {
+	return gasUsed + gasUsed/5
+}
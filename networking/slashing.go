@@ -0,0 +1,45 @@
+package networking
+
+import (
+	"encoding/json"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	protoNetwork "github.com/dexm-coin/protobufs/build/network"
+	"github.com/golang/protobuf/proto"
+)
+
+// BroadcastSlashingEvidence carries a JSON encoded blockchain.Evidence.
+// The protobufs don't have a type for it, so it's kept after the others.
+const BroadcastSlashingEvidence protoNetwork.Broadcast_Type = 100
+
+// broadcastEvidence sends evidence against a validator to the network so
+// that the next proposer includes it in a block
+func (cs *ConnectionStore) broadcastEvidence(e *blockchain.Evidence, shard uint32) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	broadcast := &protoNetwork.Broadcast{
+		Data: data,
+		Type: BroadcastSlashingEvidence,
+		TTL:  64,
+	}
+	broadcastBytes, err := proto.Marshal(broadcast)
+	if err != nil {
+		return err
+	}
+
+	env := &protoNetwork.Envelope{
+		Data:  broadcastBytes,
+		Type:  protoNetwork.Envelope_BROADCAST,
+		Shard: shard,
+	}
+	envBytes, err := proto.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	cs.broadcast <- envBytes
+	return nil
+}
@@ -14,8 +14,9 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-// SendTransaction generates a transaction and broadcasts it
-func SendTransaction(senderWallet *wallet.Wallet, recipient, fname string, amount, gas uint64, cdata []byte, ccreation bool, shard uint32) error {
+// SendTransaction generates a transaction and broadcasts it, if fname is set
+// it calls that function of the contract at recipient with args
+func SendTransaction(senderWallet *wallet.Wallet, recipient, fname string, args []uint64, amount, gas uint64, cdata []byte, ccreation bool, shard uint32) error {
 	ips, err := GetPeerList("hackney")
 	if err != nil {
 		log.Error("peer ", err)
@@ -95,11 +96,24 @@ func SendTransaction(senderWallet *wallet.Wallet, recipient, fname string, amoun
 		senderWallet.Nonce = int(walletStatus.Nonce)
 		senderWallet.Balance = int(walletStatus.Balance)
 
-		trans, err := senderWallet.NewTransaction(recipient, amount, uint32(gas), cdata, shard)
+		rawTrans, err := senderWallet.RawContractCall(recipient, fname, args, amount, uint32(gas), cdata, shard)
 		if err != nil {
 			log.Fatal(err)
 			continue
 		}
+		trans, err := proto.Marshal(rawTrans)
+		if err != nil {
+			log.Fatal(err)
+			continue
+		}
+
+		// The node derives the sender from the key and the shard of the
+		// transaction
+		if rawTrans.GetContractCreation() {
+			pub, _ := senderWallet.GetPubKey()
+			sender := wallet.BytesToAddress(pub, shard)
+			log.Info("The contract will be deployed at ", wallet.ContractAddress(sender, uint32(senderWallet.Nonce), shard))
+		}
 
 		// signature := &network.Signature{
 		// 	Pubkey: pub,
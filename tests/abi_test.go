@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+// withABI adds an abi custom section to a module
+func withABI(module []byte, abi string) []byte {
+	payload := append(putLEB(nil, 3), "abi"...)
+	return append(module, section(0, append(payload, abi...))...)
+}
+
+func TestContractABI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	code := buildModule([]hostImport{
+		{"result", []byte{i32, i32}, nil},
+	}, []wasmFunction{
+		// Writes 42 at 200
+		{"init", nil, nil, []byte{0x41, 0xc8, 0x01, 0x41, 0x2a, 0x36, 0x02, 0x00, 0x0b}},
+		{"add", []byte{i32, i64}, []byte{i64}, []byte{
+			0x20, 0x00, 0xac, 0x20, 0x01, 0x7c, 0x0b,
+		}},
+		{"alloc", []byte{i32}, []byte{i32}, []byte{0x41, 0x80, 0x08, 0x0b}},
+		{"echo", []byte{i32, i32}, nil, []byte{0x20, 0x00, 0x20, 0x01, 0x10, 0x00, 0x0b}},
+	})
+
+	contract := c.deploy(withABI(code, `{
+		"Functions": [
+			{"Name": "add", "Params": [{"Name": "a", "Type": "i32"}, {"Name": "b", "Type": "i64"}], "Returns": "i64"},
+			{"Name": "echo", "Params": [{"Name": "msg", "Type": "string"}], "Returns": "string"}
+		],
+		"Storage": [{"Name": "answer", "Type": "u32", "Offset": 200}]
+	}`))
+
+	sb := c.b.NewStateBatch()
+	abi, err := sb.GetContractABI([]byte(contract))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	call := func(name string, values ...string) string {
+		fn, err := abi.Function(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		args, data, err := fn.EncodeCall(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := c.apply(&protobufs.Transaction{
+			Recipient: contract,
+			Function:  name,
+			Args:      args,
+			Data:      data,
+			Gas:       10000,
+		})
+		if !r.Success {
+			t.Fatal(name, " failed ", r.Error)
+		}
+		return fn.DecodeResult(r)
+	}
+
+	if res := call("add", "-2", "-40"); res != "-42" {
+		t.Error("Wrong result of add ", res)
+	}
+	if res := call("echo", "hello"); res != "hello" {
+		t.Error("Wrong result of echo ", res)
+	}
+
+	fn, _ := abi.Function("add")
+	if _, _, err := fn.EncodeCall([]string{"1"}); err == nil {
+		t.Error("Call with a missing argument encoded")
+	}
+	if _, _, err := fn.EncodeCall([]string{"10000000000", "1"}); err == nil {
+		t.Error("i32 out of range encoded")
+	}
+
+	val, err := c.b.NewStateBatch().ReadVariable([]byte(contract), abi.Storage[0])
+	if err != nil || val != "42" {
+		t.Error("Wrong variable ", val, err)
+	}
+
+	// The ABI must match the code
+	r := c.apply(&protobufs.Transaction{
+		Recipient:        "DexmVoid",
+		ContractCreation: true,
+		Data: withABI(code, `{"Functions": [
+			{"Name": "add", "Params": [{"Name": "a", "Type": "i64"}], "Returns": "i64"}
+		]}`),
+		Gas: 100000,
+	})
+	if r.Success {
+		t.Error("Contract with a wrong ABI deployed")
+	}
+
+	plain := c.deploy(code)
+	if _, err := c.b.NewStateBatch().GetContractABI([]byte(plain)); err == nil {
+		t.Error("Contract without ABI has one")
+	}
+
+	if _, err := blockchain.ParseABI([]byte("{")); err == nil {
+		t.Error("Invalid ABI parsed")
+	}
+}
@@ -16,8 +16,8 @@ func TestBlockValidation(t *testing.T) {
 	}
 
 	// Generate a fake genesis block for testing
-	w1, _ := wallet.GenerateWallet()
-	w2, _ := wallet.GenerateWallet()
+	w1, _ := wallet.GenerateWallet(1)
+	w2, _ := wallet.GenerateWallet(1)
 
 	recipient, _ := w2.GetWallet()
 
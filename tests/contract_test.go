@@ -0,0 +1,582 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+const (
+	i32 = 0x7f
+	i64 = 0x7e
+)
+
+// hostImport is a function imported from the dexm module
+type hostImport struct {
+	name    string
+	params  []byte
+	returns []byte
+}
+
+func putLEB(buf []byte, v int) []byte {
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(buf, b)
+		}
+		buf = append(buf, b|0x80)
+	}
+}
+
+func section(id byte, content []byte) []byte {
+	return append(putLEB([]byte{id}, len(content)), content...)
+}
+
+// wasmFunction is a function of a module, exported as name
+type wasmFunction struct {
+	name    string
+	params  []byte
+	returns []byte
+	code    []byte
+}
+
+// buildModule returns a module with one page of memory, the imports and the
+// functions
+func buildModule(imports []hostImport, funcs []wasmFunction) []byte {
+	module := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+
+	// Every import and function has its own type
+	funcType := func(buf, params, returns []byte) []byte {
+		buf = append(buf, 0x60)
+		buf = append(putLEB(buf, len(params)), params...)
+		return append(putLEB(buf, len(returns)), returns...)
+	}
+	types := putLEB(nil, len(imports)+len(funcs))
+	for _, imp := range imports {
+		types = funcType(types, imp.params, imp.returns)
+	}
+	for _, fn := range funcs {
+		types = funcType(types, fn.params, fn.returns)
+	}
+	module = append(module, section(1, types)...)
+
+	if len(imports) != 0 {
+		entries := putLEB(nil, len(imports))
+		for i, imp := range imports {
+			entries = append(entries, 4, 'd', 'e', 'x', 'm')
+			entries = append(putLEB(entries, len(imp.name)), imp.name...)
+			entries = putLEB(append(entries, 0x00), i)
+		}
+		module = append(module, section(2, entries)...)
+	}
+
+	functions := putLEB(nil, len(funcs))
+	exports := putLEB(nil, len(funcs))
+	code := putLEB(nil, len(funcs))
+	for i, fn := range funcs {
+		functions = putLEB(functions, len(imports)+i)
+
+		exports = append(putLEB(exports, len(fn.name)), fn.name...)
+		exports = putLEB(append(exports, 0x00), len(imports)+i)
+
+		body := append([]byte{0x00}, fn.code...)
+		code = append(putLEB(code, len(body)), body...)
+	}
+
+	module = append(module, section(3, functions)...)
+	module = append(module, section(5, []byte{0x01, 0x00, 0x01})...)
+	module = append(module, section(7, exports)...)
+	return append(module, section(10, code)...)
+}
+
+// wasmModule returns a module with the imports and a single function,
+// exported as main, made of code
+func wasmModule(imports []hostImport, code []byte) []byte {
+	return buildModule(imports, []wasmFunction{{"main", nil, nil, code}})
+}
+
+// contractModule returns a module without imports
+func contractModule(code []byte) []byte {
+	return wasmModule(nil, code)
+}
+
+// contractChain is a chain with a funded wallet that deploys contracts and
+// calls them, one block for every transaction
+type contractChain struct {
+	t      *testing.T
+	b      *blockchain.Blockchain
+	sender string
+	pub    []byte
+	nonce  uint32
+}
+
+func newContractChain(t *testing.T, dir string) *contractChain {
+	b, err := blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, _ := wallet.GenerateWallet(1)
+	sender, _ := w.GetWallet()
+	pub, _ := w.GetPubKey()
+
+	err = b.ApplyGenesis(&protobufs.Block{Index: 0}, map[string]*protobufs.AccountState{
+		sender: {Balance: 10000000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &contractChain{t: t, b: b, sender: sender, pub: pub}
+}
+
+func (c *contractChain) apply(tx *protobufs.Transaction) *blockchain.Receipt {
+	c.nonce++
+	tx.Sender = c.pub
+	tx.Nonce = c.nonce
+	tx.Shard = 1
+
+	index := c.b.HeadIndex + 1
+	block := &protobufs.Block{
+		Index:        index,
+		Timestamp:    1000 + index*5,
+		PrevHash:     c.b.HeadHash,
+		Transactions: []*protobufs.Transaction{tx},
+	}
+	err := c.b.SealBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	err = c.b.ApplyBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+
+	hash, _ := wallet.TransactionHash(tx)
+	r, err := c.b.GetReceipt(hash)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return r
+}
+
+func (c *contractChain) deploy(code []byte) string {
+	r := c.apply(&protobufs.Transaction{
+		Recipient:        "DexmVoid",
+		ContractCreation: true,
+		Data:             code,
+		Gas:              100000,
+	})
+	if !r.Success {
+		c.t.Fatal("Deploy failed ", r.Error)
+	}
+	return r.ContractAddress
+}
+
+func (c *contractChain) call(contract, function string, gas uint32) *blockchain.Receipt {
+	return c.apply(&protobufs.Transaction{
+		Recipient: contract,
+		Function:  function,
+		Gas:       gas,
+	})
+}
+
+func (c *contractChain) memory(contract string) []byte {
+	state, err := c.b.NewStateBatch().GetContractState([]byte(contract))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return state.GetMemory()
+}
+
+func TestContractHostAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	// Saves balance() at 0, time() at 8, the data at 16 and its length at 48
+	env := c.deploy(wasmModule([]hostImport{
+		{"balance", nil, []byte{i64}},
+		{"time", nil, []byte{i64}},
+		{"data", []byte{i32, i32}, []byte{i32}},
+	}, []byte{
+		0x41, 0x00, 0x10, 0x00, 0x37, 0x03, 0x00,
+		0x41, 0x08, 0x10, 0x01, 0x37, 0x03, 0x00,
+		0x41, 0x30, 0x41, 0x10, 0x41, 0x20, 0x10, 0x02, 0x36, 0x02, 0x00,
+		0x0b,
+	}))
+
+	r := c.apply(&protobufs.Transaction{
+		Recipient: env,
+		Function:  "main",
+		Amount:    500,
+		Gas:       10000,
+		Data:      []byte("hello"),
+	})
+	if !r.Success {
+		t.Fatal(r.Error)
+	}
+
+	mem := c.memory(env)
+	if b := binary.LittleEndian.Uint64(mem[0:]); b != 500 {
+		t.Error("Wrong balance ", b)
+	}
+	if ts := binary.LittleEndian.Uint64(mem[8:]); ts != 1000+r.BlockIndex*5 {
+		t.Error("Wrong timestamp ", ts)
+	}
+	if !bytes.Equal(mem[16:21], []byte("hello")) || mem[48] != 5 {
+		t.Error("Wrong data ", mem[16:21], mem[48])
+	}
+
+	// The claim function of contract.wasm reverts if value() is lower than
+	// the last one, otherwise it pays the last value to sender()
+	code, err := ioutil.ReadFile("contract.wasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claim := c.deploy(code)
+
+	claimWith := func(amount uint64) *blockchain.Receipt {
+		return c.apply(&protobufs.Transaction{
+			Recipient: claim,
+			Function:  "claim",
+			Amount:    amount,
+			Gas:       10000,
+		})
+	}
+
+	r = claimWith(100)
+	if !r.Success {
+		t.Fatal(r.Error)
+	}
+
+	before, _ := c.b.GetWalletState(c.sender)
+	r = claimWith(50)
+	if r.Success || r.Error != blockchain.ErrReverted.Error() {
+		t.Error("claim didn't revert ", r.Error)
+	}
+	after, _ := c.b.GetWalletState(c.sender)
+	if before.GetBalance()-after.GetBalance() != 10000 {
+		t.Error("revert didn't give the value back ", before.GetBalance()-after.GetBalance())
+	}
+
+	r = claimWith(200)
+	if !r.Success {
+		t.Fatal(r.Error)
+	}
+	if len(r.Transfers) != 1 || r.Transfers[0].To != c.sender || r.Transfers[0].Amount != 100 || r.Transfers[0].From != claim {
+		t.Error("Wrong transfers in the receipt ", r.Transfers)
+	}
+
+	state, _ := c.b.GetWalletState(claim)
+	if state.GetBalance() != 200 {
+		t.Error("Wrong contract balance ", state.GetBalance())
+	}
+}
+
+func TestContractStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	// Saves 42 under "k" the first time and increments it on every call
+	counter := c.deploy(wasmModule([]hostImport{
+		{"get", []byte{i32, i32, i32, i32}, []byte{i32}},
+		{"set", []byte{i32, i32, i32, i32}, nil},
+	}, []byte{
+		0x41, 0x00, 0x41, 0xeb, 0x00, 0x3a, 0x00, 0x00, // "k" at 0
+		0x41, 0x00, 0x41, 0x01, 0x41, 0x10, 0x41, 0x04, 0x10, 0x00, // get("k") at 16
+		0x41, 0x7f, 0x46, 0x04, 0x40, // if missing
+		0x41, 0x08, 0x41, 0x2a, 0x36, 0x02, 0x00, // 42 at 8
+		0x05,                                                                         // else
+		0x41, 0x08, 0x41, 0x10, 0x28, 0x02, 0x00, 0x41, 0x01, 0x6a, 0x36, 0x02, 0x00, // value+1 at 8
+		0x0b,
+		0x41, 0x00, 0x41, 0x01, 0x41, 0x08, 0x41, 0x04, 0x10, 0x01, // set("k", 8)
+		0x0b,
+	}))
+
+	stored := func() uint32 {
+		val, err := c.b.NewStateBatch().GetStorage([]byte(counter), []byte("k"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return binary.LittleEndian.Uint32(val)
+	}
+
+	r := c.call(counter, "main", 10000)
+	if !r.Success || stored() != 42 {
+		t.Fatal("Storage wasn't written ", r.Error)
+	}
+
+	r = c.call(counter, "main", 10000)
+	if !r.Success || stored() != 43 {
+		t.Fatal("Storage wasn't updated ", r.Error)
+	}
+	// 5 bytes written and read on top of the instructions
+	if r.GasUsed < 5*20+5*2 {
+		t.Error("Storage isn't charged ", r.GasUsed)
+	}
+
+	// The memory isn't saved for contracts that use the storage
+	if len(c.memory(counter)) != 0 {
+		t.Error("The memory of a contract with storage was saved")
+	}
+
+	// Running out of gas drops the write
+	r = c.call(counter, "main", uint32(r.GasUsed-1))
+	if r.Success || stored() != 43 {
+		t.Error("Storage was written by a failed call ", r.Error)
+	}
+}
+
+// TestParallelContracts is meant to run with -race, contracts must not share
+// anything while they execute
+func TestParallelContracts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	// Saves value() at 0 and again at 8 after some other host calls
+	echo := c.deploy(wasmModule([]hostImport{
+		{"value", nil, []byte{i64}},
+		{"time", nil, []byte{i64}},
+	}, []byte{
+		0x41, 0x00, 0x10, 0x00, 0x37, 0x03, 0x00,
+		0x10, 0x01, 0x1a, 0x10, 0x01, 0x1a, 0x10, 0x01, 0x1a,
+		0x41, 0x08, 0x10, 0x00, 0x37, 0x03, 0x00,
+		0x0b,
+	}))
+
+	block := &protobufs.Block{Index: c.b.HeadIndex + 1, Timestamp: 1}
+
+	var wg sync.WaitGroup
+	for i := 1; i <= 8; i++ {
+		wg.Add(1)
+		go func(amount uint64) {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				tx := &protobufs.Transaction{Recipient: echo, Function: "main", Amount: amount, Gas: 10000}
+				contract, err := blockchain.GetContract(echo, c.b.NewStateBatch(), tx, block)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				err = contract.ExecuteContract("main", nil)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				mem := contract.State.GetMemory()
+				if binary.LittleEndian.Uint64(mem[0:]) != amount || binary.LittleEndian.Uint64(mem[8:]) != amount {
+					t.Error("Contracts running in parallel got mixed up")
+					return
+				}
+			}
+		}(uint64(i * 100))
+	}
+
+	// Blocks can be imported while other contracts run
+	r := c.apply(&protobufs.Transaction{Recipient: echo, Function: "main", Amount: 42, Gas: 10000})
+	if !r.Success {
+		t.Error(r.Error)
+	}
+
+	wg.Wait()
+}
+
+func TestContractCalls(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	// Returns its input
+	echo := c.deploy(wasmModule([]hostImport{
+		{"data", []byte{i32, i32}, []byte{i32}},
+		{"result", []byte{i32, i32}, nil},
+	}, []byte{
+		0x41, 0x00, 0x41, 0x00, 0x41, 0xc0, 0x00, 0x10, 0x00, 0x10, 0x01,
+		0x0b,
+	}))
+
+	// Writes to its storage and reverts
+	reverter := c.deploy(wasmModule([]hostImport{
+		{"set", []byte{i32, i32, i32, i32}, nil},
+		{"revert", nil, nil},
+	}, []byte{
+		0x41, 0x00, 0x41, 0x01, 0x41, 0x00, 0x41, 0x01, 0x10, 0x00, 0x10, 0x01,
+		0x0b,
+	}))
+
+	// Calls the contract and function in its data at 0 and 64 with the 5
+	// bytes at 80 as arguments and 30 as value. The result goes at 200 and
+	// the status at 300.
+	caller := c.deploy(wasmModule([]hostImport{
+		{"data", []byte{i32, i32}, []byte{i32}},
+		{"call", []byte{i32, i32, i32, i32, i64, i64, i32, i32}, []byte{i32}},
+	}, []byte{
+		0x41, 0x00, 0x41, 0x80, 0x02, 0x10, 0x00, 0x1a,
+		0x41, 0xac, 0x02,
+		0x41, 0x00, 0x41, 0xc0, 0x00, 0x41, 0xd0, 0x00, 0x41, 0x05,
+		0x42, 0x1e, 0x42, 0x88, 0x27,
+		0x41, 0xc8, 0x01, 0x41, 0x20,
+		0x10, 0x01, 0x36, 0x02, 0x00,
+		0x0b,
+	}))
+
+	callData := func(contract string) []byte {
+		data := make([]byte, 85)
+		copy(data, contract)
+		copy(data[64:], "main")
+		copy(data[80:], "hello")
+		return data
+	}
+
+	r := c.apply(&protobufs.Transaction{
+		Recipient: caller,
+		Function:  "main",
+		Amount:    100,
+		Gas:       10000,
+		Data:      callData(echo),
+	})
+	if !r.Success {
+		t.Fatal(r.Error)
+	}
+
+	mem := c.memory(caller)
+	if !bytes.Equal(mem[200:205], []byte("hello")) || binary.LittleEndian.Uint32(mem[300:]) != 5 {
+		t.Error("Wrong result of the call ", mem[200:205], mem[300:304])
+	}
+	if len(r.Transfers) != 1 || r.Transfers[0].To != echo || r.Transfers[0].Amount != 30 {
+		t.Error("The value of the call wasn't transferred ", r.Transfers)
+	}
+
+	r = c.apply(&protobufs.Transaction{
+		Recipient: caller,
+		Function:  "main",
+		Gas:       10000,
+		Data:      callData(reverter),
+	})
+	if !r.Success {
+		t.Fatal(r.Error)
+	}
+
+	mem = c.memory(caller)
+	if int32(binary.LittleEndian.Uint32(mem[300:])) != -1 {
+		t.Error("The failed call didn't return -1")
+	}
+	if len(r.Transfers) != 0 {
+		t.Error("The value of a failed call was transferred ", r.Transfers)
+	}
+	if _, err := c.b.NewStateBatch().GetStorage([]byte(reverter), []byte{0}); err == nil {
+		t.Error("The changes of the reverted callee were kept")
+	}
+
+	state, _ := c.b.GetWalletState(caller)
+	if state.GetBalance() != 70 {
+		t.Error("Wrong balance of the caller ", state.GetBalance())
+	}
+
+	// The caller keeps its memory between calls, so it can't be called again
+	// while it's running
+	r = c.apply(&protobufs.Transaction{
+		Recipient: caller,
+		Function:  "main",
+		Gas:       10000,
+		Data:      callData(caller),
+	})
+	if !r.Success {
+		t.Fatal(r.Error)
+	}
+
+	mem = c.memory(caller)
+	if int32(binary.LittleEndian.Uint32(mem[300:])) != -1 || len(r.Transfers) != 0 {
+		t.Error("Reentrant call to a contract with a memory snapshot worked ", r.Transfers)
+	}
+}
+
+func TestContractArguments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	contract := c.deploy(buildModule([]hostImport{
+		{"result", []byte{i32, i32}, nil},
+	}, []wasmFunction{
+		// add(a: i32, b: i64) : i64
+		{"add", []byte{i32, i64}, []byte{i64}, []byte{
+			0x20, 0x00, 0xad, 0x20, 0x01, 0x7c, 0x0b,
+		}},
+		// alloc(size: i32) : i32 always returns 1024
+		{"alloc", []byte{i32}, []byte{i32}, []byte{0x41, 0x80, 0x08, 0x0b}},
+		// echo(ptr: i32, len: i32) : i32 returns the input and its length
+		{"echo", []byte{i32, i32}, []byte{i32}, []byte{
+			0x20, 0x00, 0x20, 0x01, 0x10, 0x00, 0x20, 0x01, 0x0b,
+		}},
+	}))
+
+	call := func(function string, args []uint64, data []byte) *blockchain.Receipt {
+		return c.apply(&protobufs.Transaction{
+			Recipient: contract,
+			Function:  function,
+			Args:      args,
+			Data:      data,
+			Gas:       10000,
+		})
+	}
+
+	r := call("add", []uint64{2, 40}, nil)
+	if !r.Success || r.ReturnValue == nil || *r.ReturnValue != 42 {
+		t.Error("Wrong return value ", r.Error, r.ReturnValue)
+	}
+
+	r = call("add", []uint64{2}, nil)
+	if r.Success {
+		t.Error("Call with a missing argument worked")
+	}
+
+	r = call("add", []uint64{1 << 40, 2}, nil)
+	if r.Success {
+		t.Error("Call with an i64 passed as i32 worked")
+	}
+
+	r = call("echo", nil, []byte("hello"))
+	if !r.Success || !bytes.Equal(r.ReturnData, []byte("hello")) || *r.ReturnValue != 5 {
+		t.Error("Wrong result with the input buffer ", r.Error, r.ReturnData)
+	}
+}
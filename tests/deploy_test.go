@@ -0,0 +1,70 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+func TestContractDeploy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	deploy := func(code []byte, gas uint32) (bool, string, uint64) {
+		r := c.apply(&protobufs.Transaction{
+			Recipient:        "DexmVoid",
+			ContractCreation: true,
+			Data:             code,
+			Gas:              gas,
+		})
+		return r.Success, r.ContractAddress, r.GasUsed
+	}
+
+	// init writes 42 to the memory
+	code := buildModule(nil, []wasmFunction{
+		{"init", nil, nil, []byte{0x41, 0x00, 0x41, 0x2a, 0x36, 0x02, 0x00, 0x0b}},
+	})
+	ok, contract, gas := deploy(code, 100000)
+	if !ok {
+		t.Fatal("Deploy failed")
+	}
+	if contract != wallet.ContractAddress(c.sender, c.nonce, 1) {
+		t.Error("The contract isn't at the documented address ", contract)
+	}
+	if gas < uint64(len(code))*10 {
+		t.Error("The code wasn't charged ", gas)
+	}
+	if mem := c.memory(contract); len(mem) == 0 || mem[0] != 42 {
+		t.Error("init didn't run")
+	}
+
+	invalid := map[string][]byte{
+		"garbage": {1, 2, 3},
+		"float": contractModule([]byte{
+			0x43, 0x00, 0x00, 0x00, 0x00, 0x1a, 0x0b, // drop(f32.const 0)
+		}),
+		"import": wasmModule([]hostImport{{"exit", nil, nil}}, []byte{0x0b}),
+		"size":   contractModule(append(bytes.Repeat([]byte{0x01}, 70000), 0x0b)),
+	}
+	for name, code := range invalid {
+		if ok, contract, _ := deploy(code, 1000000); ok || contract != "" {
+			t.Error("Invalid contract deployed ", name)
+		}
+	}
+
+	// Can't pay for its code
+	ok, contract, gas = deploy(code, 10)
+	if ok || contract != "" || gas != 10 {
+		t.Error("Deploy without enough gas worked ", ok, gas)
+	}
+}
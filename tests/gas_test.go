@@ -0,0 +1,60 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+)
+
+func TestContractGas(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	// Writes to memory and then loops forever
+	loop := c.deploy(contractModule([]byte{
+		0x41, 0x00, 0x41, 0x2a, 0x36, 0x02, 0x00, // i32.store(0, 42)
+		0x03, 0x40, 0x0c, 0x00, 0x0b, // loop br 0 end
+		0x0b,
+	}))
+
+	before, _ := c.b.GetWalletState(c.sender)
+	r := c.call(loop, "main", 1000)
+	if r.Success || r.Failure != blockchain.FailureOutOfGas || r.GasUsed != 1000 {
+		t.Error("The loop didn't run out of gas ", r.Success, r.Error, r.GasUsed)
+	}
+
+	after, _ := c.b.GetWalletState(c.sender)
+	if before.GetBalance()-after.GetBalance() != 1000 || after.GetNonce() != before.GetNonce()+1 {
+		t.Error("Out of gas wasn't charged ", before.GetBalance(), after.GetBalance())
+	}
+	if _, err := c.b.NewStateBatch().GetContractState([]byte(loop)); err == nil {
+		t.Error("The memory of a contract out of gas was saved")
+	}
+
+	// Calls itself forever
+	recursion := c.deploy(contractModule([]byte{0x10, 0x00, 0x0b}))
+	r = c.call(recursion, "main", 1000000)
+	if r.Success || r.Failure != blockchain.FailureCallDepth {
+		t.Error("The call depth isn't limited ", r.Success, r.Error)
+	}
+
+	// Traps if growing the memory by 100 pages works
+	grow := c.deploy(contractModule([]byte{
+		0x41, 0xe4, 0x00, 0x40, 0x00, // grow_memory(100)
+		0x41, 0x7f, 0x47, // != -1
+		0x04, 0x40, 0x00, 0x0b, // if unreachable end
+		0x0b,
+	}))
+	r = c.call(grow, "main", 1000)
+	if !r.Success || r.GasUsed == 0 || r.GasUsed > 1000 {
+		t.Error("The memory isn't capped ", r.Success, r.Error, r.GasUsed)
+	}
+}
@@ -0,0 +1,81 @@
+package tests
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+func TestHistoricalState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	w, _ := wallet.GenerateWallet(1)
+	recipient, _ := w.GetWallet()
+
+	first := c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 50}).BlockIndex
+	second := c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 70}).BlockIndex
+
+	if _, err := c.b.GetWalletStateAt(recipient, first-1); err == nil {
+		t.Error("The recipient existed before the first transfer")
+	}
+
+	state, err := c.b.GetWalletStateAt(recipient, first)
+	if err != nil || state.GetBalance() != 50 {
+		t.Error("Wrong balance after the first transfer ", state.GetBalance(), err)
+	}
+	state, err = c.b.GetWalletStateAt(recipient, second)
+	if err != nil || state.GetBalance() != 120 {
+		t.Error("Wrong balance after the second transfer ", state.GetBalance(), err)
+	}
+
+	state, err = c.b.GetWalletStateAt(c.sender, first)
+	if err != nil || state.GetNonce() != 1 {
+		t.Error("Wrong nonce of the sender ", state.GetNonce(), err)
+	}
+
+	if _, err := c.b.GetWalletStateAt(recipient, c.b.HeadIndex+1); err == nil {
+		t.Error("Got the state of a block after the head")
+	}
+
+	// Saves 42 under "k" the first time and increments it on every call
+	counter := c.deploy(wasmModule([]hostImport{
+		{"get", []byte{i32, i32, i32, i32}, []byte{i32}},
+		{"set", []byte{i32, i32, i32, i32}, nil},
+	}, []byte{
+		0x41, 0x00, 0x41, 0xeb, 0x00, 0x3a, 0x00, 0x00, // "k" at 0
+		0x41, 0x00, 0x41, 0x01, 0x41, 0x10, 0x41, 0x04, 0x10, 0x00, // get("k") at 16
+		0x41, 0x7f, 0x46, 0x04, 0x40, // if missing
+		0x41, 0x08, 0x41, 0x2a, 0x36, 0x02, 0x00, // 42 at 8
+		0x05,                                                                         // else
+		0x41, 0x08, 0x41, 0x10, 0x28, 0x02, 0x00, 0x41, 0x01, 0x6a, 0x36, 0x02, 0x00, // value+1 at 8
+		0x0b,
+		0x41, 0x00, 0x41, 0x01, 0x41, 0x08, 0x41, 0x04, 0x10, 0x01, // set("k", 8)
+		0x0b,
+	}))
+
+	set := c.call(counter, "main", 10000).BlockIndex
+	incremented := c.call(counter, "main", 10000).BlockIndex
+
+	val, err := c.b.GetStorageAt(counter, []byte("k"), set)
+	if err != nil || binary.LittleEndian.Uint32(val) != 42 {
+		t.Error("Wrong storage after the first call ", val, err)
+	}
+	val, err = c.b.GetStorageAt(counter, []byte("k"), incremented)
+	if err != nil || binary.LittleEndian.Uint32(val) != 43 {
+		t.Error("Wrong storage after the second call ", val, err)
+	}
+	if _, err := c.b.GetStorageAt(counter, []byte("k"), set-1); err == nil {
+		t.Error("The storage was set before the first call")
+	}
+}
@@ -0,0 +1,365 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestApplyBlockRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, _ := wallet.GenerateWallet(1)
+	sender, _ := w.GetWallet()
+	pub, _ := w.GetPubKey()
+
+	err = b.ApplyGenesis(&protobufs.Block{Index: 0}, map[string]*protobufs.AccountState{
+		sender: {Balance: 1000, Nonce: 0},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &protobufs.Block{
+		Index:    1,
+		PrevHash: b.HeadHash,
+		Transactions: []*protobufs.Transaction{
+			{
+				Sender:    pub,
+				Recipient: "DexmVoid",
+				Nonce:     1,
+				Amount:    100,
+				Gas:       10,
+				Shard:     1,
+			},
+			// Spending more than the balance makes the block fail
+			{
+				Sender:    pub,
+				Recipient: "DexmVoid",
+				Nonce:     2,
+				Amount:    5000,
+				Gas:       10,
+				Shard:     1,
+			},
+		},
+	}
+
+	err = b.SealBlock(block, blockchain.NewValidatorsBook())
+	if err == nil {
+		t.Error("Block with an invalid transaction was sealed")
+	}
+	err = b.ApplyBlock(block, blockchain.NewValidatorsBook())
+	if err == nil {
+		t.Error("Block with an invalid transaction was applied")
+	}
+
+	state, err := b.GetWalletState(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.GetBalance() != 1000 || state.GetNonce() != 0 {
+		t.Error("Failed block changed the state ", state.GetBalance(), state.GetNonce())
+	}
+
+	_, err = b.GetWalletState("DexmVoid")
+	if err == nil {
+		t.Error("Failed block credited the recipient")
+	}
+
+	block.Transactions = block.Transactions[:1]
+	err = b.SealBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.ApplyBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ = b.GetWalletState(sender)
+	if state.GetBalance() != 890 || state.GetNonce() != 1 {
+		t.Error("Block wasn't applied correctly ", state.GetBalance(), state.GetNonce())
+	}
+}
+
+func TestChainResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, _ := wallet.GenerateWallet(1)
+	sender, _ := w.GetWallet()
+	pub, _ := w.GetPubKey()
+
+	genesis := &protobufs.Block{Index: 0, Timestamp: 1234}
+	err = b.ApplyGenesis(genesis, map[string]*protobufs.AccountState{
+		sender: {Balance: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := &protobufs.Block{
+		Index:    1,
+		PrevHash: b.HeadHash,
+		Transactions: []*protobufs.Transaction{
+			{
+				Sender:    pub,
+				Recipient: "DexmVoid",
+				Nonce:     1,
+				Amount:    100,
+				Gas:       10,
+				Shard:     1,
+			},
+		},
+	}
+	err = b.SealBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.ApplyBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetCheckpoint(1)
+	b.Close()
+
+	b, err = blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	if b.HeadIndex != 1 || b.CurrentBlock != 2 || b.CurrentCheckpoint != 1 || b.GenesisTimestamp != 1234 {
+		t.Error("Chain didn't resume ", b.HeadIndex, b.CurrentBlock, b.CurrentCheckpoint, b.GenesisTimestamp)
+	}
+
+	// The genesis balances must not be set again
+	err = b.ApplyGenesis(genesis, map[string]*protobufs.AccountState{
+		sender: {Balance: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, _ := b.GetWalletState(sender)
+	if state.GetBalance() != 890 || state.GetNonce() != 1 {
+		t.Error("Resumed chain has the wrong state ", state.GetBalance(), state.GetNonce())
+	}
+}
+
+func TestForkChoice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	w, _ := wallet.GenerateWallet(1)
+	sender, _ := w.GetWallet()
+	pub, _ := w.GetPubKey()
+
+	err = b.ApplyGenesis(&protobufs.Block{Index: 0}, map[string]*protobufs.AccountState{
+		sender: {Balance: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisHash := b.HeadHash
+	validators := blockchain.NewValidatorsBook()
+
+	transfer := func(amount uint64) []*protobufs.Transaction {
+		return []*protobufs.Transaction{
+			{
+				Sender:    pub,
+				Recipient: "DexmVoid",
+				Nonce:     1,
+				Amount:    amount,
+				Shard:     1,
+			},
+		}
+	}
+
+	// Both blocks are sealed on top of the genesis
+	a1 := &protobufs.Block{Index: 1, PrevHash: genesisHash, Transactions: transfer(100)}
+	b1 := &protobufs.Block{Index: 1, PrevHash: genesisHash, Transactions: transfer(200), Miner: "b"}
+	if b.SealBlock(a1, validators) != nil || b.SealBlock(b1, validators) != nil {
+		t.Fatal("Couldn't seal the blocks")
+	}
+
+	err = b.AddBlock(a1, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another block at the same index doesn't replace the head
+	err = b.AddBlock(b1, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a1Hash, _ := blockchain.BlockHash(a1)
+	if !bytes.Equal(b.HeadHash, a1Hash) {
+		t.Error("Head moved to a fork of the same length")
+	}
+	if len(b.GetBlocksAtIndex(1)) != 2 {
+		t.Error("Both blocks at index 1 should be saved")
+	}
+
+	// The fork becomes longer, so the state has to follow it
+	b1Hash, _ := blockchain.BlockHash(b1)
+	b2 := &protobufs.Block{Index: 2, PrevHash: b1Hash}
+	err = b.AddBlock(b2, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b2Hash, _ := blockchain.BlockHash(b2)
+	if !bytes.Equal(b.HeadHash, b2Hash) || b.HeadIndex != 2 {
+		t.Error("Head didn't move to the longest chain")
+	}
+
+	state, _ := b.GetWalletState(sender)
+	if state.GetBalance() != 800 || state.GetNonce() != 1 {
+		t.Error("State wasn't reorganized ", state.GetBalance(), state.GetNonce())
+	}
+
+	canonical, _ := b.GetBlock(1)
+	if h := sha256.Sum256(canonical); !bytes.Equal(h[:], b1Hash) {
+		t.Error("Wrong canonical block at index 1")
+	}
+
+	// After the checkpoint a longer fork from before it is ignored
+	err = b.SetCheckpoint(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent, _ := blockchain.BlockHash(a1)
+	for index := uint64(2); index <= 4; index++ {
+		block := &protobufs.Block{Index: index, PrevHash: parent}
+		err = b.AddBlock(block, validators)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent, _ = blockchain.BlockHash(block)
+	}
+	if !bytes.Equal(b.HeadHash, b2Hash) {
+		t.Error("Head moved to a fork from before the checkpoint")
+	}
+
+	b3 := &protobufs.Block{Index: 3, PrevHash: b2Hash}
+	err = b.AddBlock(b3, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.HeadIndex != 3 {
+		t.Error("Head didn't move after the checkpoint")
+	}
+}
+
+func TestRepairPendingBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, _ := wallet.GenerateWallet(1)
+	sender, _ := w.GetWallet()
+
+	err = b.ApplyGenesis(&protobufs.Block{Index: 0}, map[string]*protobufs.AccountState{
+		sender: {Balance: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	// The node stopped after writing part of a block: the sender was
+	// changed and a new account was created
+	balances, err := leveldb.OpenFile(dir+"/.balances", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous, err := balances.Get([]byte(sender), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, _ := proto.Marshal(&protobufs.AccountState{Balance: 1, Nonce: 1})
+	balances.Put([]byte(sender), forged, nil)
+	balances.Put([]byte("DexmNew"), forged, nil)
+	balances.Close()
+
+	// The journal of the block, written before the state
+	journal, _ := json.Marshal(map[string]interface{}{
+		"Entries": []map[string]interface{}{
+			{"Db": "balances", "Key": []byte(sender), "Value": previous, "Missing": false},
+			{"Db": "balances", "Key": []byte("DexmNew"), "Value": nil, "Missing": true},
+		},
+	})
+	blocks, err := leveldb.OpenFile(dir+"/.blocks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks.Put([]byte("pending"), journal, nil)
+	blocks.Close()
+
+	b, err = blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := b.GetWalletState(sender)
+	if err != nil || state.GetBalance() != 1000 || state.GetNonce() != 0 {
+		t.Error("The previous state wasn't restored ", state.GetBalance(), state.GetNonce())
+	}
+	if _, err := b.GetWalletState("DexmNew"); err == nil {
+		t.Error("The account created by the block is still there")
+	}
+	b.Close()
+
+	blocks, err = leveldb.OpenFile(dir+"/.blocks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blocks.Close()
+	if _, err := blocks.Get([]byte("pending"), nil); err != leveldb.ErrNotFound {
+		t.Error("The journal wasn't removed ", err)
+	}
+}
@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+func TestContractLogs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	// Both emit the input, the first 32 bytes as topic and the rest as data,
+	// then fail traps
+	emit := []byte{
+		0x41, 0x00, 0x41, 0x20, // emit(0, 32,
+		0x41, 0x00, 0x41, 0xc0, 0x00, 0x10, 0x00, // data(0, 64)
+		0x41, 0x20, 0x6b, 0x10, 0x01, // - 32)
+	}
+	contract := c.deploy(buildModule([]hostImport{
+		{"data", []byte{i32, i32}, []byte{i32}},
+		{"emit", []byte{i32, i32, i32}, nil},
+	}, []wasmFunction{
+		{"main", nil, nil, append(emit, 0x0b)},
+		{"fail", nil, nil, append(emit, 0x00, 0x0b)},
+	}))
+
+	topicA := bytes.Repeat([]byte{'a'}, 32)
+	topicB := bytes.Repeat([]byte{'b'}, 32)
+
+	emitLog := func(function string, topic []byte, data string) *blockchain.Receipt {
+		return c.apply(&protobufs.Transaction{
+			Recipient: contract,
+			Function:  function,
+			Data:      append(append([]byte{}, topic...), data...),
+			Gas:       10000,
+		})
+	}
+
+	first := emitLog("main", topicA, "one")
+	if !first.Success || len(first.Logs) != 1 {
+		t.Fatal("The event wasn't emitted ", first.Error)
+	}
+	l := first.Logs[0]
+	if l.Address != contract || !bytes.Equal(l.Topic, topicA) || string(l.Data) != "one" {
+		t.Error("Wrong event ", l.Address, l.Topic, l.Data)
+	}
+
+	bloom, err := c.b.GetBloom(c.b.HeadHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bloom.Test([]byte(contract)) || !bloom.Test(topicA) || bloom.Test(topicB) {
+		t.Error("Wrong bloom")
+	}
+
+	emitLog("main", topicB, "two")
+
+	failed := emitLog("fail", topicA, "three")
+	if failed.Success || len(failed.Logs) != 0 {
+		t.Error("The event of a failed transaction was kept")
+	}
+
+	all, err := c.b.FilterLogs(blockchain.LogFilter{Address: contract, ToBlock: math.MaxUint64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || string(all[0].Data) != "one" || string(all[1].Data) != "two" {
+		t.Error("Wrong logs of the contract ", len(all))
+	}
+	if all[0].BlockIndex != first.BlockIndex || !bytes.Equal(all[0].TransactionHash, first.TransactionHash) {
+		t.Error("Wrong position of the log")
+	}
+
+	filters := []blockchain.LogFilter{
+		{Address: contract, Topic: topicA, ToBlock: math.MaxUint64},
+		{Topic: topicA, ToBlock: math.MaxUint64},
+		{Address: contract, ToBlock: first.BlockIndex},
+		{Topic: topicA, FromBlock: 0, ToBlock: first.BlockIndex},
+	}
+	for i, f := range filters {
+		logs, err := c.b.FilterLogs(f)
+		if err != nil || len(logs) != 1 || string(logs[0].Data) != "one" {
+			t.Error("Wrong result for filter ", i, len(logs), err)
+		}
+	}
+
+	logs, _ := c.b.FilterLogs(blockchain.LogFilter{Topic: topicB, FromBlock: first.BlockIndex + 1, ToBlock: math.MaxUint64})
+	if len(logs) != 1 || string(logs[0].Data) != "two" {
+		t.Error("Wrong logs after the first block ", len(logs))
+	}
+
+	if _, err := c.b.FilterLogs(blockchain.LogFilter{}); err == nil {
+		t.Error("Filter without address or topic worked")
+	}
+}
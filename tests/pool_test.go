@@ -0,0 +1,206 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func signedTransaction(t *testing.T, w *wallet.Wallet, nonce uint32, gas uint32) []byte {
+	return signedTransactionData(t, w, nonce, gas, nil)
+}
+
+func signedTransactionData(t *testing.T, w *wallet.Wallet, nonce uint32, gas uint32, data []byte) []byte {
+	pub, _ := w.GetPubKey()
+	tx := &protobufs.Transaction{
+		Sender:    pub,
+		Recipient: "DexmVoid",
+		Nonce:     nonce,
+		Amount:    10,
+		Gas:       gas,
+		Shard:     1,
+		Data:      data,
+	}
+
+	hash, _ := wallet.TransactionHash(tx)
+	r, s, err := w.Sign(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.R = r.Bytes()
+	tx.S = s.Bytes()
+
+	raw, _ := proto.Marshal(tx)
+	return raw
+}
+
+func TestMempool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := blockchain.NewBlockchain(dir+"/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	w, _ := wallet.GenerateWallet(1)
+	sender, _ := w.GetWallet()
+
+	err = b.ApplyGenesis(&protobufs.Block{Index: 0}, map[string]*protobufs.AccountState{
+		sender: {Balance: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.CurrentBlock = 1
+
+	// Nonce 2 has to wait for nonce 1
+	err = b.AddMempoolTransaction(signedTransaction(t, w, 2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, queued := b.MempoolSize(); pending != 0 || queued != 1 {
+		t.Error("Transaction with a future nonce isn't queued ", pending, queued)
+	}
+
+	err = b.AddMempoolTransaction(signedTransaction(t, w, 1, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, queued := b.MempoolSize(); pending != 2 || queued != 0 {
+		t.Error("Queued transaction wasn't promoted ", pending, queued)
+	}
+
+	// Replacing nonce 1 needs more gas
+	if b.AddMempoolTransaction(signedTransaction(t, w, 1, 1)) == nil {
+		t.Error("Replacement with the same gas accepted")
+	}
+	err = b.AddMempoolTransaction(signedTransaction(t, w, 1, 5))
+	if err != nil {
+		t.Error("Replacement with more gas rejected ", err)
+	}
+
+	// Already used nonces and forged transactions are rejected
+	if b.AddMempoolTransaction(signedTransaction(t, w, 0, 1)) == nil {
+		t.Error("Transaction with an old nonce accepted")
+	}
+	other, _ := wallet.GenerateWallet(1)
+	forged := &protobufs.Transaction{}
+	proto.Unmarshal(signedTransaction(t, other, 3, 1), forged)
+	forged.Sender, _ = w.GetPubKey()
+	raw, _ := proto.Marshal(forged)
+	if b.AddMempoolTransaction(raw) == nil {
+		t.Error("Forged transaction accepted")
+	}
+
+	block, err := b.GenerateBlock("", 1, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	txs := block.GetTransactions()
+	if len(txs) != 2 || txs[0].GetNonce() != 1 || txs[1].GetNonce() != 2 || txs[0].GetGas() != 5 {
+		t.Fatal("Wrong transactions in the block ", txs)
+	}
+
+	err = b.AddBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pending, queued := b.MempoolSize(); pending != 0 || queued != 0 {
+		t.Error("Imported transactions weren't pruned ", pending, queued)
+	}
+
+	state, _ := b.GetWalletState(sender)
+	if state.GetNonce() != 2 || state.GetBalance() != 1000-20-6 {
+		t.Error("Wrong state after the block ", state.GetBalance(), state.GetNonce())
+	}
+}
+
+func TestMempoolReplacement(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := blockchain.NewBlockchain(dir+"/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w1, _ := wallet.GenerateWallet(1)
+	w2, _ := wallet.GenerateWallet(1)
+	sender1, _ := w1.GetWallet()
+	sender2, _ := w2.GetWallet()
+
+	err = b.ApplyGenesis(&protobufs.Block{Index: 0}, map[string]*protobufs.AccountState{
+		sender1: {Balance: 1000},
+		sender2: {Balance: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cheap := signedTransaction(t, w1, 1, 10)
+	expensive := signedTransaction(t, w2, 1, 100)
+	b.SetMempoolLimits(10, len(cheap)+len(expensive)+50)
+
+	if b.AddMempoolTransaction(cheap) != nil || b.AddMempoolTransaction(expensive) != nil {
+		t.Fatal("Couldn't fill the mempool")
+	}
+
+	// The replacement pays more but it's too big to fit without evicting a
+	// transaction that pays more per byte
+	big := signedTransactionData(t, w1, 1, 20, make([]byte, 300))
+	if b.AddMempoolTransaction(big) == nil {
+		t.Fatal("Replacement that doesn't fit accepted")
+	}
+	if pending, queued := b.MempoolSize(); pending != 2 || queued != 0 {
+		t.Error("The rejected replacement changed the mempool ", pending, queued)
+	}
+
+	block, err := b.GenerateBlock("", 1, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	gas := make(map[uint32]bool)
+	for _, tx := range block.GetTransactions() {
+		gas[tx.GetGas()] = true
+	}
+	if len(block.GetTransactions()) != 2 || !gas[10] || !gas[100] {
+		t.Error("The replaced transaction isn't in the mempool anymore ", block.GetTransactions())
+	}
+
+	// A replacement that fits removes the old one from the disk as well
+	err = b.AddMempoolTransaction(signedTransaction(t, w1, 1, 15))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+
+	db, err := leveldb.OpenFile(dir+"/.mempool", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	saved := 0
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		saved++
+	}
+	iter.Release()
+	if saved != 2 {
+		t.Error("The replaced transaction is still saved ", saved)
+	}
+}
@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/networking"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/dexm-coin/protobufs/build/network"
+	"github.com/golang/protobuf/proto"
+)
+
+func signBlock(t *testing.T, w *wallet.Wallet, block *protobufs.Block) *network.Signature {
+	blockBytes, _ := proto.Marshal(block)
+	hash := sha256.Sum256(blockBytes)
+
+	r, s, err := w.Sign(hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, _ := w.GetPubKey()
+
+	return &network.Signature{
+		Pubkey: pub,
+		R:      r.Bytes(),
+		S:      s.Bytes(),
+		Data:   hash[:],
+	}
+}
+
+func TestVerifyBlockProposal(t *testing.T) {
+	validator, _ := wallet.GenerateWallet(1)
+	other, _ := wallet.GenerateWallet(1)
+	validatorWallet, _ := validator.GetWallet()
+	otherWallet, _ := other.GetWallet()
+
+	validators := blockchain.NewValidatorsBook()
+	validators.AddValidator(validatorWallet, 1000, -300, validator.GetPublicKeySchnorrByte())
+
+	genesis := uint64(1000000)
+	block := &protobufs.Block{
+		Index:     10,
+		Timestamp: genesis + 51,
+		Miner:     validatorWallet,
+		Shard:     1,
+	}
+	now := int64(genesis + 52)
+
+	err := networking.VerifyBlockProposal(block, signBlock(t, validator, block), validators, genesis, now)
+	if err != nil {
+		t.Error("Valid proposal rejected ", err)
+	}
+
+	// A block from someone that isn't the chosen validator
+	forged := &protobufs.Block{Index: 10, Timestamp: genesis + 51, Miner: otherWallet, Shard: 1}
+	err = networking.VerifyBlockProposal(forged, signBlock(t, other, forged), validators, genesis, now)
+	if _, ok := err.(*networking.InvalidProposerError); !ok {
+		t.Error("Block from the wrong proposer accepted ", err)
+	}
+
+	// Signed by someone else in the name of the validator
+	err = networking.VerifyBlockProposal(block, signBlock(t, other, block), validators, genesis, now)
+	if _, ok := err.(*networking.InvalidSignatureError); !ok {
+		t.Error("Block signed by the wrong key accepted ", err)
+	}
+
+	err = networking.VerifyBlockProposal(block, nil, validators, genesis, now)
+	if _, ok := err.(*networking.InvalidSignatureError); !ok {
+		t.Error("Unsigned block accepted ", err)
+	}
+
+	// A valid signature over a different block
+	sig := signBlock(t, validator, block)
+	changed := &protobufs.Block{Index: 10, Timestamp: genesis + 52, Miner: validatorWallet, Shard: 1}
+	err = networking.VerifyBlockProposal(changed, sig, validators, genesis, now)
+	if _, ok := err.(*networking.InvalidSignatureError); !ok {
+		t.Error("Block with a signature for another block accepted ", err)
+	}
+
+	future := &protobufs.Block{Index: 10, Timestamp: genesis + 51, Miner: validatorWallet, Shard: 1}
+	err = networking.VerifyBlockProposal(future, signBlock(t, validator, future), validators, genesis, int64(genesis+30))
+	if _, ok := err.(*networking.InvalidTimestampError); !ok {
+		t.Error("Block from the future accepted ", err)
+	}
+
+	err = networking.VerifyBlockProposal(block, signBlock(t, validator, block), validators, genesis, int64(genesis+500))
+	if _, ok := err.(*networking.InvalidTimestampError); !ok {
+		t.Error("Stale block accepted ", err)
+	}
+
+	outOfSlot := &protobufs.Block{Index: 10, Timestamp: genesis + 20, Miner: validatorWallet, Shard: 1}
+	err = networking.VerifyBlockProposal(outOfSlot, signBlock(t, validator, outOfSlot), validators, genesis, now)
+	if _, ok := err.(*networking.InvalidTimestampError); !ok {
+		t.Error("Block outside of its slot accepted ", err)
+	}
+}
@@ -0,0 +1,120 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+func TestPruning(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	w, _ := wallet.GenerateWallet(1)
+	recipient, _ := w.GetWallet()
+
+	var receipts []*blockchain.Receipt
+	for i := 0; i < 6; i++ {
+		receipts = append(receipts, c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 10}))
+	}
+
+	// Archive nodes keep everything
+	err = c.b.Prune(blockchain.PruneConfig{Mode: blockchain.PruneArchive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.b.GetWalletStateAt(recipient, 1); err != nil {
+		t.Error("Archive node pruned the state ", err)
+	}
+
+	// Nothing after the checkpoint is pruned, however many blocks are kept
+	err = c.b.SetCheckpoint(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.b.Prune(blockchain.PruneConfig{Mode: blockchain.PruneRecent, Keep: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.b.GetWalletStateAt(recipient, 2); err == nil {
+		t.Error("The state of block 2 wasn't pruned")
+	}
+	state, err := c.b.GetWalletStateAt(recipient, 3)
+	if err != nil || state.GetBalance() != 30 {
+		t.Error("The state of block 3 was pruned ", err)
+	}
+	if _, err := c.b.GetBlock(2); err != nil {
+		t.Error("Blocks are dropped when only the state is pruned")
+	}
+
+	err = c.b.Prune(blockchain.PruneConfig{Mode: blockchain.PruneFinalized})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.b.GetBlock(3); err == nil {
+		t.Error("A block before the checkpoint is still there")
+	}
+	if _, err := c.b.GetReceipt(receipts[2].TransactionHash); err == nil {
+		t.Error("A receipt before the checkpoint is still there")
+	}
+	if _, err := c.b.GetBlock(0); err != nil {
+		t.Error("The genesis was pruned")
+	}
+	if _, err := c.b.GetBlock(4); err != nil {
+		t.Error("The checkpoint was pruned")
+	}
+
+	// The head still has all its state and new blocks go on top of it
+	state, err = c.b.GetWalletStateAt(recipient, c.b.HeadIndex)
+	if err != nil || state.GetBalance() != 60 {
+		t.Fatal("The state of the head was pruned ", err)
+	}
+	root, _ := c.b.GetStateRoot(c.b.HeadHash)
+	proof, err := c.b.ProveAccount(root, c.sender)
+	if err != nil || !proof.Verify(root) {
+		t.Error("The trie of the head was pruned ", err)
+	}
+
+	r := c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 10})
+	if !r.Success {
+		t.Error(r.Error)
+	}
+
+	err = c.b.Compact()
+	if err != nil {
+		t.Error(err)
+	}
+
+	usage, err := blockchain.DiskUsage(dir + "/")
+	if err != nil || usage[".blocks"] == 0 {
+		t.Error("Wrong disk usage ", usage, err)
+	}
+}
+
+func TestParsePruneMode(t *testing.T) {
+	cfg, err := blockchain.ParsePruneMode("128")
+	if err != nil || cfg.Mode != blockchain.PruneRecent || cfg.Keep != 128 {
+		t.Error("Wrong mode ", cfg, err)
+	}
+
+	cfg, err = blockchain.ParsePruneMode("")
+	if err != nil || cfg.Mode != blockchain.PruneArchive {
+		t.Error("Nodes aren't archive by default")
+	}
+
+	if _, err := blockchain.ParsePruneMode("some"); err == nil {
+		t.Error("Parsed an invalid mode")
+	}
+}
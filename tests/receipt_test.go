@@ -0,0 +1,214 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+func TestReceipts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	w, _ := wallet.GenerateWallet(1)
+	sender, _ := w.GetWallet()
+	pub, _ := w.GetPubKey()
+
+	err = b.ApplyGenesis(&protobufs.Block{Index: 0}, map[string]*protobufs.AccountState{
+		sender: {Balance: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transactions := []*protobufs.Transaction{
+		{
+			Sender:    pub,
+			Recipient: "DexmVoid",
+			Nonce:     1,
+			Amount:    100,
+			Gas:       10,
+			Shard:     1,
+		},
+		// Calling a contract that doesn't exist fails but stays in the block
+		{
+			Sender:    pub,
+			Recipient: "DexmVoid",
+			Nonce:     2,
+			Amount:    100,
+			Gas:       10,
+			Shard:     1,
+			Function:  "main",
+		},
+	}
+
+	block := &protobufs.Block{
+		Index:             1,
+		PrevHash:          b.HeadHash,
+		Transactions:      transactions,
+		MerkleRootReceipt: []byte("wrong root"),
+	}
+	err = b.ApplyBlock(block, blockchain.NewValidatorsBook())
+	if err == nil {
+		t.Error("Block with a wrong receipts root was applied")
+	}
+
+	err = b.SealBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.ApplyBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the gas of the failed call is paid
+	state, _ := b.GetWalletState(sender)
+	if state.GetBalance() != 880 || state.GetNonce() != 2 {
+		t.Error("Wrong state after a failed transaction ", state.GetBalance(), state.GetNonce())
+	}
+
+	hash, _ := wallet.TransactionHash(transactions[0])
+	r, err := b.GetReceipt(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Success || r.BlockIndex != 1 || r.Sender != sender {
+		t.Error("Wrong receipt ", r)
+	}
+
+	hash, _ = wallet.TransactionHash(transactions[1])
+	r, err = b.GetReceipt(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Success || r.Error == "" || r.Failure != blockchain.FailureError {
+		t.Error("The failed call has a successful receipt ", r)
+	}
+
+	// Only the failure code is hashed, not the message
+	root, _ := blockchain.ReceiptsRoot([]*blockchain.Receipt{r}, []byte("state"))
+	message := *r
+	message.Error = "another message"
+	if other, _ := blockchain.ReceiptsRoot([]*blockchain.Receipt{&message}, []byte("state")); !bytes.Equal(root, other) {
+		t.Error("The error message changed the receipts root")
+	}
+	code := *r
+	code.Failure = blockchain.FailureOutOfGas
+	if other, _ := blockchain.ReceiptsRoot([]*blockchain.Receipt{&code}, []byte("state")); bytes.Equal(root, other) {
+		t.Error("The failure code didn't change the receipts root")
+	}
+
+	// What the receipts say was paid is what left the balance
+	first, _ := wallet.TransactionHash(transactions[0])
+	ok, _ := b.GetReceipt(first)
+	if ok.GasCharged != 10 || r.GasCharged != 10 || 1000-ok.Amount-ok.GasCharged-r.GasCharged != state.GetBalance() {
+		t.Error("The receipts don't match the balance ", ok.GasCharged, r.GasCharged)
+	}
+}
+
+func TestStateRootCommitment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	w, _ := wallet.GenerateWallet(1)
+	sender, _ := w.GetWallet()
+	pub, _ := w.GetPubKey()
+
+	// Two nodes with the same genesis
+	var chains []*blockchain.Blockchain
+	for _, name := range []string{"a", "b"} {
+		b, err := blockchain.NewBlockchain(dir+"/"+name+"/", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer b.Close()
+
+		err = b.ApplyGenesis(&protobufs.Block{Index: 0}, map[string]*protobufs.AccountState{
+			sender: {Balance: 1000},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chains = append(chains, b)
+	}
+	a, b := chains[0], chains[1]
+
+	tx := &protobufs.Transaction{
+		Sender:    pub,
+		Recipient: "DexmVoid",
+		Nonce:     1,
+		Amount:    100,
+		Gas:       10,
+		Shard:     1,
+	}
+	block := &protobufs.Block{Index: 1, PrevHash: a.HeadHash, Transactions: []*protobufs.Transaction{tx}}
+	err = a.SealBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.ApplyBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The receipts are right but the state root the block commits to isn't
+	hash, _ := wallet.TransactionHash(tx)
+	r, err := a.GetReceipt(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateRoot, _ := a.GetStateRoot(a.HeadHash)
+	if root, _ := blockchain.ReceiptsRoot([]*blockchain.Receipt{r}, stateRoot); !bytes.Equal(root, block.MerkleRootReceipt) {
+		t.Fatal("The receipts root doesn't match the saved receipts")
+	}
+	wrongRoot, _ := blockchain.ReceiptsRoot([]*blockchain.Receipt{r}, []byte("wrong state"))
+
+	forged := *block
+	forged.MerkleRootReceipt = wrongRoot
+	if b.ApplyBlock(&forged, blockchain.NewValidatorsBook()) == nil {
+		t.Error("Block with a wrong state root was applied")
+	}
+
+	forged.MerkleRootReceipt = nil
+	if b.ApplyBlock(&forged, blockchain.NewValidatorsBook()) == nil {
+		t.Error("Block without a receipts root was applied")
+	}
+
+	// A block without transactions can't commit to a different state
+	empty := &protobufs.Block{Index: 1, PrevHash: b.HeadHash, MerkleRootReceipt: wrongRoot}
+	if b.ApplyBlock(empty, blockchain.NewValidatorsBook()) == nil {
+		t.Error("Empty block with a receipts root was applied")
+	}
+
+	state, _ := b.GetWalletState(sender)
+	if state.GetBalance() != 1000 || state.GetNonce() != 0 {
+		t.Error("Rejected blocks changed the state ", state.GetBalance(), state.GetNonce())
+	}
+
+	err = b.ApplyBlock(block, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootB, _ := b.GetStateRoot(b.HeadHash)
+	if !bytes.Equal(rootB, stateRoot) {
+		t.Error("The nodes disagree on the state")
+	}
+}
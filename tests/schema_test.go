@@ -0,0 +1,158 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+func TestMigrateLegacyBlocks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Blocks under their index and a pending transaction under its hash,
+	// the way old nodes saved them
+	genesis, _ := proto.Marshal(&protobufs.Block{Index: 0, Timestamp: 1000})
+	genesisHash := sha256.Sum256(genesis)
+	block, _ := proto.Marshal(&protobufs.Block{Index: 1, Timestamp: 1005, PrevHash: genesisHash[:]})
+	blockHash := sha256.Sum256(block)
+
+	db, err := leveldb.OpenFile(dir+"/.blocks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Put([]byte("0"), genesis, nil)
+	db.Put([]byte("1"), block, nil)
+	db.Put(bytes.Repeat([]byte{1}, 32), []byte("pending"), nil)
+	db.Close()
+
+	if _, err := blockchain.NewBlockchain(dir+"/", 0); err == nil {
+		t.Fatal("Opened a database with the old layout")
+	}
+
+	err = blockchain.Migrate(dir + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	hashes := b.GetBlocksAtIndex(1)
+	if len(hashes) != 1 || !bytes.Equal(hashes[0], blockHash[:]) {
+		t.Error("The block wasn't migrated")
+	}
+	if raw, err := b.GetBlockByHash(genesisHash[:]); err != nil || !bytes.Equal(raw, genesis) {
+		t.Error("The genesis wasn't migrated")
+	}
+	if pending, queued := b.MempoolSize(); pending+queued != 0 {
+		t.Error("An invalid transaction was added to the mempool")
+	}
+}
+
+func TestTransactionLocation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	w, _ := wallet.GenerateWallet(1)
+	recipient, _ := w.GetWallet()
+
+	r := c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 50})
+
+	tx, loc, err := c.b.GetTransaction(r.TransactionHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tx.GetRecipient() != recipient || loc.BlockIndex != r.BlockIndex || loc.Position != 0 || !bytes.Equal(loc.BlockHash, c.b.HeadHash) {
+		t.Error("Wrong transaction location ", loc)
+	}
+
+	// Migrating a node with the current layout changes nothing
+	c.b.Close()
+	err = blockchain.Migrate(dir + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.b, err = blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.b.GetTransaction(r.TransactionHash); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMigrateTransactionIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	w, _ := wallet.GenerateWallet(1)
+	recipient, _ := w.GetWallet()
+	r := c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 50})
+	c.b.Close()
+
+	// A node at version 1 had no index of the transactions
+	db, err := leveldb.OpenFile(dir+"/.blocks", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batch := new(leveldb.Batch)
+	iter := db.NewIterator(nil, nil)
+	for iter.Next() {
+		if iter.Key()[0] == 'x' || iter.Key()[0] == 'w' {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	batch.Put([]byte("version"), []byte("1"))
+	db.Write(batch, nil)
+	db.Close()
+
+	if _, err := blockchain.NewBlockchain(dir+"/", 0); err == nil {
+		t.Fatal("Opened a database with the old layout")
+	}
+
+	err = blockchain.Migrate(dir + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	loc, err := b.GetTransactionLocation(r.TransactionHash)
+	if err != nil || loc.BlockIndex != r.BlockIndex {
+		t.Error("The transaction wasn't indexed ", loc, err)
+	}
+	history, err := b.GetAddressHistory(recipient, 0, b.HeadIndex, 10)
+	if err != nil || len(history) != 1 || !history[0].Received {
+		t.Error("The history of the wallet wasn't indexed ", history, err)
+	}
+}
@@ -0,0 +1,96 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+func TestSimulateTransaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	contract := c.deploy(buildModule([]hostImport{
+		{"emit", []byte{i32, i32, i32}, nil},
+		{"revert", nil, nil},
+	}, []wasmFunction{
+		// add(a: i32, b: i64) : i64 and emit(0, 0, 4)
+		{"add", []byte{i32, i64}, []byte{i64}, []byte{
+			0x41, 0x00, 0x41, 0x00, 0x41, 0x04, 0x10, 0x00,
+			0x20, 0x00, 0xad, 0x20, 0x01, 0x7c, 0x0b,
+		}},
+		{"fail", nil, nil, []byte{0x10, 0x01, 0x0b}},
+	}))
+
+	before, _ := c.b.GetWalletState(c.sender)
+	head := c.b.HeadIndex
+
+	simulate := func(function string, args []uint64) *blockchain.Receipt {
+		r, err := c.b.SimulateTransaction(&protobufs.Transaction{
+			Sender:    c.pub,
+			Recipient: contract,
+			Function:  function,
+			Args:      args,
+			Shard:     1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	r := simulate("add", []uint64{2, 40})
+	if !r.Success || r.GasUsed == 0 || r.ReturnValue == nil || *r.ReturnValue != 42 {
+		t.Error("Wrong simulation ", r.Error, r.GasUsed)
+	}
+	if len(r.Logs) != 1 || len(r.Logs[0].Data) != 4 {
+		t.Error("The events weren't returned")
+	}
+
+	r = simulate("fail", nil)
+	if r.Success || r.Error != blockchain.ErrReverted.Error() {
+		t.Error("The revert reason wasn't returned ", r.Error)
+	}
+
+	after, _ := c.b.GetWalletState(c.sender)
+	if after.GetBalance() != before.GetBalance() || after.GetNonce() != before.GetNonce() || c.b.HeadIndex != head {
+		t.Error("The simulation changed the state")
+	}
+
+	// The simulated gas is enough for the real transaction
+	gas := simulate("add", []uint64{2, 40}).GasUsed
+	r = c.apply(&protobufs.Transaction{
+		Recipient: contract,
+		Function:  "add",
+		Args:      []uint64{2, 40},
+		Gas:       uint32(gas),
+	})
+	if !r.Success || r.GasUsed != gas {
+		t.Error("The simulation used different gas ", r.GasUsed, gas)
+	}
+
+	// Simulations can't ask for more gas than the node gives them
+	loop := c.deploy(contractModule([]byte{0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b}))
+	r, err = c.b.SimulateTransaction(&protobufs.Transaction{
+		Sender:    c.pub,
+		Recipient: loop,
+		Function:  "main",
+		Gas:       1 << 31,
+		Shard:     1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Failure != blockchain.FailureOutOfGas || r.GasUsed > 1000000 {
+		t.Error("The simulation gas isn't capped ", r.Error, r.GasUsed)
+	}
+}
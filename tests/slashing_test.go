@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/networking"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+func TestDoubleProposalSlashing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	w, _ := wallet.GenerateWallet(1)
+	wal, _ := w.GetWallet()
+	pub, _ := w.GetPubKey()
+
+	validators := blockchain.NewValidatorsBook()
+	validators.AddValidator(wal, 1000, -300, w.GetPublicKeySchnorrByte())
+
+	err = b.ApplyGenesis(&protobufs.Block{Index: 0}, map[string]*protobufs.AccountState{
+		"DexmPoS": {Balance: 1000},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	genesisHash := b.HeadHash
+
+	// Two different blocks signed for the same slot
+	first := &protobufs.Block{Index: 5, Miner: wal, Shard: 1, Timestamp: 1}
+	second := &protobufs.Block{Index: 5, Miner: wal, Shard: 1, Timestamp: 2}
+
+	sig := signBlock(t, w, first)
+	if b.Slashing.ObserveProposal(first, pub, sig.R, sig.S) != nil {
+		t.Error("Evidence found with a single proposal")
+	}
+	sig = signBlock(t, w, second)
+	evidence := b.Slashing.ObserveProposal(second, pub, sig.R, sig.S)
+	if evidence == nil {
+		t.Fatal("Double proposal not detected")
+	}
+	if evidence.Verify() != nil {
+		t.Error("Evidence isn't valid ", evidence.Verify())
+	}
+
+	tx, _ := evidence.SlashingTransaction()
+	block := &protobufs.Block{Index: 6, PrevHash: b.HeadHash, Transactions: []*protobufs.Transaction{tx}}
+	err = b.SealBlock(block, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.AddBlock(block, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stake, _ := validators.GetStake(wal)
+	if stake != 0 || validators.CheckDynasty(wal, 300) {
+		t.Error("Validator wasn't slashed")
+	}
+	pos, _ := b.GetWalletState("DexmPoS")
+	if pos.GetBalance() != 0 {
+		t.Error("Stake wasn't burned ", pos.GetBalance())
+	}
+	if len(b.Slashing.PendingEvidence()) != 0 {
+		t.Error("Evidence still pending after being included")
+	}
+
+	// The same validator can't be slashed twice
+	block = &protobufs.Block{Index: 7, PrevHash: b.HeadHash, Transactions: []*protobufs.Transaction{tx}}
+	err = b.SealBlock(block, validators)
+	if err == nil {
+		err = b.ApplyBlock(block, validators)
+	}
+	if err == nil {
+		t.Error("Validator slashed twice")
+	}
+
+	// A longer fork without the slash reverts it, the evidence has to go
+	// in a block of the new branch
+	parent := genesisHash
+	for index := uint64(1); index <= 2; index++ {
+		fork := &protobufs.Block{Index: index, PrevHash: parent}
+		err = b.AddBlock(fork, validators)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parent, _ = blockchain.BlockHash(fork)
+	}
+	if b.HeadIndex != 2 {
+		t.Fatal("The head didn't move to the fork")
+	}
+	if stake, _ := validators.GetStake(wal); stake != 1000 {
+		t.Error("The stake wasn't given back ", stake)
+	}
+	pending := b.Slashing.PendingEvidence()
+	if len(pending) != 1 || pending[0].Offender != wal {
+		t.Error("The evidence isn't pending again ", pending)
+	}
+}
+
+func TestVoteSlashingEvidence(t *testing.T) {
+	w, _ := wallet.GenerateWallet(1)
+	pub, _ := w.GetPubKey()
+	detector := blockchain.NewSlashingDetector()
+
+	v1 := networking.CreateVote([]byte("s1"), []byte("t1"), 0, 100, w)
+	v2 := networking.CreateVote([]byte("s1"), []byte("t2"), 0, 200, w)
+	if detector.ObserveVote(&v1, pub) != nil || detector.ObserveVote(&v2, pub) != nil {
+		t.Error("Votes with different targets reported")
+	}
+
+	// Same target height, different target
+	v3 := networking.CreateVote([]byte("s1"), []byte("t3"), 0, 100, w)
+	evidence := detector.ObserveVote(&v3, pub)
+	if evidence == nil || evidence.Verify() != nil {
+		t.Error("Double vote not detected")
+	}
+
+	// A vote surrounding another one
+	other, _ := wallet.GenerateWallet(1)
+	otherPub, _ := other.GetPubKey()
+	inner := networking.CreateVote([]byte("s2"), []byte("t4"), 100, 200, other)
+	outer := networking.CreateVote([]byte("s1"), []byte("t5"), 50, 300, other)
+	detector.ObserveVote(&inner, otherPub)
+	evidence = detector.ObserveVote(&outer, otherPub)
+	if evidence == nil || evidence.Verify() != nil {
+		t.Error("Surround vote not detected")
+	}
+
+	// Evidence with a vote changed after signing
+	outer.TargetHeight = 250
+	forged := &blockchain.Evidence{
+		Offender:  evidence.Offender,
+		PublicKey: otherPub,
+		Votes:     []*protobufs.CasperVote{&inner, &outer},
+	}
+	if forged.Verify() == nil {
+		t.Error("Forged evidence accepted")
+	}
+}
@@ -0,0 +1,170 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir+"/a")
+	defer c.b.Close()
+
+	w, _ := wallet.GenerateWallet(1)
+	recipient, _ := w.GetWallet()
+
+	c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 50})
+	c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 20})
+
+	// The checkpoint is an empty block, so the state root is bound to it by
+	// the block before
+	empty := &protobufs.Block{Index: c.b.HeadIndex + 1, PrevHash: c.b.HeadHash}
+	err = c.b.ApplyBlock(empty, blockchain.NewValidatorsBook())
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := c.b.HeadIndex
+	err = c.b.SetCheckpoint(checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkpointRoot, _ := c.b.GetStateRoot(c.b.CheckpointHash)
+
+	// Changes after the checkpoint aren't in the snapshot
+	c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 30})
+	c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 40})
+
+	validators := blockchain.NewValidatorsBook()
+	validators.AddValidator(recipient, 500, 0, w.GetPublicKeySchnorrByte())
+
+	var buf bytes.Buffer
+	err = c.b.ExportSnapshot(&buf, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := append([]byte{}, buf.Bytes()...)
+
+	snap, err := blockchain.ReadSnapshot(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(snap.StateRoot, checkpointRoot) {
+		t.Error("The snapshot isn't at the checkpoint")
+	}
+	trusted := c.b.CheckpointHash
+	validatorsHash, err := snap.ValidatorsHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := blockchain.NewBlockchain(dir+"/b/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	imported := blockchain.NewValidatorsBook()
+	err = b.ImportSnapshot(snap, trusted, validatorsHash, imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.HeadIndex != checkpoint || !bytes.Equal(b.HeadHash, c.b.CheckpointHash) || b.CurrentCheckpoint != checkpoint {
+		t.Error("Wrong head after the snapshot ", b.HeadIndex)
+	}
+	state, err := b.GetWalletState(recipient)
+	if err != nil || state.GetBalance() != 70 {
+		t.Error("Wrong balance after the snapshot ", state.GetBalance(), err)
+	}
+	if !imported.CheckIsValidator(recipient) {
+		t.Error("The validators weren't imported")
+	}
+	if _, err := b.GetBlock(0); err != nil {
+		t.Error("The genesis wasn't imported")
+	}
+
+	// Only the blocks after the snapshot are needed
+	for index := checkpoint + 1; index <= c.b.HeadIndex; index++ {
+		rawBlock, err := c.b.GetBlock(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block := &protobufs.Block{}
+		proto.Unmarshal(rawBlock, block)
+
+		err = b.ApplyBlock(block, imported)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rootA, _ := c.b.GetStateRoot(c.b.HeadHash)
+	rootB, _ := b.GetStateRoot(b.HeadHash)
+	if !bytes.Equal(rootA, rootB) {
+		t.Error("The nodes disagree on the state")
+	}
+
+	// The state of another chain, with its own valid state root
+	other := newContractChain(t, dir+"/d")
+	defer other.b.Close()
+	other.apply(&protobufs.Transaction{Recipient: recipient, Amount: 5000})
+	other.b.SetCheckpoint(other.b.HeadIndex)
+
+	buf.Reset()
+	err = other.b.ExportSnapshot(&buf, validators)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSnap, err := blockchain.ReadSnapshot(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forgeries := map[string]func(*blockchain.Snapshot){
+		"changed balance": func(s *blockchain.Snapshot) {
+			s.State[0].Value = []byte("forged")
+		},
+		"recomputed state root": func(s *blockchain.Snapshot) {
+			s.State = otherSnap.State
+			s.StateRoot = otherSnap.StateRoot
+		},
+		"other checkpoint": func(s *blockchain.Snapshot) {
+			*s = *otherSnap
+		},
+		"changed receipts": func(s *blockchain.Snapshot) {
+			s.Receipts = otherSnap.Receipts
+		},
+		"missing ancestors": func(s *blockchain.Snapshot) {
+			s.Ancestors = nil
+		},
+		"changed validators": func(s *blockchain.Snapshot) {
+			s.Validators[0].Stake = 1000000
+		},
+	}
+	for name, forge := range forgeries {
+		snap, _ = blockchain.ReadSnapshot(bytes.NewReader(raw))
+		forge(snap)
+
+		forged, err := blockchain.NewBlockchain(dir+"/c/", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if forged.ImportSnapshot(snap, trusted, validatorsHash, blockchain.NewValidatorsBook()) == nil {
+			t.Error("Imported a forged snapshot: ", name)
+		}
+		forged.Close()
+		os.RemoveAll(dir + "/c/")
+	}
+}
@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestTransactionHash(t *testing.T) {
+	w, _ := wallet.GenerateWallet(1)
+	w.Balance = 1000
+
+	tx, err := w.RawTransaction("DexmVoid", 10, 1, []byte{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, _ := wallet.TransactionHash(tx)
+	unsigned := proto.Clone(tx).(*protobufs.Transaction)
+	unsigned.R = nil
+	unsigned.S = nil
+	unsignedHash, _ := wallet.TransactionHash(unsigned)
+
+	if !bytes.Equal(hash, unsignedHash) {
+		t.Error("The hash depends on the signature")
+	}
+
+	valid, err := wallet.TransactionSignatureValid(tx)
+	if !valid || err != nil {
+		t.Error("Signature of a new transaction isn't valid ", err)
+	}
+}
+
+func TestForgedTransactions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	b, err := blockchain.NewBlockchain(dir+"/", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	w, _ := wallet.GenerateWallet(1)
+	attacker, _ := wallet.GenerateWallet(1)
+	sender, _ := w.GetWallet()
+	w.Balance = 1000
+
+	b.SetState(sender, &protobufs.AccountState{Balance: 1000})
+
+	tx, err := w.RawTransaction("DexmVoid", 10, 1, []byte{}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.ValidateTransaction(tx)
+	if err != nil {
+		t.Error("Valid transaction rejected ", err)
+	}
+	valid, err := b.ValidateBlock(&protobufs.Block{Index: 1, Transactions: []*protobufs.Transaction{tx}})
+	if !valid {
+		t.Error("Block with a valid transaction rejected ", err)
+	}
+
+	// Changing the amount after signing
+	changed := proto.Clone(tx).(*protobufs.Transaction)
+	changed.Amount = 900
+
+	// Signed by someone else in the name of the sender
+	other := proto.Clone(tx).(*protobufs.Transaction)
+	hash, _ := wallet.TransactionHash(other)
+	r, s, _ := attacker.Sign(hash)
+	other.R = r.Bytes()
+	other.S = s.Bytes()
+
+	// No signature at all
+	unsigned := proto.Clone(tx).(*protobufs.Transaction)
+	unsigned.R = nil
+	unsigned.S = nil
+
+	for _, forged := range []*protobufs.Transaction{changed, other, unsigned} {
+		if b.ValidateTransaction(forged) == nil {
+			t.Error("ValidateTransaction accepted a forged transaction")
+		}
+
+		valid, _ := b.ValidateBlock(&protobufs.Block{Index: 1, Transactions: []*protobufs.Transaction{forged}})
+		if valid {
+			t.Error("ValidateBlock accepted a forged transaction")
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+func TestAddressHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	w, _ := wallet.GenerateWallet(1)
+	recipient, _ := w.GetWallet()
+
+	first := c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 50})
+	c.apply(&protobufs.Transaction{Recipient: c.sender, Amount: 1})
+	last := c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 20})
+
+	status, err := c.b.GetTransactionStatus(first.TransactionHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.BlockIndex != first.BlockIndex || status.Position != 0 || !status.Receipt.Success || status.Receipt.Amount != 50 {
+		t.Error("Wrong transaction status ", status)
+	}
+
+	if _, err := c.b.GetTransactionStatus([]byte("missing")); err == nil {
+		t.Error("Got the status of a transaction that isn't in a block")
+	}
+
+	history, err := c.b.GetAddressHistory(recipient, 0, c.b.HeadIndex, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 2 || !bytes.Equal(history[0].TransactionHash, first.TransactionHash) || !bytes.Equal(history[1].TransactionHash, last.TransactionHash) {
+		t.Fatal("Wrong history of the recipient ", history)
+	}
+	if !history[0].Received || history[0].Sent {
+		t.Error("The recipient didn't receive the transfer")
+	}
+
+	history, _ = c.b.GetAddressHistory(c.sender, 0, c.b.HeadIndex, 100)
+	if len(history) != 3 || !history[0].Sent || history[0].Received || !history[1].Sent || !history[1].Received {
+		t.Error("Wrong history of the sender ", history)
+	}
+
+	// Range and limit
+	history, _ = c.b.GetAddressHistory(c.sender, first.BlockIndex+1, c.b.HeadIndex, 1)
+	if len(history) != 1 || history[0].BlockIndex != first.BlockIndex+1 {
+		t.Error("Wrong history from a block ", history)
+	}
+	history, _ = c.b.GetAddressHistory(recipient, 0, first.BlockIndex, 100)
+	if len(history) != 1 {
+		t.Error("Wrong history till a block ", history)
+	}
+}
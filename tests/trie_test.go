@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+	"github.com/golang/protobuf/proto"
+)
+
+func TestStateRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	genesisRoot, err := c.b.GetStateRoot(c.b.HeadHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := c.b.ProveAccount(genesisRoot, c.sender)
+	if err != nil || !proof.Verify(genesisRoot) {
+		t.Fatal("Invalid proof of the sender ", err)
+	}
+	state := &protobufs.AccountState{}
+	if proto.Unmarshal(proof.Value, state) != nil || state.GetBalance() != 10000000 {
+		t.Error("Wrong state in the proof")
+	}
+
+	proof.Value = []byte("forged")
+	if proof.Verify(genesisRoot) {
+		t.Error("Forged proof verified")
+	}
+
+	w, _ := wallet.GenerateWallet(1)
+	recipient, _ := w.GetWallet()
+
+	proof, err = c.b.ProveAccount(genesisRoot, recipient)
+	if err != nil || proof.Value != nil || !proof.Verify(genesisRoot) {
+		t.Error("Invalid proof of exclusion ", err)
+	}
+
+	c.apply(&protobufs.Transaction{Recipient: recipient, Amount: 50})
+
+	root, _ := c.b.GetStateRoot(c.b.HeadHash)
+	if bytes.Equal(root, genesisRoot) {
+		t.Fatal("The state root didn't change")
+	}
+
+	proof, err = c.b.ProveAccount(root, recipient)
+	if err != nil || !proof.Verify(root) || proto.Unmarshal(proof.Value, state) != nil || state.GetBalance() != 50 {
+		t.Error("Invalid proof of the recipient ", err)
+	}
+
+	// The old root can still be read
+	proof, err = c.b.ProveAccount(genesisRoot, recipient)
+	if err != nil || proof.Value != nil || !proof.Verify(genesisRoot) {
+		t.Error("The old root isn't readable ", err)
+	}
+	if proof.Verify(root) {
+		t.Error("Proof of exclusion verified with the wrong root")
+	}
+
+	// Removing a key gives back the root without it
+	sb := c.b.NewStateBatch()
+	sb.SetStorage([]byte("contract"), []byte("a"), []byte{1})
+	withA, _ := sb.StateRoot(root)
+	sb.SetStorage([]byte("contract"), []byte("b"), []byte{2})
+	withAB, _ := sb.StateRoot(root)
+	sb.SetStorage([]byte("contract"), []byte("b"), nil)
+	removed, _ := sb.StateRoot(withAB)
+	if !bytes.Equal(withA, removed) || bytes.Equal(withA, withAB) {
+		t.Error("The trie depends on its history")
+	}
+
+	proof, err = c.b.ProveStorage(root, "contract", []byte("a"))
+	if err != nil || proof.Value != nil || !proof.Verify(root) {
+		t.Error("Invalid proof of storage ", err)
+	}
+}
@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dexm-coin/dexmd/blockchain"
+	"github.com/dexm-coin/dexmd/wallet"
+	protobufs "github.com/dexm-coin/protobufs/build/blockchain"
+)
+
+func TestContractUpgrade(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dexm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := newContractChain(t, dir)
+	defer c.b.Close()
+
+	v1 := buildModule([]hostImport{
+		{"data", []byte{i32, i32}, []byte{i32}},
+		{"approvePatch", []byte{i32}, nil},
+		{"lock", []byte{i32}, nil},
+		{"unlock", nil, nil},
+	}, []wasmFunction{
+		// Writes 42 at 200
+		{"init", nil, nil, []byte{0x41, 0xc8, 0x01, 0x41, 0x2a, 0x36, 0x02, 0x00, 0x0b}},
+		// approvePatch(data)
+		{"approve", nil, nil, []byte{
+			0x41, 0x00, 0x41, 0x20, 0x10, 0x00, 0x1a, 0x41, 0x00, 0x10, 0x01, 0x0b,
+		}},
+		// lock(data)
+		{"lock", nil, nil, []byte{
+			0x41, 0xe4, 0x00, 0x41, 0xc0, 0x00, 0x10, 0x00, 0x1a, 0x41, 0xe4, 0x00, 0x10, 0x02, 0x0b,
+		}},
+		{"unlock", nil, nil, []byte{0x10, 0x03, 0x0b}},
+	})
+	// Returns what's at 200 plus one
+	v2 := buildModule(nil, []wasmFunction{
+		{"version", nil, []byte{i32}, []byte{
+			0x41, 0xc8, 0x01, 0x28, 0x02, 0x00, 0x41, 0x01, 0x6a, 0x0b,
+		}},
+	})
+
+	contract := c.deploy(v1)
+
+	upgrade := func() *blockchain.Receipt {
+		return c.apply(&protobufs.Transaction{
+			Recipient:        contract,
+			ContractCreation: true,
+			Data:             v2,
+			Gas:              100000,
+		})
+	}
+	run := func(function string, data []byte) *blockchain.Receipt {
+		r := c.apply(&protobufs.Transaction{
+			Recipient: contract,
+			Function:  function,
+			Data:      data,
+			Gas:       10000,
+		})
+		if !r.Success {
+			t.Fatal(function, " failed ", r.Error)
+		}
+		return r
+	}
+
+	if r := upgrade(); r.Success {
+		t.Error("Upgrade without approval worked")
+	}
+
+	run("approve", blockchain.CodeHash(v2))
+
+	w, _ := wallet.GenerateWallet(1)
+	owner, _ := w.GetWallet()
+	run("lock", []byte(owner))
+
+	if r := upgrade(); r.Success {
+		t.Error("Upgrade of a locked contract worked")
+	}
+
+	run("unlock", nil)
+
+	r := upgrade()
+	if !r.Success {
+		t.Fatal("Upgrade failed ", r.Error)
+	}
+
+	r = run("version", nil)
+	if r.ReturnValue == nil || *r.ReturnValue != 43 {
+		t.Error("The code wasn't replaced or the memory wasn't kept")
+	}
+
+	history, err := c.b.NewStateBatch().GetContractHistory([]byte(contract))
+	if err != nil || len(history) != 1 {
+		t.Fatal("Wrong history ", err)
+	}
+	if !bytes.Equal(history[0].PreviousHash, blockchain.CodeHash(v1)) ||
+		!bytes.Equal(history[0].Hash, blockchain.CodeHash(v2)) ||
+		history[0].BlockIndex != r.BlockIndex-1 || history[0].Sender != c.sender {
+		t.Error("Wrong upgrade in the history ", history[0])
+	}
+
+	// Every approval is good for one upgrade
+	if r := upgrade(); r.Success {
+		t.Error("The same approval was used twice")
+	}
+
+	// The wallet a contract is locked to can still upgrade it
+	contract = c.deploy(v1)
+	if history, err := c.b.GetContractHistory(contract); err != nil || len(history) != 0 {
+		t.Error("New contract with a history ", history, err)
+	}
+
+	run("approve", blockchain.CodeHash(v2))
+	run("lock", []byte(c.sender))
+
+	r = upgrade()
+	if !r.Success {
+		t.Fatal("Upgrade by the lock owner failed ", r.Error)
+	}
+	history, err = c.b.GetContractHistory(contract)
+	if err != nil || len(history) != 1 || history[0].Sender != c.sender || history[0].BlockIndex != r.BlockIndex {
+		t.Error("Wrong history after the upgrade by the lock owner ", history, err)
+	}
+
+	if _, err := c.b.GetContractHistory(owner); err == nil {
+		t.Error("History of a wallet that isn't a contract")
+	}
+}
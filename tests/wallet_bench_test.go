@@ -8,7 +8,7 @@ import (
 )
 
 func benchmarkEncryption(l int, b *testing.B) {
-	w, _ := wallet.GenerateWallet()
+	w, _ := wallet.GenerateWallet(1)
 
 	k := make([]byte, l)
 	// Use math/rand so it's faster in benchmarks don't use it in actual code
@@ -10,12 +10,12 @@ import (
 )
 
 func TestWalletGeneration(t *testing.T) {
-	w1, err := wallet.GenerateWallet()
+	w1, err := wallet.GenerateWallet(1)
 	if err != nil {
 		t.Error(err)
 	}
 
-	w2, err := wallet.GenerateWallet()
+	w2, err := wallet.GenerateWallet(1)
 	if err != nil {
 		t.Error(err)
 	}
@@ -43,7 +43,7 @@ func TestWalletGeneration(t *testing.T) {
 }
 
 func TestTransaction(t *testing.T) {
-	w, err := wallet.GenerateWallet()
+	w, err := wallet.GenerateWallet(1)
 	if err != nil {
 		t.Error(err)
 	}
@@ -63,7 +63,7 @@ func TestTransaction(t *testing.T) {
 }
 
 func TestImportExport(t *testing.T) {
-	w, err := wallet.GenerateWallet()
+	w, err := wallet.GenerateWallet(1)
 	if err != nil {
 		t.Error(err)
 	}
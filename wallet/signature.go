@@ -3,6 +3,7 @@ package wallet
 import (
 	"crypto/ecdsa"
 	"crypto/x509"
+	"errors"
 	"math/big"
 )
 
@@ -13,11 +14,16 @@ func SignatureValid(x509pub, r, s, data []byte) (bool, error) {
 		return false, err
 	}
 
+	pub, ok := genericPubKey.(*ecdsa.PublicKey)
+	if !ok {
+		return false, errors.New("The public key isn't an ECDSA key")
+	}
+
 	rb := new(big.Int)
 	sb := new(big.Int)
 
 	rb.SetBytes(r)
 	sb.SetBytes(s)
 
-	return ecdsa.Verify(genericPubKey.(*ecdsa.PublicKey), data, rb, sb), nil
+	return ecdsa.Verify(pub, data, rb, sb), nil
 }
@@ -6,6 +6,7 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"crypto/x509"
+	"encoding/binary"
 	"encoding/json"
 	"encoding/pem"
 	"errors"
@@ -232,6 +233,27 @@ func BytesToAddress(data []byte, shard uint32) string {
 	return wal
 }
 
+// ContractAddress returns the address of the contract deployed by the
+// transaction of sender with nonce. It's BytesToAddress of the sender address
+// followed by the nonce as 4 big endian bytes, so wallets know the address
+// before the transaction is sent.
+func ContractAddress(sender string, nonce uint32, shard uint32) string {
+	data := make([]byte, len(sender)+4)
+	copy(data, sender)
+	binary.BigEndian.PutUint32(data[len(sender):], nonce)
+
+	return BytesToAddress(data, shard)
+}
+
+// AddressMatches checks that a public key belongs to a wallet address. The
+// shard is ignored because it isn't derived from the key.
+func AddressMatches(pubKey []byte, wal string) bool {
+	if len(wal) < 6 {
+		return false
+	}
+	return BytesToAddress(pubKey, 0)[6:] == wal[6:]
+}
+
 // Sign signs the bytes passed to it with ECDSA
 func (w *Wallet) Sign(data []byte) (r, s *big.Int, e error) {
 	r, s, err := ecdsa.Sign(rand.Reader, w.PrivKey, data)
@@ -289,6 +311,12 @@ func base58Encoding(bin []byte) string {
 // RawTransaction returns a struct with a transaction. Used in GopherJS to avoid
 // protobuf which uses the unsupported unsafe
 func (w *Wallet) RawTransaction(recipient string, amount uint64, gas uint32, data []byte, shard uint32) (*protobufs.Transaction, error) {
+	return w.RawContractCall(recipient, "", nil, amount, gas, data, shard)
+}
+
+// RawContractCall is RawTransaction calling function of the contract at
+// recipient with args. Without a function data is the code of a new contract.
+func (w *Wallet) RawContractCall(recipient, function string, args []uint64, amount uint64, gas uint32, data []byte, shard uint32) (*protobufs.Transaction, error) {
 	if !IsWalletValid(recipient) {
 		return nil, errors.New("Invalid recipient")
 	}
@@ -315,18 +343,20 @@ func (w *Wallet) RawTransaction(recipient string, amount uint64, gas uint32, dat
 		Timestamp: uint64(time.Now().Unix()),
 		Data:      data,
 		Shard:     shard,
+		Function:  function,
+		Args:      args,
 	}
 
-	if len(data) != 0 {
+	if len(data) != 0 && function == "" {
 		newT.ContractCreation = true
 	}
 
-	result, err := proto.Marshal(newT)
+	hash, err := TransactionHash(newT)
 	if err != nil {
 		return nil, err
 	}
 
-	r, s, err := w.Sign(result)
+	r, s, err := w.Sign(hash)
 	if err != nil {
 		return nil, err
 	}
@@ -337,6 +367,38 @@ func (w *Wallet) RawTransaction(recipient string, amount uint64, gas uint32, dat
 	return newT, nil
 }
 
+// UnsignedTransactionBytes returns a transaction encoded without R and S,
+// that's the part of the transaction covered by the signature
+func UnsignedTransactionBytes(t *protobufs.Transaction) ([]byte, error) {
+	unsigned := proto.Clone(t).(*protobufs.Transaction)
+	unsigned.R = nil
+	unsigned.S = nil
+
+	return proto.Marshal(unsigned)
+}
+
+// TransactionHash returns the hash that identifies a transaction. It's what
+// the sender signs, so it doesn't depend on the signature.
+func TransactionHash(t *protobufs.Transaction) ([]byte, error) {
+	data, err := UnsignedTransactionBytes(t)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(data)
+	return hash[:], nil
+}
+
+// TransactionSignatureValid checks that a transaction was signed by its sender
+func TransactionSignatureValid(t *protobufs.Transaction) (bool, error) {
+	hash, err := TransactionHash(t)
+	if err != nil {
+		return false, err
+	}
+
+	return SignatureValid(t.GetSender(), t.GetR(), t.GetS(), hash)
+}
+
 // NewTransaction generates a signed transaction for the given arguments without
 // broadcasting it to the newtwork
 func (w *Wallet) NewTransaction(recipient string, amount uint64, gas uint32, data []byte, shard uint32) ([]byte, error) {